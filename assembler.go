@@ -19,6 +19,9 @@ type Assembler struct {
 
 	idx *block.IndexBlock
 
+	// Optional transform applied to the data of each block before it is written
+	transform func(index uint64, data []byte) ([]byte, error)
+
 	runtime time.Duration
 }
 
@@ -37,16 +40,12 @@ func (asm *Assembler) Runtime() time.Duration {
 }
 
 // SetRoot retreives the block associated to the id.  This is used to retreive
-// complete indexes ar trees
+// complete indexes ar trees.  For an index tree this is the root index.
 func (asm *Assembler) SetRoot(id []byte) (*block.IndexBlock, error) {
-	root, err := asm.dev.GetBlock(id)
+	idx, err := getIndexBlock(asm.dev, id)
 	if err != nil {
 		return nil, err
 	}
-	idx, ok := root.(*block.IndexBlock)
-	if !ok {
-		return nil, fmt.Errorf("not an index block")
-	}
 
 	asm.idx = idx
 	return idx, nil
@@ -146,9 +145,13 @@ func (asm *Assembler) assemble(done <-chan struct{}, bids <-chan shard, out chan
 
 			var rd io.ReadCloser
 			if rd, err = blk.Reader(); err == nil {
-				rslt.id, rslt.err = ioutil.ReadAll(rd)
+				rslt.id, err = ioutil.ReadAll(rd)
 				rd.Close()
 			}
+
+			if err == nil && asm.transform != nil {
+				rslt.id, err = asm.transform(bid.Index, rslt.id)
+			}
 		}
 
 		if err != nil {
@@ -173,7 +176,8 @@ func (asm *Assembler) assembleFromIndexBlock(done <-chan struct{}) (<-chan shard
 	go func(idx *block.IndexBlock) {
 		defer close(blocks)
 
-		errc <- idx.Iter(func(index uint64, id []byte) error {
+		// Child indexes are fetched lazily as the tree is walked
+		errc <- iterIndexTree(asm.dev, idx, func(index uint64, id []byte) error {
 			sh := shard{Index: index, Data: id}
 
 			select {
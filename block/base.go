@@ -51,3 +51,8 @@ func (block *baseBlock) Size() uint64 {
 func (block *baseBlock) SetSize(size uint64) {
 	block.size = size
 }
+
+// hashFunc returns the hash function generator of the block
+func (block *baseBlock) hashFunc() func() hash.Hash {
+	return block.hasher
+}
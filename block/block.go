@@ -25,6 +25,9 @@ const (
 	// BlockTypeMeta defines a metadata block containing the id of the a tree, index or
 	// data block and key-value metadata
 	BlockTypeMeta
+	// BlockTypeHAMT defines a block of a hash array mapped trie of directory
+	// entries used in place of a tree block for large directories
+	BlockTypeHAMT
 )
 
 func (blockType BlockType) String() (str string) {
@@ -37,6 +40,8 @@ func (blockType BlockType) String() (str string) {
 		str = "tree"
 	case BlockTypeMeta:
 		str = "meta"
+	case BlockTypeHAMT:
+		str = "hamt"
 	default:
 		str = "0x" + hex.EncodeToString([]byte{byte(blockType)})
 	}
@@ -65,7 +70,7 @@ type Block interface {
 }
 
 // New returns a new Block of the given type. It takes a uri used to determine the source
-// of the block and a hasher.  The hasher is only required for TreeBlocks
+// of the block and a hasher.  The hasher is required for all block types
 func New(typ BlockType, uri *URI, hasher func() hash.Hash) (blk Block, err error) {
 	switch typ {
 	case BlockTypeData:
@@ -74,6 +79,10 @@ func New(typ BlockType, uri *URI, hasher func() hash.Hash) (blk Block, err error
 		blk = NewIndexBlock(uri, hasher)
 	case BlockTypeTree:
 		blk = NewTreeBlock(uri, hasher)
+	case BlockTypeMeta:
+		blk = NewMetaBlock(uri, hasher)
+	case BlockTypeHAMT:
+		blk = NewHAMTBlock(uri, hasher)
 	default:
 		err = ErrInvalidBlockType
 	}
@@ -0,0 +1,197 @@
+package block
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// CodecType identifies the codec used to encode the stored data of a block
+type CodecType byte
+
+const (
+	// CodecTypeNone means the data is stored as is
+	CodecTypeNone CodecType = iota
+	// CodecTypeGzip compresses data using gzip
+	CodecTypeGzip
+	// CodecTypeDeflate compresses data using deflate
+	CodecTypeDeflate
+)
+
+// encodedFlag is set on the stored block type byte when the data is encoded by a
+// codec.  It is followed by the 1-byte codec type and 8-byte logical data size.
+const encodedFlag byte = 0x80
+
+// codecHeaderSize is the size of the header of encoded stored data including the
+// block type
+const codecHeaderSize = 10
+
+// ErrUnknownCodec is used when a codec type has not been registered
+var ErrUnknownCodec = errors.New("unknown codec")
+
+func (typ CodecType) String() string {
+	switch typ {
+	case CodecTypeNone:
+		return "none"
+	case CodecTypeGzip:
+		return "gzip"
+	case CodecTypeDeflate:
+		return "deflate"
+	}
+	return fmt.Sprintf("0x%02x", byte(typ))
+}
+
+// Codec encodes and decodes the stored data of a block.  The id of a block is
+// always computed over the logical i.e. decoded data so the codec does not affect
+// deduplication.
+type Codec interface {
+	// Type of the codec.  This is recorded with the stored block
+	Type() CodecType
+	// NewWriter returns a WriteCloser encoding data to the writer.  Closing it
+	// does not close the underlying writer
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+	// NewReader returns a ReadCloser decoding data from the reader
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+// GzipCodec is a gzip codec
+type GzipCodec struct {
+	Level int
+}
+
+// Type returns CodecTypeGzip
+func (c *GzipCodec) Type() CodecType {
+	return CodecTypeGzip
+}
+
+// NewWriter returns a gzip writer with the codec compression level
+func (c *GzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return gzip.NewWriterLevel(w, c.Level)
+}
+
+// NewReader returns a gzip reader
+func (c *GzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// DeflateCodec is a raw deflate codec
+type DeflateCodec struct {
+	Level int
+}
+
+// Type returns CodecTypeDeflate
+func (c *DeflateCodec) Type() CodecType {
+	return CodecTypeDeflate
+}
+
+// NewWriter returns a deflate writer with the codec compression level
+func (c *DeflateCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	return flate.NewWriter(w, c.Level)
+}
+
+// NewReader returns a deflate reader
+func (c *DeflateCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return flate.NewReader(r), nil
+}
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[CodecType]Codec{
+		CodecTypeGzip:    &GzipCodec{Level: gzip.DefaultCompression},
+		CodecTypeDeflate: &DeflateCodec{Level: flate.DefaultCompression},
+	}
+)
+
+// RegisterCodec registers a codec used to decode stored blocks of its type.  It
+// replaces any existing codec of the same type.
+func RegisterCodec(codec Codec) {
+	codecsMu.Lock()
+	codecs[codec.Type()] = codec
+	codecsMu.Unlock()
+}
+
+// GetCodec returns the registered codec for the type.  A nil codec is returned
+// for CodecTypeNone
+func GetCodec(typ CodecType) (Codec, error) {
+	if typ == CodecTypeNone {
+		return nil, nil
+	}
+
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+
+	codec, ok := codecs[typ]
+	if !ok {
+		return nil, ErrUnknownCodec
+	}
+	return codec, nil
+}
+
+// BlockCodec returns the codec the block data should be stored with or nil if the
+// block does not use a codec
+func BlockCodec(blk Block) Codec {
+	if cb, ok := blk.(interface {
+		Codec() Codec
+	}); ok {
+		return cb.Codec()
+	}
+	return nil
+}
+
+// CodecTypeOf returns the type of the codec handling a nil codec
+func CodecTypeOf(codec Codec) CodecType {
+	if codec == nil {
+		return CodecTypeNone
+	}
+	return codec.Type()
+}
+
+// writeCodecHeader writes the block type with the encoded flag, codec type and
+// logical size of the data
+func writeCodecHeader(wr io.Writer, typ BlockType, codec CodecType, size uint64) error {
+	hdr := make([]byte, codecHeaderSize)
+	hdr[0] = byte(typ) | encodedFlag
+	hdr[1] = byte(codec)
+	binary.BigEndian.PutUint64(hdr[2:], size)
+
+	n, err := wr.Write(hdr)
+	if err == nil && n != len(hdr) {
+		err = errIncompleteWrite
+	}
+	return err
+}
+
+// readCodecHeader reads the header of stored data.  If the data is not encoded
+// only the block type is read and a nil codec is returned
+func readCodecHeader(r io.Reader) (BlockType, Codec, uint64, error) {
+	typ, err := ReadBlockType(r)
+	if err != nil || byte(typ)&encodedFlag == 0 {
+		return typ, nil, 0, err
+	}
+
+	hdr := make([]byte, codecHeaderSize-1)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return typ, nil, 0, err
+	}
+
+	codec, err := GetCodec(CodecType(hdr[0]))
+	return BlockType(byte(typ) &^ encodedFlag), codec, binary.BigEndian.Uint64(hdr[1:]), err
+}
+
+// decodeReadCloser closes both the decoder and the underlying source
+type decodeReadCloser struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (rc *decodeReadCloser) Close() error {
+	err := rc.ReadCloser.Close()
+	if e := rc.src.Close(); e != nil {
+		err = e
+	}
+	return err
+}
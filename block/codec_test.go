@@ -0,0 +1,77 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_FileDataBlock_codec(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "codec-")
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("compressible-data-"), 1000)
+	plain, _ := newMemDataBlock(data)
+
+	for _, codec := range []Codec{&GzipCodec{Level: 9}, &DeflateCodec{Level: 9}} {
+		cdir := filepath.Join(dir, codec.Type().String())
+		os.Mkdir(cdir, 0755)
+
+		blk := NewFileDataBlock(NewURI("file://"+cdir), sha256.New)
+		blk.SetCodec(codec)
+		wr, err := blk.Writer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = wr.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		if err = wr.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// Id is defined over the logical data
+		if !bytes.Equal(blk.ID(), plain.ID()) {
+			t.Fatalf("%s id mismatch %x != %x", codec.Type(), blk.ID(), plain.ID())
+		}
+
+		stat, err := os.Stat(blk.URI().Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stat.Size() >= int64(len(data)) {
+			t.Fatalf("%s data not compressed size=%d", codec.Type(), stat.Size())
+		}
+
+		lblk, err := LoadFileDataBlock(blk.URI(), sha256.New)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lblk.Size() != uint64(len(data)) {
+			t.Fatalf("%s size mismatch %d != %d", codec.Type(), lblk.Size(), len(data))
+		}
+		if CodecTypeOf(lblk.Codec()) != codec.Type() {
+			t.Fatal("codec mismatch")
+		}
+
+		rd, err := lblk.Reader()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := ioutil.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Fatalf("%s data mismatch", codec.Type())
+		}
+	}
+
+	if _, err := GetCodec(CodecType(0x7f)); err != ErrUnknownCodec {
+		t.Fatal("should fail with", ErrUnknownCodec, err)
+	}
+}
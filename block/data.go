@@ -24,6 +24,8 @@ type MemDataBlock struct {
 	*baseBlock
 	data []byte
 	rb   *bytes.Buffer
+	// Codec the data should be stored with
+	codec Codec
 }
 
 // NewMemDataBlock inits a new DataBlock
@@ -32,6 +34,17 @@ func NewMemDataBlock(uri *URI, hasher func() hash.Hash) *MemDataBlock {
 		baseBlock: &baseBlock{uri: uri, typ: BlockTypeData, hasher: hasher}}
 }
 
+// SetCodec sets the codec the block data should be stored with.  The in-memory
+// data is never encoded
+func (block *MemDataBlock) SetCodec(codec Codec) {
+	block.codec = codec
+}
+
+// Codec returns the codec the block data should be stored with
+func (block *MemDataBlock) Codec() Codec {
+	return block.codec
+}
+
 // Writer initializes a write buffer returning a WriteCloser
 func (block *MemDataBlock) Writer() (io.WriteCloser, error) {
 	block.hw = NewHasherWriter(block.hasher(), bytes.NewBuffer(nil))
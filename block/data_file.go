@@ -1,6 +1,7 @@
 package block
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"hash"
 	"io"
@@ -9,10 +10,14 @@ import (
 	"path/filepath"
 )
 
-// FileDataBlock is a block with a file as its store.
+// FileDataBlock is a block with a file as its store.  If a codec is set the file
+// contains a header with the codec and logical size followed by the encoded data.
 type FileDataBlock struct {
 	*baseBlock
 	th *os.File // temp file handle for writer
+
+	codec Codec          // codec used to encode the stored data
+	cw    io.WriteCloser // codec writer for the temp file
 }
 
 // NewFileDataBlock instantiates a new Block for the given type
@@ -35,10 +40,24 @@ func LoadFileDataBlock(uri *URI, hasher func() hash.Hash) (*FileDataBlock, error
 	}
 
 	fp := uri.Path
-	stat, err := os.Stat(fp)
+	fh, err := os.Open(fp)
 	if err != nil {
 		return nil, ErrBlockNotFound
 	}
+	defer fh.Close()
+
+	stat, err := fh.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	_, codec, size, err := readCodecHeader(fh)
+	if err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		size = uint64(stat.Size() - 1) // deduct 1-byte type
+	}
 
 	blk := &FileDataBlock{
 		baseBlock: &baseBlock{
@@ -46,15 +65,27 @@ func LoadFileDataBlock(uri *URI, hasher func() hash.Hash) (*FileDataBlock, error
 			id:     id,
 			typ:    BlockTypeData,
 			uri:    uri,
-			size:   uint64(stat.Size() - 1), // deduct 1-byte type
+			size:   size,
 		},
+		codec: codec,
 	}
 
-	return blk, err
+	return blk, nil
+}
+
+// SetCodec sets the codec used to encode the data on write.  It must be set before
+// calling Writer
+func (block *FileDataBlock) SetCodec(codec Codec) {
+	block.codec = codec
+}
+
+// Codec returns the codec the stored data is encoded with
+func (block *FileDataBlock) Codec() Codec {
+	return block.codec
 }
 
 // Reader reads data from block.  It first burns the 1-byte type then returns a ReadCloser to the
-// actual data
+// actual data.  Encoded data is decoded by the returned reader.
 func (block *FileDataBlock) Reader() (io.ReadCloser, error) {
 	fh, err := os.OpenFile(block.uri.Path, os.O_RDONLY, 0555)
 	//fh, err := os.Open(block.uri.Path)
@@ -62,13 +93,24 @@ func (block *FileDataBlock) Reader() (io.ReadCloser, error) {
 		return nil, err
 	}
 
-	// Burn type from reader
-	if _, err = ReadBlockType(fh); err != nil {
+	// Burn type and codec header from reader
+	_, codec, _, err := readCodecHeader(fh)
+	if err != nil {
 		fh.Close()
 		return nil, err
 	}
 
-	return fh, nil
+	if codec == nil {
+		return fh, nil
+	}
+
+	dec, err := codec.NewReader(fh)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	return &decodeReadCloser{ReadCloser: dec, src: fh}, nil
 }
 
 // Writer returns a new writer closer to write data to the block.  It initializes a hashing
@@ -84,9 +126,15 @@ func (block *FileDataBlock) Writer() (io.WriteCloser, error) {
 	block.th = fh
 	tmpfile := fh.Name()
 
-	block.hw = NewHasherWriter(block.hasher(), fh)
-	// Write type before returning writer
-	if err = WriteBlockType(block.hw, block.typ); err != nil {
+	if block.codec != nil {
+		err = block.initCodecWriter()
+	} else {
+		block.hw = NewHasherWriter(block.hasher(), fh)
+		// Write type before returning writer
+		err = WriteBlockType(block.hw, block.typ)
+	}
+
+	if err != nil {
 		fh.Close()
 		os.Remove(tmpfile)
 		block.th = nil
@@ -96,6 +144,39 @@ func (block *FileDataBlock) Writer() (io.WriteCloser, error) {
 	return block, err
 }
 
+// initCodecWriter writes the codec header with a placeholder size and sets up the
+// hasher to hash the type and logical data while writing encoded data
+func (block *FileDataBlock) initCodecWriter() error {
+	err := writeCodecHeader(block.th, block.typ, block.codec.Type(), 0)
+	if err != nil {
+		return err
+	}
+
+	if block.cw, err = block.codec.NewWriter(block.th); err != nil {
+		return err
+	}
+
+	block.hw = NewHasherWriter(block.hasher(), block.cw)
+	// Hash the type without writing it to the encoded data
+	_, err = block.hw.hasher.Write([]byte{byte(block.typ)})
+	return err
+}
+
+// closeCodecWriter flushes the encoded data and writes the logical size to the
+// header
+func (block *FileDataBlock) closeCodecWriter() error {
+	err := block.cw.Close()
+	block.cw = nil
+	if err != nil {
+		return err
+	}
+
+	sz := make([]byte, 8)
+	binary.BigEndian.PutUint64(sz, block.size)
+	_, err = block.th.WriteAt(sz, codecHeaderSize-8)
+	return err
+}
+
 // Write writes and hashes the data by writing it to the underlying writer.  It also updates
 // the block size
 func (block *FileDataBlock) Write(b []byte) (int, error) {
@@ -107,8 +188,15 @@ func (block *FileDataBlock) Write(b []byte) (int, error) {
 
 // Close closes the Writer, writes the hash id to the block and resets the writer.
 func (block *FileDataBlock) Close() error {
+	var err error
+	if block.cw != nil {
+		err = block.closeCodecWriter()
+	}
+
 	// Close temp file.
-	err := block.th.Close()
+	if e := block.th.Close(); err == nil {
+		err = e
+	}
 	if err == nil {
 		// Write block id hash to cache
 		block.id = block.hw.Hash()
@@ -126,19 +214,25 @@ func (block *FileDataBlock) Close() error {
 		} else {
 			err = ErrBlockExists
 		}
-		// Remove tmpfile
-		os.Remove(oldname)
 
 	}
+	// Remove tmpfile
+	os.Remove(block.th.Name())
 
 	block.th = nil
 	block.hw = nil
 	return err
 }
 
-// Hash computes the hash of the underlying file, updates the internal hash id and
-// returns the hash
+// Hash computes the hash of the type and logical data of the underlying file,
+// updates the internal hash id and returns the hash.  It returns nil if the file
+// cannot be read.
 func (block *FileDataBlock) Hash() []byte {
-	// TODO:
-	return nil
+	sum, err := hashBlock(block.hasher(), block)
+	if err != nil {
+		return nil
+	}
+
+	block.id = sum
+	return block.id
 }
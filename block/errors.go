@@ -12,6 +12,8 @@ var (
 	ErrBlockNotFound = errors.New("block not found")
 	// ErrBlockExists is used when a block already exists
 	ErrBlockExists = errors.New("block exists")
+	// ErrBlockCorrupt is used when the block content does not match its id
+	ErrBlockCorrupt = errors.New("block corrupt")
 	// ErrInvalidBlockType is used if an unsupported block type is encountered
 	ErrInvalidBlockType = errors.New("invalid block type")
 	// ErrReadBlockType is an error when the type cannot be read
@@ -19,6 +21,11 @@ var (
 	// ErrWriteBlockType is an error when the type cannot be written
 	ErrWriteBlockType    = errors.New("failed to write BlockType")
 	ErrUnsupportedScheme = errors.New("unsupported scheme")
+	// ErrInvalidNodeName is used when a tree node name is empty, "." or ".." or
+	// contains a "/"
+	ErrInvalidNodeName = errors.New("invalid tree node name")
+	// ErrDuplicateNode is used when a tree contains the same name more than once
+	ErrDuplicateNode = errors.New("duplicate tree node")
 
 	errReaderWriterOpen = errors.New("reader/writer already open")
 	errIncompleteWrite  = errors.New("incomplete write")
@@ -35,6 +42,9 @@ func ParseError(e string) error {
 	case ErrBlockExists.Error():
 		return ErrBlockExists
 
+	case ErrBlockCorrupt.Error():
+		return ErrBlockCorrupt
+
 	case ErrInvalidBlock.Error():
 		return ErrInvalidBlock
 
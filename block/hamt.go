@@ -0,0 +1,385 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"hash"
+	"io"
+	"sort"
+	"sync"
+)
+
+const (
+	// hamtBits is the number of name hash bits consumed at each depth
+	hamtBits = 6
+	// HAMTWidth is the number of slots in a HAMTBlock
+	HAMTWidth = 1 << hamtBits
+	// HAMTBucketSize is the maximum number of nodes stored in a slot.  A slot with
+	// more nodes is split into a child HAMTBlock one level deeper.
+	HAMTBucketSize = 4
+	// MaxHAMTDepth is the deepest HAMTBlock depth before the name hash is
+	// exhausted.  Slots of blocks at this depth are never split.
+	MaxHAMTDepth = sha256.Size*8/hamtBits - 1
+
+	hamtFormatV1 byte = 1
+
+	// Slot kinds
+	hamtSlotNodes byte = 0
+	hamtSlotChild byte = 1
+)
+
+// HAMTSlotIndex returns the slot of the name in a HAMTBlock at the depth.  It uses
+// the sha256 hash of the name independent of the block hasher so the layout of a
+// directory is the same on all devices.
+func HAMTSlotIndex(name string, depth int) int {
+	if depth > MaxHAMTDepth {
+		depth = MaxHAMTDepth
+	}
+	sum := sha256.Sum256([]byte(name))
+
+	var v int
+	bit := depth * hamtBits
+	for i := 0; i < hamtBits; i++ {
+		b := sum[(bit+i)/8] >> (7 - uint((bit+i)%8)) & 1
+		v = v<<1 | int(b)
+	}
+	return v
+}
+
+// HAMTSlot is a single slot of a HAMTBlock.  It either holds the id of a child
+// HAMTBlock or the nodes hashing to the slot.
+type HAMTSlot struct {
+	// Id of the child HAMTBlock.  Nil if the slot holds nodes
+	Child []byte
+	// Nodes in the slot sorted by name
+	Nodes []*TreeNode
+}
+
+// HAMTBlock is a block of a hash array mapped trie of directory entries used in
+// place of a TreeBlock for very large directories.  Each block has HAMTWidth
+// slots indexed by the bits of the name hash at the depth of the block, so a
+// change only rewrites the blocks along the path to the modified slot.  The root
+// block is at depth 0.  The binary format is the 1-byte type, a zero byte marker,
+// 1-byte format version, 1-byte node format version, 1-byte depth, uvarint count
+// of all nodes in the trie, uvarint slot count followed by each used slot in
+// order.  A slot is the 1-byte index, 1-byte kind and either the uvarint length
+// prefixed child id or the uvarint node count followed by the binary nodes.
+type HAMTBlock struct {
+	*baseBlock
+
+	mu sync.RWMutex
+	// Depth of the block in the trie
+	depth uint8
+	// Total number of nodes in the block and all of its children
+	count uint64
+	// Used slots
+	slots map[int]*HAMTSlot
+
+	// Read buffer initialized when calling Reader()
+	rbuf *bytes.Buffer
+}
+
+// NewHAMTBlock inits a new HAMTBlock with the uri and hasher. The uri may be nil.
+func NewHAMTBlock(uri *URI, hasher func() hash.Hash) *HAMTBlock {
+	blk := &HAMTBlock{
+		baseBlock: &baseBlock{uri: uri, typ: BlockTypeHAMT, hasher: hasher},
+		slots:     make(map[int]*HAMTSlot),
+	}
+	blk.Hash()
+	return blk
+}
+
+// Depth returns the depth of the block in the trie
+func (block *HAMTBlock) Depth() int {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+	return int(block.depth)
+}
+
+// SetDepth sets the depth of the block in the trie
+func (block *HAMTBlock) SetDepth(depth int) {
+	block.mu.Lock()
+	block.depth = uint8(depth)
+	block.mu.Unlock()
+}
+
+// Count returns the number of nodes in the block and all of its children
+func (block *HAMTBlock) Count() uint64 {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+	return block.count
+}
+
+// SetCount sets the number of nodes in the block and all of its children
+func (block *HAMTBlock) SetCount(count uint64) {
+	block.mu.Lock()
+	block.count = count
+	block.mu.Unlock()
+}
+
+// Slot returns the slot at the index or nil if it is unused
+func (block *HAMTBlock) Slot(i int) *HAMTSlot {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+	return block.slots[i]
+}
+
+// SetSlot sets the slot at the index.  A nil or empty slot clears it.  Nodes are
+// sorted by name.  Hash must be called once all slots are set.
+func (block *HAMTBlock) SetSlot(i int, slot *HAMTSlot) {
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	if slot == nil || (slot.Child == nil && len(slot.Nodes) == 0) {
+		delete(block.slots, i)
+		return
+	}
+	sort.Slice(slot.Nodes, func(a, b int) bool {
+		return slot.Nodes[a].Name < slot.Nodes[b].Name
+	})
+	block.slots[i] = slot
+}
+
+// IterSlots iterates over the used slots in order
+func (block *HAMTBlock) IterSlots(f func(i int, slot *HAMTSlot) error) error {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	for _, i := range block.sortedSlots() {
+		if err := f(i, block.slots[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash computes the hash of the block updating the internal id and size.  It
+// returns the hash id
+func (block *HAMTBlock) Hash() []byte {
+	b := block.MarshalBinary()
+
+	h := block.hasher()
+	h.Write(b)
+	block.id = h.Sum(nil)
+	block.size = uint64(len(b[1:]))
+	return block.id
+}
+
+// MarshalBinary marshals the HAMTBlock into bytes
+func (block *HAMTBlock) MarshalBinary() []byte {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	keys := block.sortedSlots()
+
+	version := treeFormatV2
+	for _, slot := range block.slots {
+		for _, node := range slot.Nodes {
+			if v := node.version(); v > version {
+				version = v
+			}
+		}
+	}
+
+	b := []byte{byte(block.typ), 0, hamtFormatV1, version, block.depth}
+	b = appendUvarint(b, block.count)
+	b = appendUvarint(b, uint64(len(keys)))
+	for _, i := range keys {
+		slot := block.slots[i]
+		b = append(b, byte(i))
+		if slot.Child != nil {
+			b = append(b, hamtSlotChild)
+			b = appendBytes(b, slot.Child)
+			continue
+		}
+
+		b = append(b, hamtSlotNodes)
+		b = appendUvarint(b, uint64(len(slot.Nodes)))
+		for _, node := range slot.Nodes {
+			b = node.appendBinary(b, version)
+		}
+	}
+	return b
+}
+
+// UnmarshalBinary unmarshals the byte slice into the HAMTBlock.  It returns an
+// error if a node is in the wrong slot for the depth.
+func (block *HAMTBlock) UnmarshalBinary(b []byte) error {
+	if len(b) < 5 || b[1] != 0 || b[2] != hamtFormatV1 {
+		return ErrInvalidBlock
+	}
+	version, depth := b[3], b[4]
+	if version < treeFormatV2 || version > treeFormatV4 || int(depth) > MaxHAMTDepth {
+		return ErrInvalidBlock
+	}
+
+	count, rest, err := readUvarint(b[5:])
+	if err != nil {
+		return err
+	}
+	n, rest, err := readUvarint(rest)
+	if err != nil {
+		return err
+	}
+	if n > HAMTWidth {
+		return ErrInvalidBlock
+	}
+
+	var (
+		slots = make(map[int]*HAMTSlot, n)
+		prev  = -1
+		total uint64
+	)
+	for j := uint64(0); j < n; j++ {
+		if len(rest) < 2 {
+			return ErrInvalidBlock
+		}
+		i, kind := int(rest[0]), rest[1]
+		if i <= prev || i >= HAMTWidth {
+			return ErrInvalidBlock
+		}
+		prev = i
+		rest = rest[2:]
+
+		slot := &HAMTSlot{}
+		switch kind {
+		case hamtSlotChild:
+			var child []byte
+			if child, rest, err = readBytes(rest); err != nil {
+				return err
+			}
+			if len(child) == 0 {
+				return ErrInvalidBlock
+			}
+			slot.Child = append([]byte{}, child...)
+
+		case hamtSlotNodes:
+			var nc uint64
+			if nc, rest, err = readUvarint(rest); err != nil {
+				return err
+			}
+			if nc == 0 || nc > uint64(len(rest)) {
+				return ErrInvalidBlock
+			}
+			slot.Nodes = make([]*TreeNode, nc)
+			for k := range slot.Nodes {
+				tn := &TreeNode{}
+				if rest, err = tn.decode(rest, version); err != nil {
+					return err
+				}
+				if HAMTSlotIndex(tn.Name, int(depth)) != i {
+					return ErrInvalidBlock
+				}
+				if k > 0 && tn.Name <= slot.Nodes[k-1].Name {
+					return ErrDuplicateNode
+				}
+				slot.Nodes[k] = tn
+			}
+			total += nc
+
+		default:
+			return ErrInvalidBlock
+		}
+		slots[i] = slot
+	}
+
+	if len(rest) != 0 || total > count {
+		return ErrInvalidBlock
+	}
+
+	block.mu.Lock()
+	block.typ = BlockType(b[0])
+	block.depth = depth
+	block.count = count
+	block.slots = slots
+	block.size = uint64(len(b[1:]))
+	block.mu.Unlock()
+
+	return nil
+}
+
+// MarshalJSON is a custom json marshaller for HAMTBlock
+func (block *HAMTBlock) MarshalJSON() ([]byte, error) {
+	type slot struct {
+		Index int
+		Child string     `json:",omitempty"`
+		Nodes []TreeNode `json:",omitempty"`
+	}
+	t := struct {
+		ID    string
+		Size  uint64
+		Depth int
+		Count uint64
+		Slots []slot
+	}{
+		ID:    hex.EncodeToString(block.ID()),
+		Size:  block.Size(),
+		Depth: block.Depth(),
+		Count: block.Count(),
+		Slots: make([]slot, 0),
+	}
+
+	block.IterSlots(func(i int, s *HAMTSlot) error {
+		js := slot{Index: i, Child: hex.EncodeToString(s.Child)}
+		for _, n := range s.Nodes {
+			js.Nodes = append(js.Nodes, *n)
+		}
+		t.Slots = append(t.Slots, js)
+		return nil
+	})
+
+	return json.Marshal(t)
+}
+
+// Reader inits the internal buffer for reading and writes the bytes to it.  It
+// returns a io.ReadCloser
+func (block *HAMTBlock) Reader() (io.ReadCloser, error) {
+	b := block.MarshalBinary()
+	block.rbuf = bytes.NewBuffer(b[1:])
+	return block, nil
+}
+
+func (block *HAMTBlock) Read(p []byte) (int, error) {
+	return block.rbuf.Read(p)
+}
+
+// Writer returns a new writer to allow writing raw bytes to the HAMTBlock.  Data
+// is unmarshalled into the block once the writer is closed.
+func (block *HAMTBlock) Writer() (io.WriteCloser, error) {
+	block.hw = NewHasherWriter(block.hasher(), bytes.NewBuffer(nil))
+	err := WriteBlockType(block.hw, block.typ)
+	return block, err
+}
+
+func (block *HAMTBlock) Write(p []byte) (int, error) {
+	return block.hw.Write(p)
+}
+
+// Close closes the reader and writer.  On a write close the written data is
+// unmarshalled into the block
+func (block *HAMTBlock) Close() error {
+	block.rbuf = nil
+
+	if block.hw == nil {
+		return nil
+	}
+
+	block.id = block.hw.Hash()
+
+	buf := block.hw.uw.(*bytes.Buffer)
+	b := buf.Bytes()
+	block.hw = nil
+
+	return block.UnmarshalBinary(b)
+}
+
+func (block *HAMTBlock) sortedSlots() []int {
+	keys := make([]int, 0, len(block.slots))
+	for i := range block.slots {
+		keys = append(keys, i)
+	}
+	sort.Ints(keys)
+	return keys
+}
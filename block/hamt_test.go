@@ -0,0 +1,97 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func Test_HAMTSlotIndex(t *testing.T) {
+	seen := make(map[int]bool)
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("file-%d", i)
+		for depth := 0; depth <= MaxHAMTDepth+1; depth++ {
+			idx := HAMTSlotIndex(name, depth)
+			if idx < 0 || idx >= HAMTWidth {
+				t.Fatalf("slot out of range %d", idx)
+			}
+			if idx != HAMTSlotIndex(name, depth) {
+				t.Fatal("slot should be deterministic")
+			}
+		}
+		seen[HAMTSlotIndex(name, 0)] = true
+	}
+	if len(seen) != HAMTWidth {
+		t.Fatalf("slots not evenly used %d", len(seen))
+	}
+}
+
+func Test_HAMTBlock(t *testing.T) {
+	depth := 1
+	h := NewHAMTBlock(nil, sha256.New)
+	h.SetDepth(depth)
+
+	nodes := make(map[int][]*TreeNode)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("f%d", i)
+		idx := HAMTSlotIndex(name, depth)
+		nodes[idx] = append(nodes[idx], NewFileTreeNode(name, []byte(name)))
+	}
+	for idx, list := range nodes {
+		h.SetSlot(idx, &HAMTSlot{Nodes: list})
+	}
+	free := 0
+	for nodes[free] != nil {
+		free++
+	}
+	h.SetSlot(free, &HAMTSlot{Child: []byte("child")})
+	h.SetCount(30)
+	h.Hash()
+
+	blk, err := New(BlockTypeHAMT, nil, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd, _ := h.Reader()
+	wr, _ := blk.Writer()
+	if _, err = io.Copy(wr, rd); err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if err = wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h1 := blk.(*HAMTBlock)
+	if !bytes.Equal(h1.ID(), h.ID()) || h1.Size() != h.Size() {
+		t.Fatal("id or size mismatch")
+	}
+	if h1.Depth() != depth || h1.Count() != 30 {
+		t.Fatal("header mismatch", h1.Depth(), h1.Count())
+	}
+	if slot := h1.Slot(free); slot == nil || !bytes.Equal(slot.Child, []byte("child")) {
+		t.Fatal("child mismatch")
+	}
+
+	var count int
+	h1.IterSlots(func(i int, slot *HAMTSlot) error {
+		for j, node := range slot.Nodes {
+			if j > 0 && node.Name <= slot.Nodes[j-1].Name {
+				t.Fatal("nodes should be sorted")
+			}
+			count++
+		}
+		return nil
+	})
+	if count != 20 {
+		t.Fatal("node count mismatch", count)
+	}
+
+	// Nodes in the wrong slot are rejected
+	h.SetDepth(0)
+	if err = NewHAMTBlock(nil, sha256.New).UnmarshalBinary(h.MarshalBinary()); err != ErrInvalidBlock {
+		t.Fatal("should fail with", ErrInvalidBlock, err)
+	}
+}
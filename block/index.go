@@ -7,9 +7,19 @@ import (
 	"encoding/json"
 	"hash"
 	"io"
+	"sort"
 	"sync"
 )
 
+// Index block format versions.  Version 1 is the original fixed-size format and
+// has no version marker.  All other versions are marked by a zero byte in place
+// of the version 1 replica count followed by the version.
+const (
+	indexFormatV1 byte = iota + 1
+	indexFormatV2
+	indexFormatV3
+)
+
 // IndexBlock is an index of data blocks. It contains an ordered list
 // of block ids making up the data set. This is essentially an index of shards
 // making up the whole file. It is thread safe
@@ -19,16 +29,27 @@ type IndexBlock struct {
 	// Total file size represented by this index block
 	fileSize uint64
 
-	// Block size of each member block
+	// Block size of each member block.  For variable sized blocks this is the
+	// max size of a block
 	blockSize uint64
 
 	// replicas
 	replicas uint8
 
+	// Height of the index in an index tree.  An index of height 0 contains data
+	// blocks.  All others contain index blocks of height one less.
+	height uint8
+
 	// Block ids that belong to this block
 	mu     sync.RWMutex
 	blocks map[uint64][]byte
 
+	// Size of each block by index
+	sizes map[uint64]uint64
+
+	// Cached start offset of each block.  It is reset on every index update
+	offsets []uint64
+
 	// Read buffer used when calling Reader
 	rbuf *bytes.Buffer
 }
@@ -45,6 +66,7 @@ func NewIndexBlock(uri *URI, hasher func() hash.Hash) *IndexBlock {
 		blockSize: DefaultBlockSize,
 		replicas:  1,
 		blocks:    make(map[uint64][]byte),
+		sizes:     make(map[uint64]uint64),
 	}
 
 	return di
@@ -61,6 +83,17 @@ func (block *IndexBlock) SetReplicas(replicas uint8) {
 	block.replicas = replicas
 }
 
+// Height returns the height of the index in an index tree.  A height of 0 means
+// the index contains data blocks, otherwise it contains child index blocks.
+func (block *IndexBlock) Height() uint8 {
+	return block.height
+}
+
+// SetHeight sets the height of the index in an index tree
+func (block *IndexBlock) SetHeight(height uint8) {
+	block.height = height
+}
+
 // SetFileSize sets the file size for the index the file is representing
 func (block *IndexBlock) SetFileSize(size uint64) {
 	block.fileSize = size
@@ -90,15 +123,23 @@ func (block *IndexBlock) AddBlock(index uint64, blk Block) {
 	block.IndexBlock(index, id, size)
 }
 
-// IndexBlock adds a block to the index by the index, id and size
+// IndexBlock adds a block to the index by the index, id and size.  If a block
+// already exists at the index it is replaced.
 func (block *IndexBlock) IndexBlock(index uint64, id []byte, size uint64) {
 
 	block.mu.Lock()
+	// Remove the replaced block from the totals
+	if old, ok := block.blocks[index]; ok {
+		block.fileSize -= block.sizes[index]
+		block.size -= uint64(len(old))
+	}
 	// Update the index
 	block.blocks[index] = id
+	block.sizes[index] = size
 	block.fileSize += size
 	// Update the actual size of this block.
 	block.size += uint64(len(id))
+	block.offsets = nil
 	block.mu.Unlock()
 }
 
@@ -106,18 +147,7 @@ func (block *IndexBlock) IndexBlock(index uint64, id []byte, size uint64) {
 // and issues the callback with the index and id.
 func (block *IndexBlock) Iter(f func(index uint64, id []byte) error) error {
 	// Get sorted block ids
-	block.mu.RLock()
-	// bcount := block.size / block.blockSize
-	// if (block.size % block.blockSize) != 0 {
-	bcount := block.fileSize / block.blockSize
-	if (block.fileSize % block.blockSize) != 0 {
-		bcount++
-	}
-	ids := make([][]byte, bcount)
-	for i := range block.blocks {
-		//ids[i-1] = block.blocks[i]
-		ids[i] = block.blocks[i]
-	}
+	ids := block.Blocks()
 
 	// Iterate over sorted set
 	for i, k := range ids {
@@ -125,31 +155,120 @@ func (block *IndexBlock) Iter(f func(index uint64, id []byte) error) error {
 			return err
 		}
 	}
+
+	return nil
+}
+
+// IterEntries iterates over each block in order issuing the callback with the
+// index, start offset in the file, size and id of the block.
+func (block *IndexBlock) IterEntries(f func(index, offset, size uint64, id []byte) error) error {
+	ids := block.Blocks()
+
+	block.mu.RLock()
+	sizes := make([]uint64, len(ids))
+	for i := range sizes {
+		sizes[i] = block.sizes[uint64(i)]
+	}
 	block.mu.RUnlock()
 
+	var offset uint64
+	for i, id := range ids {
+		if err := f(uint64(i), offset, sizes[i], id); err != nil {
+			return err
+		}
+		offset += sizes[i]
+	}
+
 	return nil
 }
 
+// Entry returns the id, start offset in the file and size of the block at the
+// given index
+func (block *IndexBlock) Entry(index uint64) (id []byte, offset, size uint64, ok bool) {
+	offsets := block.loadOffsets()
+
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	if id, ok = block.blocks[index]; ok {
+		offset = offsets[index]
+		size = block.sizes[index]
+	}
+	return
+}
+
+// Locate returns the index of the block containing the given file offset.  It
+// returns false if the offset is beyond the end of the file.
+func (block *IndexBlock) Locate(offset uint64) (uint64, bool) {
+	offsets := block.loadOffsets()
+
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	// Find the first block starting after the offset
+	i := sort.Search(len(offsets), func(i int) bool {
+		return offsets[i] > offset
+	})
+	if i == 0 {
+		return 0, false
+	}
+
+	index := uint64(i - 1)
+	if offset >= offsets[index]+block.sizes[index] {
+		return 0, false
+	}
+	return index, true
+}
+
+// loadOffsets returns the start offset of every block computing and caching them
+// if needed
+func (block *IndexBlock) loadOffsets() []uint64 {
+	block.mu.RLock()
+	offsets := block.offsets
+	block.mu.RUnlock()
+	if offsets != nil {
+		return offsets
+	}
+
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	offsets = make([]uint64, block.entryCount())
+	var offset uint64
+	for i := range offsets {
+		offsets[i] = offset
+		offset += block.sizes[uint64(i)]
+	}
+	block.offsets = offsets
+
+	return offsets
+}
+
 // Blocks returns sorted block ids by file order.  It assumes there are no
 // wholes in the file
 func (block *IndexBlock) Blocks() [][]byte {
 	// Sort by block index
 	block.mu.RLock()
-	// bcount := block.size / block.blockSize
-	// if (block.size % block.blockSize) != 0 {
-	bcount := block.fileSize / block.blockSize
-	if (block.fileSize % block.blockSize) != 0 {
-		bcount++
-	}
-	ids := make([][]byte, bcount)
+	ids := make([][]byte, block.entryCount())
 	for i := range block.blocks {
-		//ids[i-1] = block.blocks[i]
 		ids[i] = block.blocks[i]
 	}
 	block.mu.RUnlock()
 	return ids
 }
 
+// entryCount returns the number of entry positions i.e. the highest index plus 1.
+// Variable sized blocks make it impossible to derive this from the file size.
+func (block *IndexBlock) entryCount() uint64 {
+	var c uint64
+	for i := range block.blocks {
+		if i >= c {
+			c = i + 1
+		}
+	}
+	return c
+}
+
 // BlockCount returns the number of blocks in the index
 func (block *IndexBlock) BlockCount() int {
 	block.mu.RLock()
@@ -158,20 +277,34 @@ func (block *IndexBlock) BlockCount() int {
 }
 
 // Hash computes the hash of the block given the hash function updating the indertal id
-// and returns the hash id.
+// and size and returns the hash id.
 func (block *IndexBlock) Hash() []byte {
+	b := block.MarshalBinary()
+
 	h := block.hasher()
-	h.Write(block.MarshalBinary())
+	h.Write(b)
 	sh := h.Sum(nil)
 
 	// Update internal cache
 	block.id = sh[:]
+	block.size = uint64(len(b[1:]))
 	return block.id
 }
 
-// MarshalBinary marshals the IndexBlock into bytes.  It writes the type, size, blocksize,
-// and finally the block ids in that order.
+// MarshalBinary marshals the IndexBlock into bytes.  Indexes with replicas where
+// all blocks but the last are of the block size are written in the version 1
+// format.  It writes the type, replicas, size, blocksize, and finally the block
+// ids in that order.  Indexes containing other indexes are written in the version
+// 3 format.  All other indexes are written in the version 2 format containing the
+// size of each block.
 func (block *IndexBlock) MarshalBinary() []byte {
+	if block.height > 0 {
+		return block.marshalVersioned(indexFormatV3)
+	}
+	if block.isVariable() {
+		return block.marshalVersioned(indexFormatV2)
+	}
+
 	sz := make([]byte, 8)
 	binary.BigEndian.PutUint64(sz, block.fileSize)
 	bsz := make([]byte, 8)
@@ -188,22 +321,101 @@ func (block *IndexBlock) MarshalBinary() []byte {
 	return out
 }
 
-// UnmarshalBinary takes the byte slice and unmarshals it into an IndexBlock.
+// marshalVersioned writes the type, a zero marker, version, replicas, size,
+// blocksize and the block count.  Version 3 additionally writes the height after
+// the replicas.  It is followed by the size, id length and id of each block as
+// uvarints.
+func (block *IndexBlock) marshalVersioned(version byte) []byte {
+	out := []byte{byte(block.typ), 0, version, byte(block.replicas)}
+	if version == indexFormatV3 {
+		out = append(out, block.height)
+	}
+
+	sz := make([]byte, 16)
+	binary.BigEndian.PutUint64(sz[:8], block.fileSize)
+	binary.BigEndian.PutUint64(sz[8:], block.blockSize)
+	out = append(out, sz...)
+
+	ids := block.Blocks()
+	out = appendUvarint(out, uint64(len(ids)))
+
+	block.mu.RLock()
+	for i, id := range ids {
+		out = appendUvarint(out, block.sizes[uint64(i)])
+		out = appendUvarint(out, uint64(len(id)))
+		out = append(out, id...)
+	}
+	block.mu.RUnlock()
+
+	return out
+}
+
+// isVariable returns true if the index cannot be represented in the fixed size
+// format i.e. it has holes, a block other than the last is not of the block size
+// or the last block exceeds the block size.  Indexes with zero replicas are
+// always variable as a zero replicas byte marks the versioned formats.
+func (block *IndexBlock) isVariable() bool {
+	block.mu.RLock()
+	defer block.mu.RUnlock()
+
+	if block.replicas == 0 {
+		return true
+	}
+
+	n := block.entryCount()
+	for i := uint64(0); i < n; i++ {
+		if _, ok := block.blocks[i]; !ok {
+			return true
+		}
+
+		size, ok := block.sizes[i]
+		if !ok {
+			// Unknown size
+			continue
+		}
+		if i < n-1 && size != block.blockSize {
+			return true
+		}
+		if size > block.blockSize {
+			return true
+		}
+	}
+
+	return false
+}
+
+// UnmarshalBinary takes the byte slice and unmarshals it into an IndexBlock.  It
+// reads both the fixed and variable size formats.  Fixed size indexes written with
+// zero replicas before they were always versioned are read as fixed size if they
+// do not parse as versioned.
 func (block *IndexBlock) UnmarshalBinary(b []byte) error {
 	if len(b) < 18 {
 		return ErrInvalidBlock
 	}
 
+	if b[1] == 0 {
+		if err := block.unmarshalVersioned(b); err == nil {
+			return nil
+		}
+	}
+
 	block.typ = BlockType(b[0])
 	block.replicas = uint8(b[1])
+	block.height = 0
 	block.size = uint64(len(b[1:]))
 
 	block.fileSize = binary.BigEndian.Uint64(b[2:10])
 	block.blockSize = binary.BigEndian.Uint64(b[10:18])
 
-	// Block count
+	ids := b[18:]
+
+	// Block count.  Ids are of a fixed width given by the hash function so the
+	// count is derived from the id data.  Without a hash function the count is
+	// derived from the file and block size.
 	var bcount uint64
-	if block.fileSize < block.blockSize {
+	if block.hasher != nil {
+		bcount = uint64(len(ids) / block.hasher().Size())
+	} else if block.fileSize < block.blockSize {
 		bcount = 1
 	} else {
 		bcount = block.fileSize / block.blockSize
@@ -212,15 +424,20 @@ func (block *IndexBlock) UnmarshalBinary(b []byte) error {
 		}
 	}
 
+	block.mu.Lock()
+	defer block.mu.Unlock()
+
+	block.blocks = make(map[uint64][]byte)
+	block.sizes = make(map[uint64]uint64)
+	block.offsets = nil
+
 	// No entries
 	if bcount == 0 {
 		return nil
 	}
 
-	ids := b[18:]
 	w := uint64(len(ids)) / bcount
 
-	block.blocks = make(map[uint64][]byte)
 	var last uint64
 	for i := uint64(0); i < bcount; i++ {
 		//p := i * w
@@ -229,11 +446,91 @@ func (block *IndexBlock) UnmarshalBinary(b []byte) error {
 		last = p
 	}
 
+	// Derive the block sizes if the count matches the fixed size layout
+	if block.blockSize > 0 && (bcount-1)*block.blockSize < block.fileSize &&
+		bcount*block.blockSize >= block.fileSize {
+		for i := uint64(0); i < bcount-1; i++ {
+			block.sizes[i] = block.blockSize
+		}
+		block.sizes[bcount-1] = block.fileSize - (bcount-1)*block.blockSize
+	}
+
+	return nil
+}
+
+// unmarshalVersioned unmarshals the versioned formats
+func (block *IndexBlock) unmarshalVersioned(b []byte) error {
+	var height uint8
+	hdr := 4
+
+	switch b[2] {
+	case indexFormatV2:
+	case indexFormatV3:
+		height = b[4]
+		hdr++
+	default:
+		return ErrInvalidBlock
+	}
+
+	if len(b) < hdr+17 {
+		return ErrInvalidBlock
+	}
+
+	typ := BlockType(b[0])
+	replicas := b[3]
+	fileSize := binary.BigEndian.Uint64(b[hdr : hdr+8])
+	blockSize := binary.BigEndian.Uint64(b[hdr+8 : hdr+16])
+
+	buf := b[hdr+16:]
+	count, n := binary.Uvarint(buf)
+	if n <= 0 {
+		return ErrInvalidBlock
+	}
+	buf = buf[n:]
+
+	blocks := make(map[uint64][]byte)
+	sizes := make(map[uint64]uint64)
+	for i := uint64(0); i < count; i++ {
+		size, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return ErrInvalidBlock
+		}
+		buf = buf[n:]
+
+		l, n := binary.Uvarint(buf)
+		if n <= 0 || uint64(len(buf[n:])) < l {
+			return ErrInvalidBlock
+		}
+		buf = buf[n:]
+
+		blocks[i] = buf[:l]
+		sizes[i] = size
+		buf = buf[l:]
+	}
+
+	if len(buf) != 0 {
+		return ErrInvalidBlock
+	}
+
+	block.mu.Lock()
+	block.typ = typ
+	block.replicas = replicas
+	block.height = height
+	block.fileSize = fileSize
+	block.blockSize = blockSize
+	block.size = uint64(len(b[1:]))
+	block.blocks = blocks
+	block.sizes = sizes
+	block.offsets = nil
+	block.mu.Unlock()
+
 	return nil
 }
 
-// MarshalJSON is custom json marshaller for IndexBlock
+// MarshalJSON is custom json marshaller for IndexBlock.  Holes in the index are
+// empty ids.
 func (block *IndexBlock) MarshalJSON() ([]byte, error) {
+	ids := block.Blocks()
 	t := struct {
 		ID         string
 		Size       uint64
@@ -241,6 +538,7 @@ func (block *IndexBlock) MarshalJSON() ([]byte, error) {
 		BlockSize  uint64
 		BlockCount int
 		Replicas   uint8
+		Height     uint8
 		Blocks     []string
 	}{
 		ID:         hex.EncodeToString(block.ID()),
@@ -249,20 +547,21 @@ func (block *IndexBlock) MarshalJSON() ([]byte, error) {
 		BlockSize:  block.BlockSize(),
 		BlockCount: block.BlockCount(),
 		Replicas:   block.replicas,
-		Blocks:     make([]string, len(block.blocks)),
+		Height:     block.height,
+		Blocks:     make([]string, len(ids)),
 	}
 
-	block.Iter(func(idx uint64, id []byte) error {
-		t.Blocks[idx] = hex.EncodeToString(id)
-		return nil
-	})
+	for i, id := range ids {
+		t.Blocks[i] = hex.EncodeToString(id)
+	}
 
 	return json.Marshal(t)
 }
 
-// Reader returns a ReadCloser to this block.  It contains a byte stream with
-// the 1-byte replica count, 8-byte size, 8-byte block size followed by an
-// ordered list of block id's.
+// Reader returns a ReadCloser to this block.  It contains the byte stream written
+// by MarshalBinary without the leading type byte, i.e. the version 1 layout or the
+// zero marker, version, replicas, height, sizes and entries of the versioned
+// formats.
 func (block *IndexBlock) Reader() (io.ReadCloser, error) {
 	b := block.MarshalBinary()
 	block.rbuf = bytes.NewBuffer(b[1:])
@@ -3,6 +3,8 @@ package block
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -168,3 +170,172 @@ func Test_IndexBlock_smallfile(t *testing.T) {
 		t.Fatal("size mismatch")
 	}
 }
+
+func Test_IndexBlock_variable(t *testing.T) {
+	data := [][]byte{
+		[]byte("0123456789"),
+		[]byte("01234"),
+		[]byte("0123456789"),
+		[]byte("012"),
+	}
+
+	idx := NewIndexBlock(nil, sha256.New)
+	idx.SetBlockSize(10)
+	for i, d := range data {
+		mem, _ := newMemDataBlock(d)
+		idx.AddBlock(uint64(i), mem)
+	}
+	idx.Hash()
+
+	if idx.FileSize() != 28 {
+		t.Fatal("wrong file size", idx.FileSize())
+	}
+
+	b := idx.MarshalBinary()
+	if b[1] != 0 || b[2] != indexFormatV2 {
+		t.Fatal("should be version 2")
+	}
+	if idx.Size() != uint64(len(b)-1) {
+		t.Fatalf("size mismatch %d != %d", idx.Size(), len(b)-1)
+	}
+
+	nidx := NewIndexBlock(nil, sha256.New)
+	if err := nidx.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if nidx.FileSize() != idx.FileSize() || nidx.BlockSize() != idx.BlockSize() {
+		t.Fatal("size mismatch")
+	}
+	if nidx.BlockCount() != len(data) {
+		t.Fatal("block count mismatch", nidx.BlockCount())
+	}
+	if !bytes.Equal(nidx.Hash(), idx.ID()) {
+		t.Fatal("id mismatch")
+	}
+
+	_, off, sz, ok := nidx.Entry(2)
+	if !ok || off != 15 || sz != 10 {
+		t.Fatalf("wrong entry offset=%d size=%d", off, sz)
+	}
+
+	for _, tc := range []struct {
+		off   uint64
+		index uint64
+		ok    bool
+	}{{0, 0, true}, {9, 0, true}, {10, 1, true}, {14, 1, true}, {15, 2, true}, {27, 3, true}, {28, 0, false}} {
+		i, ok := nidx.Locate(tc.off)
+		if ok != tc.ok || i != tc.index {
+			t.Errorf("locate offset=%d want=%d/%v have=%d/%v", tc.off, tc.index, tc.ok, i, ok)
+		}
+	}
+
+	// Replacing the short block makes the index fixed size again
+	mem, _ := newMemDataBlock([]byte("abcdefghij"))
+	nidx.AddBlock(1, mem)
+	if nidx.FileSize() != 33 {
+		t.Fatal("wrong file size", nidx.FileSize())
+	}
+	if b = nidx.MarshalBinary(); b[1] == 0 {
+		t.Fatal("should be version 1")
+	}
+}
+
+func Test_IndexBlock_fixedSizes(t *testing.T) {
+	idx := NewIndexBlock(nil, sha256.New)
+	idx.SetBlockSize(19)
+	for i, d := range []string{"1234509876543223456", "plokijuhygqakvoekfk", "1234"} {
+		mem, _ := newMemDataBlock([]byte(d))
+		idx.AddBlock(uint64(i), mem)
+	}
+
+	nidx := NewIndexBlock(nil, sha256.New)
+	if err := nidx.UnmarshalBinary(idx.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, off, sz, ok := nidx.Entry(2)
+	if !ok || off != 38 || sz != 4 {
+		t.Fatalf("wrong entry offset=%d size=%d", off, sz)
+	}
+}
+
+func Test_IndexBlock_height(t *testing.T) {
+	idx := NewIndexBlock(nil, sha256.New)
+	idx.SetBlockSize(10)
+	idx.SetHeight(1)
+	idx.IndexBlock(0, []byte("12345678901234567890123456789012"), 40)
+	idx.IndexBlock(1, []byte("abcdefghijabcdefghijabcdefghijab"), 15)
+
+	nidx := NewIndexBlock(nil, sha256.New)
+	if err := nidx.UnmarshalBinary(idx.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if nidx.Height() != 1 {
+		t.Fatal("height mismatch")
+	}
+	if nidx.FileSize() != 55 {
+		t.Fatal("file size mismatch", nidx.FileSize())
+	}
+	if !bytes.Equal(nidx.Hash(), idx.Hash()) {
+		t.Fatal("id mismatch")
+	}
+}
+
+func Test_IndexBlock_zeroReplicas(t *testing.T) {
+	idx := NewIndexBlock(nil, sha256.New)
+	idx.SetBlockSize(19)
+	idx.SetReplicas(0)
+	for i, d := range []string{"1234509876543223456", "1234"} {
+		mem, _ := newMemDataBlock([]byte(d))
+		idx.AddBlock(uint64(i), mem)
+	}
+
+	nidx := NewIndexBlock(nil, sha256.New)
+	if err := nidx.UnmarshalBinary(idx.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if nidx.Replicas() != 0 || nidx.FileSize() != 23 || nidx.BlockCount() != 2 {
+		t.Fatal("index mismatch", nidx.Replicas(), nidx.FileSize(), nidx.BlockCount())
+	}
+	if !bytes.Equal(nidx.Hash(), idx.Hash()) {
+		t.Fatal("id mismatch")
+	}
+
+	// Fixed size format written with zero replicas
+	b := []byte{byte(BlockTypeIndex), 0}
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 23)
+	b = append(b, 0, 0, 0, 0, 0, 0, 0, 19)
+	b = append(b, idx.Blocks()[0]...)
+	b = append(b, idx.Blocks()[1]...)
+
+	nidx = NewIndexBlock(nil, sha256.New)
+	if err := nidx.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if nidx.FileSize() != 23 || nidx.BlockCount() != 2 {
+		t.Fatal("legacy index mismatch", nidx.FileSize(), nidx.BlockCount())
+	}
+	if _, _, sz, ok := nidx.Entry(1); !ok || sz != 4 {
+		t.Fatal("wrong entry size", sz)
+	}
+}
+
+func Test_IndexBlock_holesJSON(t *testing.T) {
+	mem, _ := newMemDataBlock([]byte("hole"))
+	idx := NewIndexBlock(nil, sha256.New)
+	idx.SetBlockSize(4)
+	idx.AddBlock(3, mem)
+	idx.Hash()
+
+	b, err := idx.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v struct{ Blocks []string }
+	if err = json.Unmarshal(b, &v); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Blocks) != 4 || v.Blocks[0] != "" || v.Blocks[3] != hex.EncodeToString(mem.ID()) {
+		t.Fatal("wrong blocks", v.Blocks)
+	}
+}
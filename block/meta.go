@@ -1,80 +1,535 @@
 package block
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"hash"
+	"io"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	// metaFormatText is the legacy format of a key=value line per entry
+	metaFormatText byte = 0
+	// metaFormatV2 is the length-prefixed typed format
+	metaFormatV2 byte = 2
+)
+
+// MetaValueType is the type of a metadata value
+type MetaValueType uint8
+
+const (
+	// MetaString is a utf-8 string value
+	MetaString MetaValueType = iota + 1
+	// MetaInt is a signed 64-bit integer value
+	MetaInt
+	// MetaBool is a boolean value
+	MetaBool
+	// MetaBytes is a raw byte value
+	MetaBytes
+	// MetaTime is a timestamp value with nanosecond precision
+	MetaTime
+)
+
+func (typ MetaValueType) String() string {
+	switch typ {
+	case MetaString:
+		return "string"
+	case MetaInt:
+		return "int"
+	case MetaBool:
+		return "bool"
+	case MetaBytes:
+		return "bytes"
+	case MetaTime:
+		return "time"
+	}
+	return fmt.Sprintf("MetaValueType(%d)", uint8(typ))
+}
+
+// metaValue is a typed metadata value in its encoded form
+type metaValue struct {
+	typ  MetaValueType
+	data string
+}
+
+// String returns the string representation of the value.  Bytes are hex encoded
+// and timestamps are formatted as RFC3339 in UTC.
+func (v metaValue) String() string {
+	switch v.typ {
+	case MetaInt:
+		i, _ := binary.Varint([]byte(v.data))
+		return strconv.FormatInt(i, 10)
+	case MetaBool:
+		return strconv.FormatBool(v.data == "\x01")
+	case MetaBytes:
+		return hex.EncodeToString([]byte(v.data))
+	case MetaTime:
+		ns, _ := binary.Varint([]byte(v.data))
+		return time.Unix(0, ns).UTC().Format(time.RFC3339Nano)
+	}
+	return v.data
+}
+
+// validate checks the encoded data is valid for the type
+func (v metaValue) validate() error {
+	switch v.typ {
+	case MetaString, MetaBytes:
+		return nil
+	case MetaInt, MetaTime:
+		if _, n := binary.Varint([]byte(v.data)); n <= 0 || n != len(v.data) {
+			return ErrInvalidBlock
+		}
+		return nil
+	case MetaBool:
+		if v.data != "\x00" && v.data != "\x01" {
+			return ErrInvalidBlock
+		}
+		return nil
+	}
+	return ErrInvalidBlock
+}
+
+func varintValue(typ MetaValueType, i int64) metaValue {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, i)
+	return metaValue{typ: typ, data: string(buf[:n])}
+}
+
 // MetaBlock is a metadata block. It contains an id that points
 // to an actual data block i.e. tree, index, data and key-value
-// metadata
+// metadata.  The binary format is the 1-byte type, a zero byte marker, 1-byte
+// format version, the uvarint length prefixed reference, uvarint entry count
+// followed by each entry sorted by key.  An entry is the uvarint length prefixed
+// key, 1-byte value type and the uvarint length prefixed value.  Blocks in the
+// legacy text format are written back in that format so their ids do not change.
 type MetaBlock struct {
 	*baseBlock
-	m map[string]string // Metadata
+
+	// Id of the tree, index or data block this metadata describes
+	ref []byte
+
+	// Format version the block is marshalled with
+	version byte
+
+	mu sync.RWMutex
+	m  map[string]metaValue // Metadata
+
+	// Read buffer initialized when calling Reader()
+	rbuf *bytes.Buffer
 }
 
+// NewMetaBlock inits a new MetaBlock with the uri and hasher. The uri may be nil.
 func NewMetaBlock(uri *URI, hasher func() hash.Hash) *MetaBlock {
-
-	return &MetaBlock{
+	mb := &MetaBlock{
 		baseBlock: &baseBlock{
 			hasher: hasher,
 			uri:    uri,
 			typ:    BlockTypeMeta,
-			size:   uint64(hasher().Size() + 1), // hash size plus the new line
 		},
-		m: make(map[string]string),
+		version: metaFormatV2,
+		m:       make(map[string]metaValue),
 	}
+	mb.Hash()
+	return mb
 }
 
+// SetReference sets the id of the block this MetaBlock describes and updates the
+// hash id
+func (blk *MetaBlock) SetReference(id []byte) {
+	blk.mu.Lock()
+	blk.ref = id
+	blk.mu.Unlock()
+
+	blk.Hash()
+}
+
+// Reference returns the id of the block this MetaBlock describes
+func (blk *MetaBlock) Reference() []byte {
+	blk.mu.RLock()
+	defer blk.mu.RUnlock()
+	return blk.ref
+}
+
+// SetMetadata adds the key-value pairs as string values to the existing metadata
+// and updates the hash id
 func (blk *MetaBlock) SetMetadata(m map[string]string) {
+	blk.mu.Lock()
 	for k, v := range m {
-		blk.m[k] = v
+		blk.m[k] = metaValue{typ: MetaString, data: v}
+	}
+	blk.mu.Unlock()
+
+	blk.Hash()
+}
+
+// Metadata returns a copy of the metadata with each value in its string
+// representation
+func (blk *MetaBlock) Metadata() map[string]string {
+	blk.mu.RLock()
+	defer blk.mu.RUnlock()
+
+	out := make(map[string]string, len(blk.m))
+	for k, v := range blk.m {
+		out[k] = v.String()
+	}
+	return out
+}
+
+// Keys returns all metadata keys in sorted order
+func (blk *MetaBlock) Keys() []string {
+	blk.mu.RLock()
+	defer blk.mu.RUnlock()
+	return blk.sortedKeys()
+}
+
+// ValueType returns the type of the value of the key
+func (blk *MetaBlock) ValueType(key string) (MetaValueType, bool) {
+	blk.mu.RLock()
+	defer blk.mu.RUnlock()
+	v, ok := blk.m[key]
+	return v.typ, ok
+}
+
+// Delete removes the key and updates the hash id
+func (blk *MetaBlock) Delete(key string) {
+	blk.mu.Lock()
+	delete(blk.m, key)
+	blk.mu.Unlock()
+
+	blk.Hash()
+}
+
+// SetString sets a string value and updates the hash id
+func (blk *MetaBlock) SetString(key, val string) {
+	blk.set(key, metaValue{typ: MetaString, data: val})
+}
+
+// SetInt sets an integer value and updates the hash id
+func (blk *MetaBlock) SetInt(key string, val int64) {
+	blk.set(key, varintValue(MetaInt, val))
+}
+
+// SetBool sets a boolean value and updates the hash id
+func (blk *MetaBlock) SetBool(key string, val bool) {
+	data := "\x00"
+	if val {
+		data = "\x01"
+	}
+	blk.set(key, metaValue{typ: MetaBool, data: data})
+}
+
+// SetBytes sets a raw byte value and updates the hash id
+func (blk *MetaBlock) SetBytes(key string, val []byte) {
+	blk.set(key, metaValue{typ: MetaBytes, data: string(val)})
+}
+
+// SetTime sets a timestamp value and updates the hash id.  The time is stored as
+// nanoseconds since the unix epoch, dropping the location.
+func (blk *MetaBlock) SetTime(key string, val time.Time) {
+	blk.set(key, varintValue(MetaTime, val.UnixNano()))
+}
+
+// GetString returns the string value of the key.  It returns false if the key
+// does not exist or is not a string
+func (blk *MetaBlock) GetString(key string) (string, bool) {
+	v, ok := blk.get(key, MetaString)
+	return v.data, ok
+}
+
+// GetInt returns the integer value of the key.  It returns false if the key does
+// not exist or is not an integer
+func (blk *MetaBlock) GetInt(key string) (int64, bool) {
+	v, ok := blk.get(key, MetaInt)
+	if !ok {
+		return 0, false
+	}
+	i, _ := binary.Varint([]byte(v.data))
+	return i, true
+}
+
+// GetBool returns the boolean value of the key.  It returns false as the second
+// value if the key does not exist or is not a boolean
+func (blk *MetaBlock) GetBool(key string) (bool, bool) {
+	v, ok := blk.get(key, MetaBool)
+	return v.data == "\x01", ok
+}
+
+// GetBytes returns the raw byte value of the key.  It returns false if the key
+// does not exist or is not a byte value
+func (blk *MetaBlock) GetBytes(key string) ([]byte, bool) {
+	v, ok := blk.get(key, MetaBytes)
+	if !ok {
+		return nil, false
 	}
+	return []byte(v.data), true
+}
+
+// GetTime returns the timestamp value of the key in UTC.  It returns false if the
+// key does not exist or is not a timestamp
+func (blk *MetaBlock) GetTime(key string) (time.Time, bool) {
+	v, ok := blk.get(key, MetaTime)
+	if !ok {
+		return time.Time{}, false
+	}
+	ns, _ := binary.Varint([]byte(v.data))
+	return time.Unix(0, ns).UTC(), true
+}
+
+func (blk *MetaBlock) set(key string, v metaValue) {
+	blk.mu.Lock()
+	blk.m[key] = v
+	blk.mu.Unlock()
+
 	blk.Hash()
 }
 
+func (blk *MetaBlock) get(key string, typ MetaValueType) (metaValue, bool) {
+	blk.mu.RLock()
+	defer blk.mu.RUnlock()
+
+	v, ok := blk.m[key]
+	if !ok || v.typ != typ {
+		return metaValue{}, false
+	}
+	return v, true
+}
+
+// Hash computes the hash of the block updating the internal id and size.  It returns
+// the hash id
 func (blk *MetaBlock) Hash() []byte {
+	b := blk.MarshalBinary()
+
 	h := blk.hasher()
-	h.Write(blk.MarshalBinary())
+	h.Write(b)
 	sh := h.Sum(nil)
 
 	// Update internal cache
 	blk.id = sh[:]
+	blk.size = uint64(len(b[1:]))
 	return blk.id
 }
 
+// UnmarshalBinary unmarshals the byte slice into the MetaBlock.  Both the binary
+// and legacy text formats are accepted.  The legacy format is the 1-byte type,
+// 1-byte reference length, the reference id and finally the metadata as key=value
+// pairs 1 per line.
 func (blk *MetaBlock) UnmarshalBinary(b []byte) error {
-	blk.size = uint64(len(b))
-	s := string(b)
+	if len(b) < 2 {
+		return ErrInvalidBlock
+	}
 
-	lines := strings.Split(s, "\n")
-	l := len(lines)
-	if l == 0 {
-		return fmt.Errorf("invalid MetaBlock data")
+	var (
+		ref     []byte
+		m       map[string]metaValue
+		version byte
+		err     error
+	)
+	// A legacy block without a reference could only be mistaken for the binary
+	// format if its first key started with the version byte
+	if len(b) > 2 && b[1] == 0 && b[2] == metaFormatV2 {
+		version = metaFormatV2
+		ref, m, err = unmarshalMetaV2(b[3:])
+	} else {
+		version = metaFormatText
+		ref, m, err = unmarshalMetaText(b[1:])
+	}
+	if err != nil {
+		return err
 	}
 
-	for _, line := range lines {
-		kvp := strings.Split(line, "=")
-		if len(kvp) != 2 {
-			return fmt.Errorf("invalid metadata: '%s'", line)
-		}
-		blk.m[kvp[0]] = kvp[1]
+	blk.mu.Lock()
+	blk.typ = BlockType(b[0])
+	blk.ref = nil
+	if len(ref) > 0 {
+		blk.ref = make([]byte, len(ref))
+		copy(blk.ref, ref)
 	}
+	blk.version = version
+	blk.m = m
+	blk.mu.Unlock()
 
 	blk.Hash()
 
 	return nil
 }
 
+// unmarshalMetaV2 unmarshals the reference and entries of the binary format
+func unmarshalMetaV2(b []byte) ([]byte, map[string]metaValue, error) {
+	ref, b, err := readBytes(b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	count, b, err := readUvarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if count > uint64(len(b)) {
+		return nil, nil, ErrInvalidBlock
+	}
+
+	m := make(map[string]metaValue, count)
+	for i := uint64(0); i < count; i++ {
+		var key, data []byte
+		if key, b, err = readBytes(b); err != nil {
+			return nil, nil, err
+		}
+		if len(b) == 0 {
+			return nil, nil, ErrInvalidBlock
+		}
+		typ := MetaValueType(b[0])
+		if data, b, err = readBytes(b[1:]); err != nil {
+			return nil, nil, err
+		}
+
+		v := metaValue{typ: typ, data: string(data)}
+		if err = v.validate(); err != nil {
+			return nil, nil, err
+		}
+		if _, ok := m[string(key)]; ok {
+			return nil, nil, ErrInvalidBlock
+		}
+		m[string(key)] = v
+	}
+
+	if len(b) != 0 {
+		return nil, nil, ErrInvalidBlock
+	}
+	return ref, m, nil
+}
+
+// unmarshalMetaText unmarshals the reference and entries of the legacy text format
+func unmarshalMetaText(b []byte) ([]byte, map[string]metaValue, error) {
+	rl := int(b[0])
+	if len(b) < 1+rl {
+		return nil, nil, ErrInvalidBlock
+	}
+
+	m := make(map[string]metaValue)
+	if data := b[1+rl:]; len(data) > 0 {
+		lines := strings.Split(string(data), "\n")
+		for _, line := range lines {
+			kvp := strings.SplitN(line, "=", 2)
+			if len(kvp) != 2 {
+				return nil, nil, fmt.Errorf("invalid metadata: '%s'", line)
+			}
+			m[kvp[0]] = metaValue{typ: MetaString, data: kvp[1]}
+		}
+	}
+
+	return b[1 : 1+rl], m, nil
+}
+
+// MarshalBinary marshals the MetaBlock into bytes.  It writes the 1-byte type
+// followed by the format marker, version, reference and entries sorted by key.
+// Legacy text blocks are written with the 1-byte reference length, the reference
+// id and the key=value pairs sorted by key 1 per line, unless the metadata can no
+// longer be represented in that format.
 func (blk *MetaBlock) MarshalBinary() []byte {
+	blk.mu.RLock()
+	defer blk.mu.RUnlock()
+
 	keys := blk.sortedKeys()
-	lines := make([]string, 0, len(blk.m))
+
+	if blk.version == metaFormatText && blk.textSafe() {
+		out := append([]byte{byte(blk.typ), byte(len(blk.ref))}, blk.ref...)
+
+		lines := make([]string, 0, len(blk.m))
+		for _, k := range keys {
+			lines = append(lines, fmt.Sprintf("%s=%s", k, blk.m[k].data))
+		}
+		return append(out, []byte(strings.Join(lines, "\n"))...)
+	}
+
+	out := []byte{byte(blk.typ), 0, metaFormatV2}
+	out = appendBytes(out, blk.ref)
+	out = appendUvarint(out, uint64(len(keys)))
 	for _, k := range keys {
-		lines = append(lines, fmt.Sprintf("%s=%s", k, blk.m[k]))
+		v := blk.m[k]
+		out = appendBytes(out, []byte(k))
+		out = append(out, byte(v.typ))
+		out = appendBytes(out, []byte(v.data))
+	}
+	return out
+}
+
+// textSafe returns true if the reference and all entries can be represented in
+// the legacy text format
+func (blk *MetaBlock) textSafe() bool {
+	if len(blk.ref) > 0xff {
+		return false
 	}
-	return []byte(strings.Join(lines, "\n"))
+	for k, v := range blk.m {
+		if v.typ != MetaString || strings.ContainsAny(k, "=\n") || strings.ContainsRune(v.data, '\n') {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalJSON is a custom json marshaller for MetaBlock
+func (blk *MetaBlock) MarshalJSON() ([]byte, error) {
+	t := struct {
+		ID        string
+		Size      uint64
+		Reference string
+		Metadata  map[string]string
+	}{
+		ID:        hex.EncodeToString(blk.ID()),
+		Size:      blk.Size(),
+		Reference: hex.EncodeToString(blk.Reference()),
+		Metadata:  blk.Metadata(),
+	}
+
+	return json.Marshal(t)
+}
+
+// Reader returns a ReadCloser to the marshalled block data excluding the 1-byte
+// type
+func (blk *MetaBlock) Reader() (io.ReadCloser, error) {
+	b := blk.MarshalBinary()
+	blk.rbuf = bytes.NewBuffer(b[1:])
+	return blk, nil
+}
+
+func (blk *MetaBlock) Read(p []byte) (int, error) {
+	return blk.rbuf.Read(p)
+}
+
+// Writer inits a new WriteCloser backed by a hasher.  It writes the type and returns
+// the WriteCloser.  The data is unmarshalled into the block once the writer is closed.
+func (blk *MetaBlock) Writer() (io.WriteCloser, error) {
+	blk.hw = NewHasherWriter(blk.hasher(), bytes.NewBuffer(nil))
+	err := WriteBlockType(blk.hw, blk.typ)
+	return blk, err
+}
+
+func (blk *MetaBlock) Write(p []byte) (int, error) {
+	return blk.hw.Write(p)
+}
+
+// Close closes the reader and writer.  On a write close the written data is
+// unmarshalled into the block
+func (blk *MetaBlock) Close() error {
+	blk.rbuf = nil
+
+	if blk.hw == nil {
+		return nil
+	}
+
+	buf := blk.hw.uw.(*bytes.Buffer)
+	b := buf.Bytes()
+	blk.hw = nil
+
+	return blk.UnmarshalBinary(b)
 }
 
 func (blk *MetaBlock) sortedKeys() []string {
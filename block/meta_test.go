@@ -8,6 +8,7 @@ import (
 	"io/ioutil"
 	"os"
 	"testing"
+	"time"
 )
 
 func Test_MetaBlock(t *testing.T) {
@@ -19,6 +20,7 @@ func Test_MetaBlock(t *testing.T) {
 	}
 
 	mb.SetMetadata(m)
+	mb.SetReference([]byte("12345678901234567890123456789012"))
 	b := mb.MarshalBinary()
 	mb1 := NewMetaBlock(nil, hasher)
 	if err := mb1.UnmarshalBinary(b); err != nil {
@@ -32,6 +34,9 @@ func Test_MetaBlock(t *testing.T) {
 	if bytes.Compare(mb.ID(), mb1.ID()) != 0 {
 		t.Fatal("id mismatch")
 	}
+	if bytes.Compare(mb.Reference(), mb1.Reference()) != 0 {
+		t.Fatal("reference mismatch")
+	}
 
 	for k, v := range mb.m {
 		val, ok := mb1.m[k]
@@ -45,6 +50,181 @@ func Test_MetaBlock(t *testing.T) {
 
 }
 
+func Test_MetaBlock_ReaderWriter(t *testing.T) {
+	hasher := sha256.New
+	mb := NewMetaBlock(nil, hasher)
+	mb.SetReference([]byte("12345678901234567890123456789012"))
+	mb.SetMetadata(map[string]string{"url": "http://host/?a=b", "name": "foo"})
+
+	mb1, err := New(BlockTypeMeta, nil, hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rd, err := mb.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	wr, err := mb1.Writer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.Copy(wr, rd); err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	if err = wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Compare(mb.ID(), mb1.ID()) != 0 {
+		t.Fatalf("id mismatch %x != %x", mb.ID(), mb1.ID())
+	}
+	if mb.Size() != mb1.Size() {
+		t.Fatalf("size mismatch %d != %d", mb.Size(), mb1.Size())
+	}
+
+	meta := mb1.(*MetaBlock).Metadata()
+	if meta["url"] != "http://host/?a=b" {
+		t.Fatal("value mismatch", meta["url"])
+	}
+
+	// Empty block
+	eb := NewMetaBlock(nil, hasher)
+	eb1 := NewMetaBlock(nil, hasher)
+	if err = eb1.UnmarshalBinary(eb.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(eb.ID(), eb1.ID()) != 0 {
+		t.Fatal("id mismatch")
+	}
+}
+
+func Test_MetaBlock_typed(t *testing.T) {
+	hasher := sha256.New
+	ts := time.Date(2017, 10, 2, 15, 4, 5, 999, time.UTC)
+
+	mb := NewMetaBlock(nil, hasher)
+	mb.SetReference([]byte("ref"))
+	mb.SetString("desc", "line 1\nline 2 a=b")
+	mb.SetString("url", "http://host/?a=b")
+	mb.SetString("", "empty key")
+	mb.SetInt("size", -42)
+	mb.SetBool("exec", true)
+	mb.SetBytes("raw", []byte{0, '\n', '='})
+	mb.SetTime("mtime", ts)
+
+	mb1 := NewMetaBlock(nil, hasher)
+	if err := mb1.UnmarshalBinary(mb.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mb.ID(), mb1.ID()) {
+		t.Fatal("id mismatch")
+	}
+
+	if v, _ := mb1.GetString("desc"); v != "line 1\nline 2 a=b" {
+		t.Fatalf("desc mismatch %q", v)
+	}
+	if v, _ := mb1.GetString(""); v != "empty key" {
+		t.Fatalf("empty key mismatch %q", v)
+	}
+	if v, ok := mb1.GetInt("size"); !ok || v != -42 {
+		t.Fatal("int mismatch", v)
+	}
+	if v, ok := mb1.GetBool("exec"); !ok || !v {
+		t.Fatal("bool mismatch")
+	}
+	if v, ok := mb1.GetBytes("raw"); !ok || !bytes.Equal(v, []byte{0, '\n', '='}) {
+		t.Fatal("bytes mismatch", v)
+	}
+	if v, ok := mb1.GetTime("mtime"); !ok || !v.Equal(ts) {
+		t.Fatal("time mismatch", v)
+	}
+	if typ, _ := mb1.ValueType("mtime"); typ != MetaTime {
+		t.Fatal("type mismatch", typ)
+	}
+
+	// Type mismatch
+	if _, ok := mb1.GetInt("url"); ok {
+		t.Fatal("should not get a string as an int")
+	}
+
+	md := mb1.Metadata()
+	if md["size"] != "-42" || md["exec"] != "true" || md["raw"] != "000a3d" {
+		t.Fatal("string representation mismatch", md)
+	}
+	if md["mtime"] != "2017-10-02T15:04:05.000000999Z" {
+		t.Fatal("time representation mismatch", md["mtime"])
+	}
+
+	mb1.Delete("raw")
+	if _, ok := mb1.GetBytes("raw"); ok {
+		t.Fatal("key should be deleted")
+	}
+	if bytes.Equal(mb.ID(), mb1.ID()) {
+		t.Fatal("id should change")
+	}
+
+	// Truncated and invalid values
+	b := mb.MarshalBinary()
+	if err := NewMetaBlock(nil, hasher).UnmarshalBinary(b[:len(b)-1]); err != ErrInvalidBlock {
+		t.Fatal("should fail with", ErrInvalidBlock, err)
+	}
+	bad := NewMetaBlock(nil, hasher)
+	bad.SetBool("flag", true)
+	b = bad.MarshalBinary()
+	b[len(b)-1] = 2
+	if err := NewMetaBlock(nil, hasher).UnmarshalBinary(b); err != ErrInvalidBlock {
+		t.Fatal("should fail with", ErrInvalidBlock, err)
+	}
+}
+
+func Test_MetaBlock_legacy(t *testing.T) {
+	hasher := sha256.New
+	ref := []byte("12345678901234567890123456789012")
+
+	legacy := append([]byte{byte(BlockTypeMeta), byte(len(ref))}, ref...)
+	legacy = append(legacy, []byte("name=foo\nurl=http://host/?a=b")...)
+	h := hasher()
+	h.Write(legacy)
+	id := h.Sum(nil)
+
+	mb := NewMetaBlock(nil, hasher)
+	if err := mb.UnmarshalBinary(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mb.Reference(), ref) {
+		t.Fatal("reference mismatch")
+	}
+	if v, _ := mb.GetString("url"); v != "http://host/?a=b" {
+		t.Fatal("value mismatch", v)
+	}
+
+	// Legacy blocks keep their ids
+	if !bytes.Equal(mb.ID(), id) {
+		t.Fatal("legacy id changed")
+	}
+	mb.SetString("other", "value")
+	if mb.MarshalBinary()[1] != byte(len(ref)) {
+		t.Fatal("should be written in the legacy format")
+	}
+
+	// Unless a value cannot be represented
+	mb.SetInt("count", 1)
+	if b := mb.MarshalBinary(); b[1] != 0 || b[2] != metaFormatV2 {
+		t.Fatal("should be written in the binary format")
+	}
+
+	// Empty legacy block
+	eb := NewMetaBlock(nil, hasher)
+	if err := eb.UnmarshalBinary([]byte{byte(BlockTypeMeta), 0}); err != nil {
+		t.Fatal(err)
+	}
+	if len(eb.Keys()) != 0 || eb.Size() != 1 {
+		t.Fatal("should be empty")
+	}
+}
+
 // NullBlock is used calculate the hash of a stream of bytes via reading or writing to the
 // block
 type NullBlock struct {
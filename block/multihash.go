@@ -0,0 +1,139 @@
+package block
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+
+	"github.com/minio/blake2b-simd"
+)
+
+// HashCode identifies the hash algorithm of a multihash id.  The values follow the
+// multihash table.
+type HashCode uint64
+
+const (
+	// HashCodeSHA1 is the sha1 hash code
+	HashCodeSHA1 HashCode = 0x11
+	// HashCodeSHA256 is the sha2-256 hash code
+	HashCodeSHA256 HashCode = 0x12
+	// HashCodeSHA512 is the sha2-512 hash code
+	HashCodeSHA512 HashCode = 0x13
+	// HashCodeBlake2b256 is the blake2b-256 hash code
+	HashCodeBlake2b256 HashCode = 0xb220
+	// HashCodeBlake2b512 is the blake2b-512 hash code
+	HashCodeBlake2b512 HashCode = 0xb240
+)
+
+var (
+	// ErrUnknownHashCode is used when the hash code of an id is not supported
+	ErrUnknownHashCode = errors.New("unknown hash code")
+	// ErrInvalidMultihash is used when an id is not a valid multihash
+	ErrInvalidMultihash = errors.New("invalid multihash")
+)
+
+var hashFuncs = map[HashCode]func() hash.Hash{
+	HashCodeSHA1:       sha1.New,
+	HashCodeSHA256:     sha256.New,
+	HashCodeSHA512:     sha512.New,
+	HashCodeBlake2b256: blake2b.New256,
+	HashCodeBlake2b512: blake2b.New512,
+}
+
+func (code HashCode) String() string {
+	switch code {
+	case HashCodeSHA1:
+		return "sha1"
+	case HashCodeSHA256:
+		return "sha2-256"
+	case HashCodeSHA512:
+		return "sha2-512"
+	case HashCodeBlake2b256:
+		return "blake2b-256"
+	case HashCodeBlake2b512:
+		return "blake2b-512"
+	}
+	return fmt.Sprintf("0x%x", uint64(code))
+}
+
+// MultiHasher returns a hash function generator whose sums are self-describing
+// multihash ids.  Each id is the uvarint hash code, uvarint digest length and
+// finally the digest.  It can be used anywhere a hasher is expected.
+func MultiHasher(code HashCode) (func() hash.Hash, error) {
+	hf, ok := hashFuncs[code]
+	if !ok {
+		return nil, ErrUnknownHashCode
+	}
+
+	prefix := appendUvarint(nil, uint64(code))
+	prefix = appendUvarint(prefix, uint64(hf().Size()))
+
+	return func() hash.Hash {
+		return &multiHash{Hash: hf(), prefix: prefix}
+	}, nil
+}
+
+// multiHash prefixes the digest of the underlying hash with the hash code and
+// digest length
+type multiHash struct {
+	hash.Hash
+	prefix []byte
+}
+
+// Sum appends the multihash id to b
+func (h *multiHash) Sum(b []byte) []byte {
+	return h.Hash.Sum(append(b, h.prefix...))
+}
+
+// Size returns the size of the multihash id
+func (h *multiHash) Size() int {
+	return len(h.prefix) + h.Hash.Size()
+}
+
+// DecodeMultihash returns the hash code and digest of a multihash id.  It returns
+// an error if the id is not a valid multihash of a known hash code.
+func DecodeMultihash(id []byte) (HashCode, []byte, error) {
+	code, n := binary.Uvarint(id)
+	if n <= 0 {
+		return 0, nil, ErrInvalidMultihash
+	}
+	id = id[n:]
+
+	l, n := binary.Uvarint(id)
+	if n <= 0 || uint64(len(id[n:])) != l {
+		return 0, nil, ErrInvalidMultihash
+	}
+
+	hf, ok := hashFuncs[HashCode(code)]
+	if !ok {
+		return 0, nil, ErrUnknownHashCode
+	}
+	if int(l) != hf().Size() {
+		return 0, nil, ErrInvalidMultihash
+	}
+
+	return HashCode(code), id[n:], nil
+}
+
+// HasherForID returns the hash function generator that produced the multihash id
+func HasherForID(id []byte) (func() hash.Hash, error) {
+	code, _, err := DecodeMultihash(id)
+	if err != nil {
+		return nil, err
+	}
+	return MultiHasher(code)
+}
+
+// SelectHasher returns the hash function generator that produced the id if it is
+// a multihash, otherwise the default hasher is returned.  This allows blocks
+// hashed with different functions to live side by side.
+func SelectHasher(id []byte, def func() hash.Hash) func() hash.Hash {
+	if hf, err := HasherForID(id); err == nil {
+		return hf
+	}
+	return def
+}
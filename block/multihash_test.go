@@ -0,0 +1,91 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+func Test_MultiHasher(t *testing.T) {
+	data := []byte("multihash-data")
+
+	for code, size := range map[HashCode]int{
+		HashCodeSHA1:       22,
+		HashCodeSHA256:     34,
+		HashCodeSHA512:     66,
+		HashCodeBlake2b256: 36,
+		HashCodeBlake2b512: 68,
+	} {
+		hf, err := MultiHasher(code)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		h := hf()
+		h.Write(data)
+		id := h.Sum(nil)
+		if len(id) != size || h.Size() != size {
+			t.Fatalf("%s size mismatch want=%d have=%d/%d", code, size, len(id), h.Size())
+		}
+
+		c, digest, err := DecodeMultihash(id)
+		if err != nil {
+			t.Fatal(code, err)
+		}
+		if c != code {
+			t.Fatalf("code mismatch want=%s have=%s", code, c)
+		}
+		uh := hashFuncs[code]()
+		uh.Write(data)
+		if !bytes.Equal(digest, uh.Sum(nil)) {
+			t.Fatalf("%s digest mismatch", code)
+		}
+
+		// Hasher is selected from the id
+		h = SelectHasher(id, sha256.New)()
+		h.Write(data)
+		if !bytes.Equal(h.Sum(nil), id) {
+			t.Fatalf("%s wrong hasher selected", code)
+		}
+	}
+
+	if _, err := MultiHasher(0x01); err != ErrUnknownHashCode {
+		t.Fatal("should fail with", ErrUnknownHashCode, err)
+	}
+
+	// Plain ids fall back to the default hasher
+	sh := sha256.Sum256(data)
+	if _, _, err := DecodeMultihash(sh[:]); err == nil {
+		t.Fatal("plain sha256 should not decode")
+	}
+	h := SelectHasher(sh[:], sha256.New)()
+	if h.Size() != sha256.Size {
+		t.Fatal("should use default hasher")
+	}
+}
+
+func Test_MultiHasher_blocks(t *testing.T) {
+	hf, _ := MultiHasher(HashCodeBlake2b256)
+
+	idx := NewIndexBlock(nil, hf)
+	idx.SetBlockSize(4)
+	for i := uint64(0); i < 3; i++ {
+		blk := NewMemDataBlock(nil, hf)
+		wr, _ := blk.Writer()
+		wr.Write([]byte{byte(i), 1, 2, 3})
+		wr.Close()
+		idx.AddBlock(i, blk)
+	}
+	idx.Hash()
+
+	idx2 := NewIndexBlock(nil, SelectHasher(idx.ID(), sha256.New))
+	if err := idx2.UnmarshalBinary(idx.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if idx2.BlockCount() != 3 {
+		t.Fatal("should have 3 blocks", idx2.BlockCount())
+	}
+	if !bytes.Equal(idx2.Hash(), idx.ID()) {
+		t.Fatal("id mismatch")
+	}
+}
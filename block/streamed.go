@@ -22,6 +22,10 @@ type StreamedBlock struct {
 	fh io.ReadWriteCloser
 	// Read hasher
 	hasher func() hash.Hash
+	// Codec the data should be stored with
+	codec Codec
+	// Hash of the type and data once the stream has been completely read
+	sum []byte
 }
 
 // NewStreamedBlock initializes a block with a read/writer.  It hashes both on reads as well
@@ -47,6 +51,17 @@ func NewStreamedBlock(typ BlockType, uri *URI, hasher func() hash.Hash, fh io.Re
 	return nb
 }
 
+// SetCodec sets the codec the block data should be stored with.  The stream
+// itself is never encoded
+func (block *StreamedBlock) SetCodec(codec Codec) {
+	block.codec = codec
+}
+
+// Codec returns the codec the block data should be stored with
+func (block *StreamedBlock) Codec() Codec {
+	return block.codec
+}
+
 // Reader gets a reader that wraps the underlying network connection in to a block size
 // limited reader.
 func (block *StreamedBlock) Reader() (io.ReadCloser, error) {
@@ -55,10 +70,11 @@ func (block *StreamedBlock) Reader() (io.ReadCloser, error) {
 		return nil, errReaderWriterOpen
 	}
 	// We do not burn the type as it is not expected to be in the underlying stream
+	// but it is hashed to match the id
 	block.hr = NewHasherReader(block.hasher(), block.fh)
-	//_, err := block.hr.hasher.Write([]byte{byte(block.typ)})
+	_, err := block.hr.hasher.Write([]byte{byte(block.typ)})
 
-	return block, nil
+	return block, err
 }
 
 // Writer returns a write to a remote block.
@@ -79,7 +95,11 @@ func (block *StreamedBlock) Writer() (io.WriteCloser, error) {
 func (block *StreamedBlock) Close() error {
 
 	if swapped := atomic.CompareAndSwapInt32(&block.rwr, blockReading, 0); swapped {
-		block.id = block.hr.Hash()
+		// The id can only be computed once the complete stream has been read
+		if block.hr.DataSize() == block.size {
+			block.sum = block.hr.Hash()
+			block.id = block.sum
+		}
 		block.hr = nil
 		//block.hasher = nil
 	} else if swapped := atomic.CompareAndSwapInt32(&block.rwr, blockWriting, 0); swapped {
@@ -124,7 +144,14 @@ func (block *StreamedBlock) Write(p []byte) (int, error) {
 	return block.hw.Write(p)
 }
 
-// Hash is a no-op to satisfy the block interface
+// Hash returns the hash of the type and data computed once the stream has been
+// completely read through the Reader.  The stream cannot be re-read so nil is
+// returned until then.
 func (block *StreamedBlock) Hash() []byte {
-	return nil
+	return block.sum
+}
+
+// hashFunc returns the hash function generator used when reading the stream
+func (block *StreamedBlock) hashFunc() func() hash.Hash {
+	return block.hasher
 }
@@ -8,14 +8,35 @@ import (
 	"io"
 	"os"
 	"sort"
+	"strings"
 	"sync"
 )
 
-// TreeBlock is a block containing other types of blocks as it's children
+const (
+	// treeFormatText is the legacy format of a text line per node
+	treeFormatText byte = 0
+	// treeFormatV2 is the length-prefixed binary format
+	treeFormatV2 byte = 2
+	// treeFormatV3 is the binary format with node attributes
+	treeFormatV3 byte = 3
+	// treeFormatV4 is the binary format with node attributes and hard links
+	treeFormatV4 byte = 4
+)
+
+// TreeBlock is a block containing other types of blocks as it's children.  The
+// binary format is the 1-byte type, a zero byte marker, 1-byte format version,
+// uvarint node count followed by each binary TreeNode sorted by name.  Version 3
+// is only used when a node has attributes, in which case each node is followed by
+// its length prefixed attributes.  Version 4 is only used when a node is a hard
+// link and additionally writes the length prefixed link of each node.  Blocks in
+// the legacy text format are written back in that format so their ids do not
+// change.
 type TreeBlock struct {
 	*baseBlock
 	// Mode
 	mode os.FileMode
+	// Format version the block is marshalled with
+	version byte
 	// Child nodes indexed by name
 	mu    sync.RWMutex
 	nodes map[string]*TreeNode
@@ -26,6 +47,7 @@ type TreeBlock struct {
 // NewTreeBlock inits a new TreeBlock with the uri and hasher. The uri may be nil.
 func NewTreeBlock(uri *URI, hasher func() hash.Hash) *TreeBlock {
 	tb := &TreeBlock{
+		version:   treeFormatV2,
 		nodes:     make(map[string]*TreeNode),
 		baseBlock: &baseBlock{uri: uri, typ: BlockTypeTree, hasher: hasher},
 	}
@@ -86,11 +108,23 @@ func (block *TreeBlock) Iter(cb func(*TreeNode) error) error {
 	return err
 }
 
-// AddNodes adds TreeNodes to the TreeBlock.  It also updates the size of the block by
-// computing the byte slice size
-func (block *TreeBlock) AddNodes(nodes ...*TreeNode) {
+// AddNodes adds TreeNodes to the TreeBlock replacing existing nodes with the same
+// name.  It also updates the id and size of the block.  It returns an error
+// without adding any nodes if a name is invalid or given more than once.
+func (block *TreeBlock) AddNodes(nodes ...*TreeNode) error {
 	if len(nodes) == 0 {
-		return
+		return nil
+	}
+
+	names := make(map[string]struct{}, len(nodes))
+	for _, tn := range nodes {
+		if err := ValidateNodeName(tn.Name); err != nil {
+			return err
+		}
+		if _, ok := names[tn.Name]; ok {
+			return ErrDuplicateNode
+		}
+		names[tn.Name] = struct{}{}
 	}
 
 	block.mu.Lock()
@@ -108,46 +142,131 @@ func (block *TreeBlock) AddNodes(nodes ...*TreeNode) {
 	block.size = uint64(len(b[1:]))
 	block.mu.Unlock()
 
+	return nil
 }
 
-// UnmarshalBinary unmarshals the byte slice to a tree block
+// UnmarshalBinary unmarshals the byte slice to a tree block.  Both the binary and
+// legacy text formats are accepted.
 func (block *TreeBlock) UnmarshalBinary(b []byte) error {
+	if len(b) == 0 {
+		return ErrInvalidBlock
+	}
+
+	var (
+		nodes   map[string]*TreeNode
+		version byte
+		err     error
+	)
+	if len(b) > 2 && b[1] == 0 {
+		version = b[2]
+		nodes, err = unmarshalTreeNodes(version, b[3:])
+	} else {
+		version = treeFormatText
+		nodes, err = unmarshalTextTreeNodes(b[1:])
+	}
+	if err != nil {
+		return err
+	}
+
 	block.typ = BlockType(b[0])
 	block.size = uint64(len(b[1:]))
+	block.version = version
+	block.nodes = nodes
 
-	if len(b[1:]) == 0 {
-		return nil
+	return nil
+}
+
+// unmarshalTreeNodes unmarshals the nodes of the binary format
+func unmarshalTreeNodes(version byte, b []byte) (map[string]*TreeNode, error) {
+	if version < treeFormatV2 || version > treeFormatV4 {
+		return nil, ErrInvalidBlock
 	}
 
-	//fmt.Printf("|%s|\n", b[1:])
-	list := bytes.Split(b[1:], []byte("\n"))
+	count, b, err := readUvarint(b)
+	if err != nil {
+		return nil, err
+	}
+	if count > uint64(len(b)) {
+		return nil, ErrInvalidBlock
+	}
+
+	nodes := make(map[string]*TreeNode, count)
+	for i := uint64(0); i < count; i++ {
+		tn := &TreeNode{}
+		if b, err = tn.decode(b, version); err != nil {
+			return nil, err
+		}
+		if _, ok := nodes[tn.Name]; ok {
+			return nil, ErrDuplicateNode
+		}
+		nodes[tn.Name] = tn
+	}
+
+	if len(b) != 0 {
+		return nil, ErrInvalidBlock
+	}
+	return nodes, nil
+}
+
+// unmarshalTextTreeNodes unmarshals the nodes of the legacy text format, 1 per line
+func unmarshalTextTreeNodes(b []byte) (map[string]*TreeNode, error) {
+	nodes := make(map[string]*TreeNode)
+	if len(b) == 0 {
+		return nodes, nil
+	}
+
+	list := bytes.Split(b, []byte("\n"))
 	for _, l := range list {
 		tn := &TreeNode{}
-		if err := tn.UnmarshalBinary(l); err != nil {
-			return err
+		if err := tn.unmarshalText(l); err != nil {
+			return nil, err
 		}
-		block.nodes[tn.Name] = tn
+		if _, ok := nodes[tn.Name]; ok {
+			return nil, ErrDuplicateNode
+		}
+		nodes[tn.Name] = tn
 	}
 
-	return nil
+	return nodes, nil
 }
 
 // MarshalBinary marshals the TreeNodes sorted by name.  It writes a 1-byte type followed
-// by each node 1 per line.
+// by the format marker, version and nodes.  Legacy text blocks are written with each
+// node 1 per line unless a node can no longer be represented in that format.
 func (block *TreeBlock) MarshalBinary() []byte {
-	if len(block.nodes) == 0 {
-		return []byte{byte(block.typ)}
+	keys := block.sortedKeys()
+
+	if block.version == treeFormatText && block.textSafe() {
+		list := make([][]byte, 0, len(keys))
+		for _, k := range keys {
+			list = append(list, block.nodes[k].marshalText())
+		}
+		return append([]byte{byte(block.typ)}, bytes.Join(list, []byte("\n"))...)
 	}
 
-	keys := block.sortedKeys()
-	list := make([][]byte, 0, len(keys))
+	version := treeFormatV2
+	for _, node := range block.nodes {
+		if v := node.version(); v > version {
+			version = v
+		}
+	}
 
+	b := []byte{byte(block.typ), 0, version}
+	b = appendUvarint(b, uint64(len(keys)))
 	for _, k := range keys {
-		b := block.nodes[k].MarshalBinary()
-		list = append(list, b)
+		b = block.nodes[k].appendBinary(b, version)
 	}
+	return b
+}
 
-	return append([]byte{byte(block.typ)}, bytes.Join(list, []byte("\n"))...)
+// textSafe returns true if all nodes can be represented in the legacy text format
+func (block *TreeBlock) textSafe() bool {
+	for name, node := range block.nodes {
+		if strings.ContainsRune(name, '\n') || node.version() != treeFormatV2 {
+			return false
+		}
+	}
+	return true
 }
 
 // Reader inits the internal buffer for reading and writes the bytes to it.  It returns a
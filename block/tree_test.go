@@ -6,6 +6,7 @@ import (
 	"io"
 	"os"
 	"testing"
+	"time"
 )
 
 func Test_TreeNode(t *testing.T) {
@@ -113,3 +114,207 @@ func Test_TreeBlock(t *testing.T) {
 		t.Fatal("count mismatch", tb.NodeCount(), tb2.NodeCount())
 	}
 }
+
+func Test_TreeBlock_binary(t *testing.T) {
+	names := []string{"new\nline", "sp ace", "bin\x00\xff", "日本"}
+
+	tb := NewTreeBlock(nil, sha256.New)
+	for _, name := range names {
+		if err := tb.AddNodes(NewFileTreeNode(name, []byte("addr"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tb1 := NewTreeBlock(nil, sha256.New)
+	if err := tb1.UnmarshalBinary(tb.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range names {
+		if _, ok := tb1.GetNodeByName(name); !ok {
+			t.Fatalf("missing node %q", name)
+		}
+	}
+	if !bytes.Equal(tb1.Hash(), tb.ID()) {
+		t.Fatal("id mismatch")
+	}
+
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		if err := tb.AddNodes(NewFileTreeNode(name, nil)); err != ErrInvalidNodeName {
+			t.Fatalf("%q should fail with %v got %v", name, ErrInvalidNodeName, err)
+		}
+	}
+	if err := tb.AddNodes(NewFileTreeNode("x", nil), NewFileTreeNode("x", nil)); err != ErrDuplicateNode {
+		t.Fatal("should fail with", ErrDuplicateNode, err)
+	}
+
+	// Duplicate and truncated encodings are rejected
+	node := NewFileTreeNode("dup", []byte("addr")).MarshalBinary()
+	b := append([]byte{byte(BlockTypeTree), 0, treeFormatV2, 2}, node...)
+	if err := NewTreeBlock(nil, sha256.New).UnmarshalBinary(append(b, node...)); err != ErrDuplicateNode {
+		t.Fatal("should fail with", ErrDuplicateNode, err)
+	}
+	if err := NewTreeBlock(nil, sha256.New).UnmarshalBinary(b); err != ErrInvalidBlock {
+		t.Fatal("should fail with", ErrInvalidBlock, err)
+	}
+}
+
+func Test_TreeBlock_legacy(t *testing.T) {
+	nodes := []*TreeNode{
+		NewFileTreeNode("a file", []byte{1, 2}),
+		NewDirTreeNode("dir", []byte{3, 4}),
+		{Name: "meta", Address: []byte{5}, Type: BlockTypeMeta},
+	}
+
+	lines := make([][]byte, len(nodes))
+	for i, n := range nodes {
+		lines[i] = n.marshalText()
+	}
+	legacy := append([]byte{byte(BlockTypeTree)}, bytes.Join(lines, []byte("\n"))...)
+
+	h := sha256.New()
+	h.Write(legacy)
+	id := h.Sum(nil)
+
+	tb := NewTreeBlock(nil, sha256.New)
+	if err := tb.UnmarshalBinary(legacy); err != nil {
+		t.Fatal(err)
+	}
+	if tb.NodeCount() != 3 {
+		t.Fatal("should have 3 nodes")
+	}
+	if n, _ := tb.GetNodeByName("meta"); n.Type != BlockTypeMeta {
+		t.Fatal("meta type not parsed")
+	}
+
+	// Legacy blocks keep their ids
+	if !bytes.Equal(tb.Hash(), id) {
+		t.Fatal("legacy id changed")
+	}
+
+	// Unless a name cannot be represented
+	tb.AddNodes(NewFileTreeNode("new\nline", nil))
+	if tb.MarshalBinary()[1] != 0 {
+		t.Fatal("should be written in the binary format")
+	}
+}
+
+func Test_TreeBlock_attrs(t *testing.T) {
+	plain := NewFileTreeNode("plain", []byte("addr"))
+	node := NewFileTreeNode("file", []byte("addr"))
+	node.Attrs = &NodeAttrs{
+		ModTime: time.Unix(1500000000, 123).UTC(),
+		UID:     1000,
+		GID:     100,
+		Size:    4096,
+		Xattrs:  map[string][]byte{"user.b": []byte("2"), "user.a": {0, 1}},
+	}
+
+	// Standalone node
+	tn := &TreeNode{}
+	if err := tn.UnmarshalBinary(node.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if !tn.Attrs.Equal(node.Attrs) {
+		t.Fatal("attrs mismatch", tn.Attrs)
+	}
+	if err := tn.UnmarshalBinary(plain.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if tn.Attrs != nil {
+		t.Fatal("attrs should be nil")
+	}
+
+	// Trees without attributes keep the version 2 format
+	tb := NewTreeBlock(nil, sha256.New)
+	tb.AddNodes(plain)
+	b := tb.MarshalBinary()
+	if b[2] != treeFormatV2 {
+		t.Fatal("should be version 2")
+	}
+	id := tb.ID()
+
+	tb.AddNodes(node)
+	b = tb.MarshalBinary()
+	if b[2] != treeFormatV3 {
+		t.Fatal("should be version 3")
+	}
+
+	tb1 := NewTreeBlock(nil, sha256.New)
+	if err := tb1.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := tb1.GetNodeByName("file"); !n.Attrs.Equal(node.Attrs) {
+		t.Fatal("attrs mismatch", n.Attrs)
+	}
+	if n, _ := tb1.GetNodeByName("plain"); n.Attrs != nil {
+		t.Fatal("attrs should be nil")
+	}
+	if !bytes.Equal(tb1.Hash(), tb.ID()) {
+		t.Fatal("id mismatch")
+	}
+
+	// Removing the attributes restores the original id
+	nn := *node
+	nn.Attrs = nil
+	tb1 = NewTreeBlock(nil, sha256.New)
+	tb1.AddNodes(plain, &nn)
+	tb2 := NewTreeBlock(nil, sha256.New)
+	tb2.AddNodes(plain)
+	if !bytes.Equal(tb2.ID(), id) || tb1.MarshalBinary()[2] != treeFormatV2 {
+		t.Fatal("should not use attributes")
+	}
+
+	// Zero value attributes are kept
+	nn.Attrs = &NodeAttrs{}
+	tn = &TreeNode{}
+	if err := tn.UnmarshalBinary(nn.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if tn.Attrs == nil || !tn.Attrs.ModTime.IsZero() {
+		t.Fatal("zero attrs mismatch", tn.Attrs)
+	}
+}
+
+func Test_TreeBlock_links(t *testing.T) {
+	sym := NewSymlinkTreeNode("sym", []byte("target"))
+	if !sym.IsSymlink() || sym.Type != BlockTypeData {
+		t.Fatal("should be a symlink")
+	}
+
+	link := NewFileTreeNode("link", []byte("addr"))
+	link.Link = "sub/file"
+
+	tn := &TreeNode{}
+	if err := tn.UnmarshalBinary(link.MarshalBinary()); err != nil {
+		t.Fatal(err)
+	}
+	if tn.Link != link.Link || tn.Attrs != nil {
+		t.Fatal("link mismatch", tn.Link)
+	}
+
+	tb := NewTreeBlock(nil, sha256.New)
+	tb.AddNodes(sym)
+	if tb.MarshalBinary()[2] != treeFormatV2 {
+		t.Fatal("symlinks should not change the format")
+	}
+
+	tb.AddNodes(link)
+	b := tb.MarshalBinary()
+	if b[2] != treeFormatV4 {
+		t.Fatal("should be version 4")
+	}
+
+	tb1 := NewTreeBlock(nil, sha256.New)
+	if err := tb1.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := tb1.GetNodeByName("link"); n.Link != link.Link {
+		t.Fatal("link mismatch", n.Link)
+	}
+	if n, _ := tb1.GetNodeByName("sym"); !n.IsSymlink() || n.Link != "" {
+		t.Fatal("symlink mismatch")
+	}
+	if !bytes.Equal(tb1.Hash(), tb.ID()) {
+		t.Fatal("id mismatch")
+	}
+}
@@ -1,12 +1,16 @@
 package block
 
 import (
+	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // TreeNode contains child entries pointing to other blocks
@@ -15,9 +19,128 @@ type TreeNode struct {
 	Address []byte // hash address to its index block
 	Type    BlockType
 	Mode    os.FileMode
+	// Optional extended attributes.  Nil if not recorded
+	Attrs *NodeAttrs
+	// Slash separated path, relative to the tree root, of the node this node is
+	// hard linked to.  Empty if not a hard link
+	Link string
 }
 
-//NewFileTreeNode inits a new TreeNode for a file
+// NodeAttrs are the optional extended attributes of a TreeNode
+type NodeAttrs struct {
+	// Modification time
+	ModTime time.Time
+	// Owner user and group ids
+	UID uint32
+	GID uint32
+	// Logical size of the file data
+	Size uint64
+	// Extended file attributes by name
+	Xattrs map[string][]byte
+}
+
+// Equal returns true if both attributes are nil or have the same values
+func (attrs *NodeAttrs) Equal(o *NodeAttrs) bool {
+	if attrs == nil || o == nil {
+		return attrs == o
+	}
+	if !attrs.ModTime.Equal(o.ModTime) || attrs.UID != o.UID || attrs.GID != o.GID ||
+		attrs.Size != o.Size || len(attrs.Xattrs) != len(o.Xattrs) {
+		return false
+	}
+	for k, v := range attrs.Xattrs {
+		ov, ok := o.Xattrs[k]
+		if !ok || string(v) != string(ov) {
+			return false
+		}
+	}
+	return true
+}
+
+// MarshalBinary marshals the attributes.  It writes the modification time as a
+// varint of seconds and uvarint of nanoseconds since the unix epoch, the uvarint
+// uid, gid and size, and finally the uvarint xattr count followed by the uvarint
+// length prefixed name and value of each xattr sorted by name.
+func (attrs *NodeAttrs) MarshalBinary() []byte {
+	var b []byte
+	if !attrs.ModTime.IsZero() {
+		b = appendVarint(b, attrs.ModTime.Unix())
+		b = appendUvarint(b, uint64(attrs.ModTime.Nanosecond()))
+	} else {
+		b = appendVarint(b, 0)
+		b = appendUvarint(b, 0)
+	}
+	b = appendUvarint(b, uint64(attrs.UID))
+	b = appendUvarint(b, uint64(attrs.GID))
+	b = appendUvarint(b, attrs.Size)
+
+	keys := make([]string, 0, len(attrs.Xattrs))
+	for k := range attrs.Xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b = appendUvarint(b, uint64(len(keys)))
+	for _, k := range keys {
+		b = appendBytes(b, []byte(k))
+		b = appendBytes(b, attrs.Xattrs[k])
+	}
+	return b
+}
+
+// UnmarshalBinary unmarshals the binary form of the attributes
+func (attrs *NodeAttrs) UnmarshalBinary(b []byte) error {
+	sec, n := binary.Varint(b)
+	if n <= 0 {
+		return ErrInvalidBlock
+	}
+	vals := make([]uint64, 5)
+	var err error
+	b = b[n:]
+	for i := range vals {
+		if vals[i], b, err = readUvarint(b); err != nil {
+			return err
+		}
+	}
+	nsec, uid, gid, size, count := vals[0], vals[1], vals[2], vals[3], vals[4]
+	if nsec >= 1e9 || uid > math.MaxUint32 || gid > math.MaxUint32 || count > uint64(len(b)) {
+		return ErrInvalidBlock
+	}
+
+	var xattrs map[string][]byte
+	if count > 0 {
+		xattrs = make(map[string][]byte, count)
+		for i := uint64(0); i < count; i++ {
+			var k, v []byte
+			if k, b, err = readBytes(b); err != nil {
+				return err
+			}
+			if v, b, err = readBytes(b); err != nil {
+				return err
+			}
+			if _, ok := xattrs[string(k)]; ok {
+				return ErrInvalidBlock
+			}
+			xattrs[string(k)] = append([]byte{}, v...)
+		}
+	}
+	if len(b) != 0 {
+		return ErrInvalidBlock
+	}
+
+	attrs.ModTime = time.Time{}
+	if sec != 0 || nsec != 0 {
+		attrs.ModTime = time.Unix(sec, int64(nsec)).UTC()
+	}
+	attrs.UID = uint32(uid)
+	attrs.GID = uint32(gid)
+	attrs.Size = size
+	attrs.Xattrs = xattrs
+
+	return nil
+}
+
+// NewFileTreeNode inits a new TreeNode for a file
 func NewFileTreeNode(name string, addr []byte) *TreeNode {
 	return &TreeNode{
 		Name:    name,
@@ -27,7 +150,7 @@ func NewFileTreeNode(name string, addr []byte) *TreeNode {
 	}
 }
 
-//NewDirTreeNode inits a new TreeNode for a directory
+// NewDirTreeNode inits a new TreeNode for a directory
 func NewDirTreeNode(name string, addr []byte) *TreeNode {
 	return &TreeNode{
 		Name:    name,
@@ -37,32 +160,188 @@ func NewDirTreeNode(name string, addr []byte) *TreeNode {
 	}
 }
 
+// NewSymlinkTreeNode inits a new TreeNode for a symbolic link.  The address is
+// that of the data block containing the link target.
+func NewSymlinkTreeNode(name string, addr []byte) *TreeNode {
+	return &TreeNode{
+		Name:    name,
+		Address: addr,
+		Type:    BlockTypeData,
+		Mode:    os.ModePerm | os.ModeSymlink,
+	}
+}
+
+// IsDir returns true if the node is a directory pointing to a TreeBlock or the root
+// of a HAMT
+func (node *TreeNode) IsDir() bool {
+	return node.Type == BlockTypeTree || node.Type == BlockTypeHAMT
+}
+
+// IsSymlink returns true if the node is a symbolic link
+func (node *TreeNode) IsSymlink() bool {
+	return node.Mode&os.ModeSymlink != 0
+}
+
 func (node *TreeNode) MarshalJSON() ([]byte, error) {
 	t := struct {
 		Name    string
 		Address string
 		Type    BlockType
 		Mode    string
+		Attrs   *NodeAttrs `json:",omitempty"`
+		Link    string     `json:",omitempty"`
 	}{
 		node.Name,
 		hex.EncodeToString(node.Address),
 		node.Type,
 		node.Mode.String(),
+		node.Attrs,
+		node.Link,
 	}
 	return json.Marshal(t)
 }
 
-// MarshalBinary marshals the TreeNode into bytes.  It writes mode, space, block
-// type, space, hash address, space, and finally the name as a string and returns the
-// byte representation of the string
+// MarshalBinary marshals the TreeNode into its length-prefixed binary form.  It
+// writes the uvarint length prefixed name, 1-byte block type, uvarint mode and
+// the uvarint length prefixed hash address.  If set the uvarint length prefixed
+// attributes and link are written last.
 func (node TreeNode) MarshalBinary() []byte {
+	return node.appendBinary(nil, node.version())
+}
+
+// UnmarshalBinary unmarshals the binary form of a TreeNode.  It returns an error if
+// the format is not as expected or the name is invalid
+func (node *TreeNode) UnmarshalBinary(b []byte) error {
+	rest, err := node.decode(b, treeFormatV2)
+	if err == nil && len(rest) > 0 {
+		rest, err = node.decodeAttrs(rest)
+		if err == nil && len(rest) > 0 {
+			rest, err = node.decodeLink(rest)
+		} else if err == nil && node.Attrs == nil {
+			err = ErrInvalidBlock
+		}
+	}
+	if err == nil && len(rest) != 0 {
+		err = ErrInvalidBlock
+	}
+	return err
+}
+
+// version returns the lowest tree format version able to represent the node
+func (node TreeNode) version() byte {
+	switch {
+	case node.Link != "":
+		return treeFormatV4
+	case node.Attrs != nil:
+		return treeFormatV3
+	}
+	return treeFormatV2
+}
+
+// appendBinary appends the binary form of the node for the tree format version.
+// From version 3 the length prefixed attributes are always written, empty if not
+// set, and from version 4 the length prefixed link.
+func (node TreeNode) appendBinary(b []byte, version byte) []byte {
+	b = appendBytes(b, []byte(node.Name))
+	b = append(b, byte(node.Type))
+	b = appendUvarint(b, uint64(node.Mode))
+	b = appendBytes(b, node.Address)
+
+	if version >= treeFormatV3 {
+		var attrs []byte
+		if node.Attrs != nil {
+			attrs = node.Attrs.MarshalBinary()
+		}
+		b = appendBytes(b, attrs)
+	}
+	if version >= treeFormatV4 {
+		b = appendBytes(b, []byte(node.Link))
+	}
+	return b
+}
+
+// decodeLink decodes the length prefixed link returning the remaining bytes
+func (node *TreeNode) decodeLink(b []byte) ([]byte, error) {
+	link, b, err := readBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	node.Link = string(link)
+	return b, nil
+}
+
+// decodeAttrs decodes the length prefixed attributes returning the remaining
+// bytes.  Empty attributes are not set.
+func (node *TreeNode) decodeAttrs(b []byte) ([]byte, error) {
+	ab, b, err := readBytes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	node.Attrs = nil
+	if len(ab) > 0 {
+		attrs := &NodeAttrs{}
+		if err = attrs.UnmarshalBinary(ab); err != nil {
+			return nil, err
+		}
+		node.Attrs = attrs
+	}
+	return b, nil
+}
+
+// decode decodes a single binary TreeNode of the tree format version returning the
+// remaining bytes
+func (node *TreeNode) decode(b []byte, version byte) ([]byte, error) {
+	name, b, err := readBytes(b)
+	if err != nil {
+		return nil, err
+	}
+	if err = ValidateNodeName(string(name)); err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, ErrInvalidBlock
+	}
+	typ := BlockType(b[0])
+
+	mode, b, err := readUvarint(b[1:])
+	if err != nil {
+		return nil, err
+	}
+
+	addr, b, err := readBytes(b)
+	if err != nil {
+		return nil, err
+	}
+
+	node.Name = string(name)
+	node.Type = typ
+	node.Mode = os.FileMode(mode)
+	node.Address = append([]byte{}, addr...)
+	node.Attrs = nil
+	node.Link = ""
+
+	if version >= treeFormatV3 {
+		if b, err = node.decodeAttrs(b); err != nil {
+			return nil, err
+		}
+	}
+	if version >= treeFormatV4 {
+		return node.decodeLink(b)
+	}
+	return b, nil
+}
+
+// marshalText marshals the TreeNode into the legacy text form.  It writes mode,
+// space, block type, space, hash address, space, and finally the name.
+func (node TreeNode) marshalText() []byte {
 	str := fmt.Sprintf("%d %s %x %s", node.Mode, node.Type, node.Address, node.Name)
 	return []byte(str)
 }
 
-// UnmarshalBinary unmarshals the given bytes into a TreeNode.  it returns an error if the
-// format is not as expected
-func (node *TreeNode) UnmarshalBinary(b []byte) error {
+// unmarshalText unmarshals the legacy text form of a TreeNode.  it returns an error
+// if the format is not as expected
+func (node *TreeNode) unmarshalText(b []byte) error {
 	str := string(b)
 	parts := strings.Split(str, " ")
 
@@ -87,5 +366,13 @@ func (node *TreeNode) UnmarshalBinary(b []byte) error {
 
 	node.Name = strings.Join(parts[3:], " ")
 	return nil
+}
 
+// ValidateNodeName returns ErrInvalidNodeName if the name is empty, "." or "..", or
+// contains a "/".  Any other byte sequence is a valid name.
+func ValidateNodeName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsRune(name, '/') {
+		return ErrInvalidNodeName
+	}
+	return nil
 }
@@ -1,6 +1,7 @@
 package block
 
 import (
+	"encoding/binary"
 	"io"
 )
 
@@ -32,6 +33,7 @@ func ReadBlockType(r io.Reader) (BlockType, error) {
 	return bt, err
 }
 
+// ParseBlockType parses the string representation of a BlockType
 func ParseBlockType(typ string) (btyp BlockType, err error) {
 
 	switch typ {
@@ -41,9 +43,54 @@ func ParseBlockType(typ string) (btyp BlockType, err error) {
 		btyp = BlockTypeIndex
 	case "tree":
 		btyp = BlockTypeTree
+	case "meta":
+		btyp = BlockTypeMeta
+	case "hamt":
+		btyp = BlockTypeHAMT
 	default:
 		err = ErrInvalidBlockType
 	}
 
 	return
 }
+
+// appendUvarint appends the uvarint encoding of v to the byte slice
+func appendUvarint(b []byte, v uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(buf, v)
+	return append(b, buf[:n]...)
+}
+
+// appendVarint appends the varint encoding of v to the byte slice
+func appendVarint(b []byte, v int64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, v)
+	return append(b, buf[:n]...)
+}
+
+// appendBytes appends the uvarint length prefixed bytes to the byte slice
+func appendBytes(b []byte, p []byte) []byte {
+	return append(appendUvarint(b, uint64(len(p))), p...)
+}
+
+// readUvarint reads a uvarint returning it along with the remaining bytes
+func readUvarint(b []byte) (uint64, []byte, error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 {
+		return 0, nil, ErrInvalidBlock
+	}
+	return v, b[n:], nil
+}
+
+// readBytes reads uvarint length prefixed bytes returning them along with the
+// remaining bytes
+func readBytes(b []byte) ([]byte, []byte, error) {
+	l, b, err := readUvarint(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	if uint64(len(b)) < l {
+		return nil, nil, ErrInvalidBlock
+	}
+	return b[:l], b[l:], nil
+}
@@ -0,0 +1,75 @@
+package block
+
+import (
+	"bytes"
+	"hash"
+	"io"
+)
+
+// Verify re-hashes the block content and checks that it matches the block id.
+// It returns ErrBlockCorrupt if it does not.
+func Verify(blk Block) error {
+	return VerifyID(blk, blk.ID())
+}
+
+// VerifyID re-hashes the block content and checks that it matches the given id.
+// The content is hashed exactly as the writers do i.e. the 1-byte type followed by
+// the logical data.  The hash function is selected from the id if it is a
+// multihash, otherwise the block hasher is used.  A block backed by a stream is
+// consumed in the process.
+func VerifyID(blk Block, id []byte) error {
+	if len(id) == 0 {
+		return ErrInvalidBlock
+	}
+
+	hasher := SelectHasher(id, blockHasher(blk))
+	if hasher == nil {
+		return ErrInvalidBlock
+	}
+
+	sum, err := hashBlock(hasher(), blk)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(sum, id) {
+		return ErrBlockCorrupt
+	}
+	return nil
+}
+
+// hashBlock writes the block type and content read from the block to the hash
+// returning the sum
+func hashBlock(h hash.Hash, blk Block) ([]byte, error) {
+	rd, err := blk.Reader()
+	if err != nil {
+		return nil, err
+	}
+
+	h.Write([]byte{byte(blk.Type())})
+	_, err = io.Copy(h, rd)
+	if e := rd.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return h.Sum(nil), nil
+}
+
+// blockHasher returns the hash function of the block or nil if it is not known.
+// Blocks implemented outside of this package may provide it with a Hasher method.
+func blockHasher(blk Block) func() hash.Hash {
+	switch hb := blk.(type) {
+	case interface {
+		hashFunc() func() hash.Hash
+	}:
+		return hb.hashFunc()
+	case interface {
+		Hasher() func() hash.Hash
+	}:
+		return hb.Hasher()
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package block
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type nopReadWriteCloser struct {
+	*bytes.Buffer
+}
+
+func (rw *nopReadWriteCloser) Close() error { return nil }
+
+func Test_Verify(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "verify-")
+	defer os.RemoveAll(dir)
+
+	data := bytes.Repeat([]byte("verify-data-"), 100)
+	mem, _ := newMemDataBlock(data)
+
+	idx := NewIndexBlock(nil, sha256.New)
+	idx.SetBlockSize(uint64(len(data)))
+	idx.AddBlock(0, mem)
+	idx.Hash()
+
+	tree := NewTreeBlock(nil, sha256.New)
+	tree.AddNodes(NewFileTreeNode("file", idx.ID()))
+
+	meta := NewMetaBlock(nil, sha256.New)
+	meta.SetReference(idx.ID())
+	meta.SetMetadata(map[string]string{"name": "file"})
+
+	for _, blk := range []Block{mem, idx, tree, meta} {
+		if err := Verify(blk); err != nil {
+			t.Fatalf("%s %v", blk.Type(), err)
+		}
+	}
+
+	// File blocks with and without a codec
+	for _, codec := range []Codec{nil, &GzipCodec{Level: 1}} {
+		cdir, _ := ioutil.TempDir(dir, "data")
+		fb := NewFileDataBlock(NewURI("file://"+cdir), sha256.New)
+		fb.SetCodec(codec)
+		wr, _ := fb.Writer()
+		wr.Write(data)
+		if err := wr.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(fb.Hash(), mem.ID()) {
+			t.Fatalf("%s hash mismatch %x != %x", CodecTypeOf(codec), fb.ID(), mem.ID())
+		}
+		if err := Verify(fb); err != nil {
+			t.Fatal(CodecTypeOf(codec), err)
+		}
+	}
+
+	// Corrupt file data
+	fb := NewFileDataBlock(NewURI("file://"+dir), sha256.New)
+	wr, _ := fb.Writer()
+	wr.Write(data)
+	wr.Close()
+	if err := ioutil.WriteFile(fb.URI().Path, append([]byte{byte(BlockTypeData)}, data[1:]...), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Verify(fb); err != ErrBlockCorrupt {
+		t.Fatal("should fail with", ErrBlockCorrupt, err)
+	}
+
+	// Id mismatch
+	if err := VerifyID(tree, idx.ID()); err != ErrBlockCorrupt {
+		t.Fatal("should fail with", ErrBlockCorrupt, err)
+	}
+
+	// Multihash ids select their own hasher
+	mh, _ := MultiHasher(HashCodeSHA512)
+	mmem := NewMemDataBlock(nil, mh)
+	wr, _ = mmem.Writer()
+	wr.Write(data)
+	wr.Close()
+	if err := VerifyID(mem, mmem.ID()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_StreamedBlock_Hash(t *testing.T) {
+	data := []byte("streamed-block-data")
+	mem, _ := newMemDataBlock(data)
+
+	rw := &nopReadWriteCloser{bytes.NewBuffer(data)}
+	sb := NewStreamedBlock(BlockTypeData, NewURI("tcp://host/"), sha256.New, rw, uint64(len(data)))
+	if sb.Hash() != nil {
+		t.Fatal("hash should be nil before reading")
+	}
+
+	rd, _ := sb.Reader()
+	if _, err := ioutil.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+
+	if !bytes.Equal(sb.Hash(), mem.ID()) {
+		t.Fatalf("hash mismatch %x != %x", sb.Hash(), mem.ID())
+	}
+
+	// Verification consumes the stream
+	rw = &nopReadWriteCloser{bytes.NewBuffer(data)}
+	sb = NewStreamedBlock(BlockTypeData, NewURI("tcp://host/"), sha256.New, rw, uint64(len(data)))
+	if err := VerifyID(sb, mem.ID()); err != nil {
+		t.Fatal(err)
+	}
+}
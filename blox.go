@@ -22,11 +22,59 @@ type BlockDevice interface {
 // Blox is used to read and write data streams to a block device
 type Blox struct {
 	dev BlockDevice
+
+	// Chunker used to split streams when writing.  If nil fixed size blocks are
+	// used
+	chunker Chunker
+
+	// Codec used to store data blocks when writing.  If nil blocks are stored as is
+	codec block.Codec
+
+	// Whether WriteTree records extended attributes of files and directories
+	attrs bool
+
+	// Entries above which directories are written as a HAMT
+	shardThreshold int
 }
 
 // NewBlox inits a new Blox instance with a block device.
 func NewBlox(dev BlockDevice) *Blox {
-	return &Blox{dev: dev}
+	return &Blox{dev: dev, shardThreshold: DefaultShardThreshold}
+}
+
+// SetChunker sets the Chunker used by WriteIndex to split streams into blocks.
+// It should be set before the instance is used as it is not thread-safe
+func (blox *Blox) SetChunker(chunker Chunker) {
+	blox.chunker = chunker
+}
+
+// SetCodec sets the codec WriteIndex stores data blocks with.  It should be set
+// before the instance is used as it is not thread-safe
+func (blox *Blox) SetCodec(codec block.Codec) {
+	blox.codec = codec
+}
+
+// SetTreeAttrs sets whether WriteTree and ImportTar record the modification
+// time, ownership, size and xattrs of each file and directory.  Trees written
+// without attributes only change when the content, names or modes change.
+// ImportTar always records modification times.  It should be set before the
+// instance is used as it is not thread-safe
+func (blox *Blox) SetTreeAttrs(enabled bool) {
+	blox.attrs = enabled
+}
+
+// SetShardThreshold sets the number of entries above which directories are written
+// as a HAMT of blocks rather than a single TreeBlock.  Directories are converted
+// between the two as they grow and shrink past the threshold.  A threshold less
+// than 1 disables the use of HAMTs.  It should be set before the instance is used
+// as it is not thread-safe
+func (blox *Blox) SetShardThreshold(n int) {
+	blox.shardThreshold = n
+}
+
+// dirWriter returns a writer for directories using the shard threshold
+func (blox *Blox) dirWriter() *dirWriter {
+	return &dirWriter{dev: blox.dev, threshold: blox.shardThreshold}
 }
 
 // ReadIndex reads the index id and writes the block data to the writer
@@ -42,6 +90,10 @@ func (blox *Blox) ReadIndex(id []byte, wr io.Writer, parallel int) error {
 // WriteIndex reads from the reader and writes to blox storage
 func (blox *Blox) WriteIndex(rd io.ReadCloser, parallel int) (idx *block.IndexBlock, err error) {
 	sharder := NewStreamSharder(blox.dev, parallel)
+	if blox.chunker != nil {
+		sharder.SetChunker(blox.chunker)
+	}
+	sharder.SetCodec(blox.codec)
 	if err = sharder.Shard(rd); err == nil {
 		idx = sharder.IndexBlock()
 		_, err = blox.dev.SetBlock(idx)
@@ -0,0 +1,224 @@
+package blox
+
+import (
+	"errors"
+	"io"
+
+	"github.com/hexablock/blox/block"
+)
+
+var errInvalidChunkSize = errors.New("invalid chunk size")
+
+// Chunker splits a stream into chunks.  Each chunk becomes a data block in the
+// index of the stream.
+type Chunker interface {
+	// NewReader returns a ChunkReader returning successive chunks from the reader
+	NewReader(rd io.Reader) ChunkReader
+	// BlockSize returns the max size of a chunk.  This is recorded as the block size
+	// of the index
+	BlockSize() uint64
+}
+
+// ChunkReader reads chunks from an underlying stream
+type ChunkReader interface {
+	// Next returns the next chunk.  It returns io.EOF when the stream has been
+	// exhausted.  The returned slice is owned by the caller.
+	Next() ([]byte, error)
+}
+
+// FixedChunker splits a stream into chunks of a fixed size.  Only the last chunk
+// may be smaller than the size.
+type FixedChunker struct {
+	Size uint64
+}
+
+// NewFixedChunker inits a new FixedChunker with the given chunk size
+func NewFixedChunker(size uint64) *FixedChunker {
+	return &FixedChunker{Size: size}
+}
+
+// BlockSize returns the fixed chunk size
+func (ch *FixedChunker) BlockSize() uint64 {
+	return ch.Size
+}
+
+// NewReader returns a ChunkReader returning fixed size chunks from the reader
+func (ch *FixedChunker) NewReader(rd io.Reader) ChunkReader {
+	return &fixedChunkReader{rd: rd, buf: make([]byte, ch.Size)}
+}
+
+type fixedChunkReader struct {
+	rd  io.Reader
+	buf []byte
+	eof bool
+}
+
+func (cr *fixedChunkReader) Next() ([]byte, error) {
+	if cr.eof {
+		return nil, io.EOF
+	}
+	if len(cr.buf) == 0 {
+		return nil, errInvalidChunkSize
+	}
+
+	n, err := io.ReadFull(cr.rd, cr.buf)
+	if err != nil {
+		if err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		cr.eof = true
+	}
+
+	out := make([]byte, n)
+	copy(out, cr.buf[:n])
+	return out, nil
+}
+
+// CDCChunker is a content-defined chunker based on FastCDC.  It uses a gear
+// based rolling hash to find chunk boundaries such that insertions and deletions
+// in a stream only affect the chunks around the edit, preserving deduplication
+// of the remaining chunks.
+type CDCChunker struct {
+	// Min, average and max chunk sizes
+	Min uint64
+	Avg uint64
+	Max uint64
+
+	// Mask used before and after the average size is reached
+	maskS uint64
+	maskL uint64
+}
+
+// NewCDCChunker inits a new content-defined chunker with the min, average and max
+// chunk sizes.  The average is rounded down to a power of 2.
+func NewCDCChunker(min, avg, max uint64) (*CDCChunker, error) {
+	if min == 0 || min > avg || avg > max {
+		return nil, errInvalidChunkSize
+	}
+
+	var bits uint
+	for (uint64(1) << (bits + 1)) <= avg {
+		bits++
+	}
+	if bits < 2 || bits > 62 {
+		return nil, errInvalidChunkSize
+	}
+
+	return &CDCChunker{
+		Min:   min,
+		Avg:   avg,
+		Max:   max,
+		maskS: cdcMask(bits + 1),
+		maskL: cdcMask(bits - 1),
+	}, nil
+}
+
+// DefaultCDCChunker returns a content-defined chunker with an average chunk size
+// of the DefaultBlockSize
+func DefaultCDCChunker() *CDCChunker {
+	avg := block.DefaultBlockSize
+	ch, _ := NewCDCChunker(avg/4, avg, avg*4)
+	return ch
+}
+
+// BlockSize returns the max chunk size
+func (ch *CDCChunker) BlockSize() uint64 {
+	return ch.Max
+}
+
+// NewReader returns a ChunkReader returning content-defined chunks from the reader
+func (ch *CDCChunker) NewReader(rd io.Reader) ChunkReader {
+	return &cdcChunkReader{ch: ch, rd: rd, buf: make([]byte, ch.Max)}
+}
+
+// cut returns the chunk boundary for the given data
+func (ch *CDCChunker) cut(b []byte) int {
+	n := uint64(len(b))
+	if n <= ch.Min {
+		return int(n)
+	}
+	if n > ch.Max {
+		n = ch.Max
+	}
+
+	normal := ch.Avg
+	if n < normal {
+		normal = n
+	}
+
+	var (
+		fp uint64
+		i  = ch.Min
+	)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gearTable[b[i]]
+		if fp&ch.maskS == 0 {
+			return int(i + 1)
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gearTable[b[i]]
+		if fp&ch.maskL == 0 {
+			return int(i + 1)
+		}
+	}
+
+	return int(n)
+}
+
+type cdcChunkReader struct {
+	ch  *CDCChunker
+	rd  io.Reader
+	buf []byte
+	// Number of buffered bytes
+	n   int
+	eof bool
+}
+
+func (cr *cdcChunkReader) Next() ([]byte, error) {
+	// Fill the buffer
+	if !cr.eof && cr.n < len(cr.buf) {
+		m, err := io.ReadFull(cr.rd, cr.buf[cr.n:])
+		cr.n += m
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return nil, err
+			}
+			cr.eof = true
+		}
+	}
+
+	if cr.n == 0 {
+		return nil, io.EOF
+	}
+
+	c := cr.ch.cut(cr.buf[:cr.n])
+	out := make([]byte, c)
+	copy(out, cr.buf[:c])
+
+	// Shift remaining data to the front of the buffer
+	cr.n = copy(cr.buf, cr.buf[c:cr.n])
+
+	return out, nil
+}
+
+// cdcMask returns a mask with the given number of high bits set.  The high bits of
+// the gear hash depend on the most bytes in the window.
+func cdcMask(bits uint) uint64 {
+	return ((uint64(1) << bits) - 1) << (64 - bits)
+}
+
+// gearTable contains 256 pseudo-random values used by the gear hash.  It is
+// generated deterministically so chunk boundaries are stable across processes.
+var gearTable = func() (t [256]uint64) {
+	// splitmix64
+	seed := uint64(0x6a09e667f3bcc908)
+	for i := range t {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return
+}()
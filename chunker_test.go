@@ -0,0 +1,85 @@
+package blox
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func readChunks(t *testing.T, chunker Chunker, data []byte) [][]byte {
+	cr := chunker.NewReader(bytes.NewReader(data))
+
+	var out [][]byte
+	for {
+		chunk, err := cr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		out = append(out, chunk)
+	}
+	return out
+}
+
+func Test_FixedChunker(t *testing.T) {
+	data := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	chunks := readChunks(t, NewFixedChunker(4096), data)
+	if len(chunks) != 3 {
+		t.Fatalf("chunk count want=3 have=%d", len(chunks))
+	}
+	if len(chunks[2]) != 10000-8192 {
+		t.Fatal("wrong last chunk size", len(chunks[2]))
+	}
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func Test_CDCChunker(t *testing.T) {
+	if _, err := NewCDCChunker(1024, 512, 4096); err == nil {
+		t.Fatal("should fail with invalid sizes")
+	}
+
+	chunker, err := NewCDCChunker(1024, 4096, 16384)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(2)).Read(data)
+
+	chunks := readChunks(t, chunker, data)
+	if !bytes.Equal(bytes.Join(chunks, nil), data) {
+		t.Fatal("data mismatch")
+	}
+	for i, c := range chunks {
+		if uint64(len(c)) > chunker.Max {
+			t.Fatal("chunk exceeds max size", i, len(c))
+		}
+		if i < len(chunks)-1 && uint64(len(c)) < chunker.Min {
+			t.Fatal("chunk below min size", i, len(c))
+		}
+	}
+
+	// Insert a byte at the start.  All but the first few chunks should be the same
+	edited := append([]byte{'x'}, data...)
+	echunks := readChunks(t, chunker, edited)
+
+	orig := make(map[string]bool)
+	for _, c := range chunks {
+		orig[string(c)] = true
+	}
+	var same int
+	for _, c := range echunks {
+		if orig[string(c)] {
+			same++
+		}
+	}
+	if same < len(chunks)-2 {
+		t.Fatalf("too few shared chunks have=%d total=%d", same, len(chunks))
+	}
+}
@@ -0,0 +1,316 @@
+package blox
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/hexablock/blox/block"
+)
+
+const (
+	// Size of the per-block convergent keys as well as the user key
+	cryptoKeySize = 32
+
+	// Metadata keys of the MetaBlock describing an encrypted stream
+	metaKeyKeys   = "keys"
+	metaKeyCipher = "cipher"
+
+	// Cipher used to encrypt blocks
+	blockCipherName = "aes-256-ctr"
+)
+
+var (
+	errInvalidKeySize = errors.New("key must be 32 bytes")
+	errInvalidKeyData = errors.New("invalid key data")
+	errNotEncrypted   = errors.New("not an encrypted stream")
+)
+
+// EncryptedSharder shards a stream encrypting each block with a key derived from
+// its content i.e. convergent encryption.  Identical content produces identical
+// encrypted blocks preserving deduplication.  The per-block keys are encrypted
+// with the user key and stored as a separate stream referenced by the MetaBlock
+// describing the encrypted stream.  Storage nodes never see plaintext.
+type EncryptedSharder struct {
+	*StreamSharder
+
+	// User key protecting the per-block keys
+	key []byte
+
+	// Convergent key of each block by index
+	mu   sync.Mutex
+	keys map[uint64][]byte
+
+	// MetaBlock describing the encrypted stream
+	meta *block.MetaBlock
+}
+
+// NewEncryptedSharder inits a new EncryptedSharder writing to the device.  The key
+// is a 32 byte user key used to protect the per-block keys.
+func NewEncryptedSharder(dev BlockDevice, numRoutines int, key []byte) (*EncryptedSharder, error) {
+	if len(key) != cryptoKeySize {
+		return nil, errInvalidKeySize
+	}
+
+	sh := &EncryptedSharder{
+		StreamSharder: NewStreamSharder(dev, numRoutines),
+		key:           key,
+		keys:          make(map[uint64][]byte),
+	}
+	sh.StreamSharder.transform = sh.encrypt
+
+	return sh, nil
+}
+
+// MetaBlock returns the MetaBlock describing the encrypted stream.  It references
+// the index of the encrypted stream.  It is available once Shard has completed and
+// is not written to the device.
+func (sh *EncryptedSharder) MetaBlock() *block.MetaBlock {
+	return sh.meta
+}
+
+// Shard encrypts and shards the stream.  Once complete the index of the encrypted
+// stream and the encrypted keys are written to the device and the MetaBlock is
+// generated.
+func (sh *EncryptedSharder) Shard(rd io.ReadCloser) error {
+	start := time.Now()
+
+	if err := sh.StreamSharder.Shard(rd); err != nil {
+		return err
+	}
+
+	idx := sh.StreamSharder.IndexBlock()
+	if _, err := sh.dev.SetBlock(idx); err != nil && err != block.ErrBlockExists {
+		return err
+	}
+
+	// Collect keys in block order
+	sh.mu.Lock()
+	keys := make([]byte, 0, len(sh.keys)*cryptoKeySize)
+	for i := uint64(0); i < uint64(len(sh.keys)); i++ {
+		keys = append(keys, sh.keys[i]...)
+	}
+	sh.mu.Unlock()
+
+	ekeys, err := sealKeys(sh.key, keys)
+	if err != nil {
+		return err
+	}
+
+	// Store the encrypted keys as a stream of their own
+	ksh := NewStreamSharder(sh.dev, sh.numRoutines)
+	if err = ksh.Shard(ioutil.NopCloser(bytes.NewReader(ekeys))); err != nil {
+		return err
+	}
+	kidx := ksh.IndexBlock()
+	if _, err = sh.dev.SetBlock(kidx); err != nil && err != block.ErrBlockExists {
+		return err
+	}
+
+	meta := block.NewMetaBlock(nil, sh.dev.Hasher())
+	meta.SetReference(idx.ID())
+	meta.SetMetadata(map[string]string{
+		metaKeyKeys:   hex.EncodeToString(kidx.ID()),
+		metaKeyCipher: blockCipherName,
+	})
+	sh.meta = meta
+
+	sh.runtime = time.Since(start)
+
+	return nil
+}
+
+// encrypt encrypts the shard data with the key derived from the data recording
+// the key by the shard index
+func (sh *EncryptedSharder) encrypt(index uint64, data []byte) ([]byte, error) {
+	key := convergentKey(data)
+	out, err := cryptBlock(key, data)
+	if err == nil {
+		sh.mu.Lock()
+		sh.keys[index] = key
+		sh.mu.Unlock()
+	}
+	return out, err
+}
+
+// EncryptedAssembler assembles an encrypted stream written by an EncryptedSharder
+// decrypting each block
+type EncryptedAssembler struct {
+	*Assembler
+
+	// User key protecting the per-block keys
+	key []byte
+
+	// Decrypted per-block keys
+	keys []byte
+}
+
+// NewEncryptedAssembler inits a new EncryptedAssembler backed by the device.  The
+// key is the 32 byte user key the stream was written with.
+func NewEncryptedAssembler(dev BlockDevice, numRoutines int, key []byte) (*EncryptedAssembler, error) {
+	if len(key) != cryptoKeySize {
+		return nil, errInvalidKeySize
+	}
+
+	asm := &EncryptedAssembler{
+		Assembler: NewAssembler(dev, numRoutines),
+		key:       key,
+	}
+	asm.Assembler.transform = asm.decrypt
+
+	return asm, nil
+}
+
+// SetRoot retrieves the MetaBlock with the id along with the encrypted stream
+// index it references, and decrypts the per-block keys.
+func (asm *EncryptedAssembler) SetRoot(id []byte) (*block.IndexBlock, error) {
+	blk, err := asm.dev.GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	meta, ok := blk.(*block.MetaBlock)
+	if !ok {
+		return nil, errNotEncrypted
+	}
+
+	md := meta.Metadata()
+	if md[metaKeyCipher] != blockCipherName {
+		return nil, errNotEncrypted
+	}
+	kid, err := hex.DecodeString(md[metaKeyKeys])
+	if err != nil {
+		return nil, err
+	}
+
+	// Assemble and decrypt the keys
+	kasm := NewAssembler(asm.dev, asm.numRoutines)
+	if _, err = kasm.SetRoot(kid); err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(nil)
+	if err = kasm.Assemble(buf); err != nil {
+		return nil, err
+	}
+	if asm.keys, err = openKeys(asm.key, buf.Bytes()); err != nil {
+		return nil, err
+	}
+
+	return asm.Assembler.SetRoot(meta.Reference())
+}
+
+func (asm *EncryptedAssembler) decrypt(index uint64, data []byte) ([]byte, error) {
+	s := index * cryptoKeySize
+	if s+cryptoKeySize > uint64(len(asm.keys)) {
+		return nil, errInvalidKeyData
+	}
+	return cryptBlock(asm.keys[s:s+cryptoKeySize], data)
+}
+
+// WriteEncrypted encrypts and writes the stream to blox storage.  It returns the
+// MetaBlock describing the encrypted stream after writing it to the device.
+func (blox *Blox) WriteEncrypted(rd io.ReadCloser, key []byte, parallel int) (*block.MetaBlock, error) {
+	sharder, err := NewEncryptedSharder(blox.dev, parallel, key)
+	if err != nil {
+		return nil, err
+	}
+	if blox.chunker != nil {
+		sharder.SetChunker(blox.chunker)
+	}
+	sharder.SetCodec(blox.codec)
+
+	if err = sharder.Shard(rd); err != nil {
+		return nil, err
+	}
+
+	meta := sharder.MetaBlock()
+	_, err = blox.dev.SetBlock(meta)
+	return meta, err
+}
+
+// ReadEncrypted reads the encrypted stream described by the MetaBlock id, and
+// writes the decrypted data to the writer
+func (blox *Blox) ReadEncrypted(id []byte, wr io.Writer, key []byte, parallel int) error {
+	asm, err := NewEncryptedAssembler(blox.dev, parallel, key)
+	if err != nil {
+		return err
+	}
+
+	if _, err = asm.SetRoot(id); err == nil {
+		err = asm.Assemble(wr)
+	}
+	return err
+}
+
+// convergentKey derives the encryption key of a block from its content
+func convergentKey(data []byte) []byte {
+	sh := sha256.Sum256(data)
+	return sh[:]
+}
+
+// cryptBlock encrypts or decrypts the block data with AES-256 in CTR mode.  A zero
+// IV is used as each key is only ever used for the same content.
+func cryptBlock(key, data []byte) ([]byte, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, len(data))
+	iv := make([]byte, aes.BlockSize)
+	cipher.NewCTR(c, iv).XORKeyStream(out, data)
+	return out, nil
+}
+
+// sealKeys encrypts the keys with the user key using AES-256-GCM.  The random
+// nonce is prepended to the output
+func sealKeys(key, keys []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	return aead.Seal(nonce, nonce, keys, nil), nil
+}
+
+// openKeys decrypts and authenticates the keys sealed with the user key
+func openKeys(key, data []byte) ([]byte, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	ns := aead.NonceSize()
+	if len(data) < ns {
+		return nil, errInvalidKeyData
+	}
+
+	keys, err := aead.Open(nil, data[:ns], data[ns:], nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys)%cryptoKeySize != 0 {
+		return nil, errInvalidKeyData
+	}
+	return keys, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
@@ -0,0 +1,82 @@
+package blox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+func Test_Encrypted(t *testing.T) {
+	ts, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.cleanup()
+
+	key := bytes.Repeat([]byte("k"), 32)
+	data := bytes.Repeat([]byte("plaintext-content-"), 2000)
+
+	bx := NewBlox(ts.dev)
+	bx.SetChunker(NewFixedChunker(8192))
+
+	if _, err = bx.WriteEncrypted(ioutil.NopCloser(bytes.NewReader(data)), key[:16], 2); err == nil {
+		t.Fatal("should fail with invalid key size")
+	}
+
+	meta, err := bx.WriteEncrypted(ioutil.NopCloser(bytes.NewReader(data)), key, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No plaintext on the raw device
+	ts.rdev.IterIDs(func(id []byte) error {
+		blk, er := ts.rdev.GetBlock(id)
+		if er != nil {
+			t.Fatal(er)
+		}
+		b, _ := ioutil.ReadFile(blk.URI().Path)
+		if bytes.Contains(b, []byte("plaintext-content")) {
+			t.Errorf("plaintext found in block %x", id)
+		}
+		return nil
+	})
+
+	// Convergent encryption deduplicates identical content even with a different
+	// user key
+	other := bytes.Repeat([]byte("o"), 32)
+	meta2, err := bx.WriteEncrypted(ioutil.NopCloser(bytes.NewReader(data)), other, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(meta.Reference(), meta2.Reference()) {
+		t.Fatal("encrypted index should be the same")
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = bx.ReadEncrypted(meta.ID(), buf, key, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data mismatch")
+	}
+
+	if err = bx.ReadEncrypted(meta.ID(), ioutil.Discard, other, 2); err == nil {
+		t.Fatal("should fail with the wrong key")
+	}
+
+	// The encrypted index reads as ciphertext
+	buf.Reset()
+	if err = bx.ReadIndex(meta.Reference(), buf, 2); err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != len(data) || bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("index data should be encrypted")
+	}
+
+	if _, err = ts.dev.GetBlock(meta.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err = bx.ReadEncrypted(meta.Reference(), ioutil.Discard, key, 2); err != errNotEncrypted {
+		t.Fatalf(errCheckStr, errNotEncrypted, err)
+	}
+}
@@ -2,8 +2,8 @@ package device
 
 import (
 	"hash"
-	"io"
 	"io/ioutil"
+	"sync"
 
 	"github.com/hexablock/blox/block"
 	"github.com/hexablock/log"
@@ -54,7 +54,7 @@ type RawDevice interface {
 }
 
 // BlockIndex implements a BlockDevice index containing type and size.
-// IndexBlock and TreeBlock are stored in their entirity only in the index.
+// IndexBlock, TreeBlock and MetaBlock are stored in their entirity only in the index.
 // DataBlock is stored in the index if the size is smaller than
 // maxIndexDataValSize.
 type BlockIndex interface {
@@ -79,6 +79,7 @@ type Stats struct {
 	IndexBlocks  int
 	TreeBlocks   int
 	MetaBlocks   int
+	HAMTBlocks   int
 	TotalBlocks  int
 	BlocksOnDisk int
 	UsedBytes    uint64
@@ -86,8 +87,8 @@ type Stats struct {
 
 // BlockDevice holds and stores the actual blocks.  It contians an underlying block device
 // used primarily to store data blocks.  It maintains an index of all blocks, that includes
-// the type and size of the block indexed by its hash id. Index and Tree blocks are stored
-// in the index/journal.
+// the type and size of the block indexed by its hash id. Index, Tree, Meta and HAMT
+// blocks are stored in the index/journal.
 type BlockDevice struct {
 	// Block index for the underlying RawDevice
 	idx BlockIndex
@@ -98,6 +99,13 @@ type BlockDevice struct {
 	// Called at various phases based on action.  This is user supplied to take
 	// custom actions
 	delegate Delegate
+
+	// Verify block content against the id on read
+	verify bool
+
+	// Garbage collection state.  Nil if disabled
+	gcMu sync.Mutex
+	gc   *gcState
 }
 
 // NewBlockDevice inits a new BlockDevice with the underlying raw BlockDevice.
@@ -114,6 +122,28 @@ func (dev *BlockDevice) SetDelegate(delegate Delegate) {
 	dev.delegate = delegate
 }
 
+// SetVerifyOnRead enables or disables verification of blocks on read.  When
+// enabled GetBlock re-hashes each block and returns block.ErrBlockCorrupt if it
+// does not match the requested id.  Data blocks on the raw device are read in
+// their entirity to do so.  It should be set before the device is used as it is
+// not thread-safe
+func (dev *BlockDevice) SetVerifyOnRead(verify bool) {
+	dev.verify = verify
+}
+
+// SetGCEnabled enables or disables garbage collection.  When enabled the id of
+// each block written is kept in memory until a collection started after the
+// write ends, so that GC does not remove blocks whose writers have yet to
+// reference them.  It should be set before the device is used as it is not
+// thread-safe
+func (dev *BlockDevice) SetGCEnabled(enabled bool) {
+	if !enabled {
+		dev.gc = nil
+	} else if dev.gc == nil {
+		dev.gc = &gcState{written: make(map[string]struct{})}
+	}
+}
+
 // Reindex scans the raw device and adds indexes for earch block not found in
 // the index
 func (dev *BlockDevice) Reindex() {
@@ -146,7 +176,7 @@ func (dev *BlockDevice) Hasher() func() hash.Hash {
 	return dev.raw.Hasher()
 }
 
-// GetBlock returns a block from the volume. Index and tree blocks will be returned in
+// GetBlock returns a block from the volume. Index, tree and meta blocks will be returned in
 // their entirity while a DataBlock will only contain the type and size.  The Reader
 // must be used to access the block contents.
 func (dev *BlockDevice) GetBlock(id []byte) (blk block.Block, err error) {
@@ -156,37 +186,36 @@ func (dev *BlockDevice) GetBlock(id []byte) (blk block.Block, err error) {
 		return nil, err
 	}
 
-	// Initialize a new in-memory block
-	if blk, err = block.New(jent.Type(), nil, dev.raw.Hasher()); err != nil {
+	// Initialize a new in-memory block using the hasher that generated the id
+	if blk, err = block.New(jent.Type(), nil, block.SelectHasher(id, dev.raw.Hasher())); err != nil {
 		return
 	}
 
-	var wr io.WriteCloser
-
 	switch jent.Type() {
 	case block.BlockTypeData:
 		// Get the remainder of the data if there is any.  This would be an inline data block.
 		// only
 		if jent.size < maxIndexDataValSize {
 			// Create block from inline journal data.  It does not contain the size.
-			if wr, err = blk.Writer(); err == nil {
-				defer wr.Close()
-				_, err = wr.Write(jent.data)
-			}
+			err = writeInline(blk, jent.data)
 		} else {
 			blk, err = dev.raw.GetBlock(jent.id)
 		}
 
-	case block.BlockTypeIndex, block.BlockTypeTree:
-		if wr, err = blk.Writer(); err == nil {
-			defer wr.Close()
-			_, err = wr.Write(jent.data)
-		}
+	case block.BlockTypeIndex, block.BlockTypeTree, block.BlockTypeMeta, block.BlockTypeHAMT:
+		err = writeInline(blk, jent.data)
 
 	default:
 		err = block.ErrInvalidBlockType
 	}
 
+	if err == nil && dev.verify {
+		if err = block.VerifyID(blk, id); err != nil {
+			log.Printf("[ERROR] BlockDevice.GetBlock verification failed id=%x error='%v'", id, err)
+			return nil, err
+		}
+	}
+
 	return
 }
 
@@ -198,6 +227,8 @@ func (dev *BlockDevice) BlockExists(id []byte) (bool, error) {
 // SetBlock stores the block in the volume. For DataBlocks the ID is expected to be
 // present.
 func (dev *BlockDevice) SetBlock(blk block.Block) ([]byte, error) {
+	// Keep the block from being collected before it is stored
+	dev.gcWrite(blk.ID())
 
 	typ := blk.Type()
 	jent := &IndexEntry{id: blk.ID(), size: blk.Size(), typ: typ}
@@ -225,14 +256,7 @@ func (dev *BlockDevice) SetBlock(blk block.Block) ([]byte, error) {
 		// use the device returned id
 		jent.id = id
 
-	case block.BlockTypeTree:
-		bd, err := blockReadAll(blk)
-		if err != nil {
-			return nil, err
-		}
-		jent.data = bd
-
-	case block.BlockTypeIndex:
+	case block.BlockTypeIndex, block.BlockTypeTree, block.BlockTypeMeta, block.BlockTypeHAMT:
 		bd, err := blockReadAll(blk)
 		if err != nil {
 			return nil, err
@@ -264,24 +288,27 @@ func (dev *BlockDevice) setIndex(jent *IndexEntry) error {
 
 // RemoveBlock removes a block from the volume as well as journal by the given hash id
 func (dev *BlockDevice) RemoveBlock(id []byte) error {
+	err := dev.removeBlock(id)
+	if err == nil && dev.delegate != nil {
+		// Call delegate
+		dev.delegate.BlockRemove(id)
+	}
+	return err
+}
+
+// removeBlock removes the block from the index and the raw device if it is not
+// inline
+func (dev *BlockDevice) removeBlock(id []byte) error {
 	jent, err := dev.idx.Remove(id)
 	if err == nil {
 		// Inline block
 		switch jent.Type() {
 		case block.BlockTypeData:
-			if jent.size <= maxIndexDataValSize {
-				if dev.delegate != nil {
-					// Call delegate
-					dev.delegate.BlockRemove(id)
-				}
+			if jent.size < maxIndexDataValSize {
 				return nil
 			}
 
-		case block.BlockTypeIndex, block.BlockTypeTree:
-			if dev.delegate != nil {
-				// Call delegate
-				dev.delegate.BlockRemove(id)
-			}
+		case block.BlockTypeIndex, block.BlockTypeTree, block.BlockTypeMeta, block.BlockTypeHAMT:
 			return nil
 		}
 
@@ -294,17 +321,16 @@ func (dev *BlockDevice) RemoveBlock(id []byte) error {
 	// TODO: Defer this to compaction
 	//
 
-	if err = dev.raw.RemoveBlock(id); err == nil && dev.delegate != nil {
-		// Call delegate
-		dev.delegate.BlockRemove(id)
-	}
-
-	return err
+	return dev.raw.RemoveBlock(id)
 }
 
-// Close stops all operations on the device and closes it
+// Close stops all operations on the device and closes it along with the index
 func (dev *BlockDevice) Close() error {
-	return dev.raw.Close()
+	err := dev.raw.Close()
+	if er := dev.idx.Close(); er != nil && err == nil {
+		err = er
+	}
+	return err
 }
 
 // Stats returns stats about the device
@@ -315,6 +341,19 @@ func (dev *BlockDevice) Stats() *Stats {
 	return stats
 }
 
+// writeInline writes the inline index data to the in-memory block
+func writeInline(blk block.Block, data []byte) error {
+	wr, err := blk.Writer()
+	if err != nil {
+		return err
+	}
+	if _, err = wr.Write(data); err != nil {
+		wr.Close()
+		return err
+	}
+	return wr.Close()
+}
+
 func blockReadAll(blk block.Block) ([]byte, error) {
 	rd, err := blk.Reader()
 	if err != nil {
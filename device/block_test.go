@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/json"
+	"io/ioutil"
 	"testing"
 
 	"github.com/hexablock/blox/block"
@@ -181,10 +182,92 @@ func TestBlockDevice(t *testing.T) {
 		t.Fatalf("node count mismatch have=%d want=%d", tb.NodeCount(), tree.NodeCount())
 	}
 
+	// Meta tests
+
+	meta := block.NewMetaBlock(nil, vt.hasher)
+	meta.SetReference(tid)
+	meta.SetMetadata(map[string]string{"name": "tree"})
+	mid, err := vt.dev.SetBlock(meta)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mblk, err := vt.dev.GetBlock(mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(mblk.ID(), mid) != 0 {
+		t.Fatalf("id mismatch want=%x have=%x", mid, mblk.ID())
+	}
+	mb := mblk.(*block.MetaBlock)
+	if bytes.Compare(mb.Reference(), tid) != 0 {
+		t.Fatal("reference mismatch")
+	}
+	if mb.Metadata()["name"] != "tree" {
+		t.Fatal("metadata mismatch")
+	}
+
 	stat := vt.dev.Stats()
 	if stat.UsedBytes == 0 {
 		t.Error("used bytes 0")
 	}
+	if stat.MetaBlocks != 1 {
+		t.Errorf("meta blocks want=1 have=%d", stat.MetaBlocks)
+	}
 	b, _ := json.MarshalIndent(stat, "", " ")
 	t.Logf("%s\n", b)
 }
+
+func TestBlockDevice_verify(t *testing.T) {
+	vt, err := newDevTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vt.cleanup()
+	vt.dev.SetVerifyOnRead(true)
+
+	inline := block.NewMemDataBlock(nil, vt.hasher)
+	wr, _ := inline.Writer()
+	wr.Write(testdata)
+	wr.Close()
+
+	large := vt.raw.NewBlock()
+	wr, _ = large.Writer()
+	wr.Write(bytes.Repeat(testdata, 500))
+	wr.Close()
+
+	idx := block.NewIndexBlock(nil, vt.hasher)
+	idx.SetBlockSize(uint64(len(testdata)))
+	idx.AddBlock(0, inline)
+	idx.Hash()
+
+	for _, blk := range []block.Block{inline, large, idx} {
+		if _, err = vt.dev.SetBlock(blk); err != nil && err != block.ErrBlockExists {
+			t.Fatal(err)
+		}
+		if _, err = vt.dev.GetBlock(blk.ID()); err != nil {
+			t.Fatalf("%s %v", blk.Type(), err)
+		}
+	}
+
+	// Corrupt inline and on disk data
+	ent, _ := vt.dev.idx.Get(inline.ID())
+	ent.data = append([]byte{}, ent.data...)
+	ent.data[0] ^= 0xff
+	if _, err = vt.dev.GetBlock(inline.ID()); err != block.ErrBlockCorrupt {
+		t.Fatal("should fail with", block.ErrBlockCorrupt, err)
+	}
+
+	if err = ioutil.WriteFile(large.URI().Path, []byte{byte(block.BlockTypeData), 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = vt.dev.GetBlock(large.ID()); err != block.ErrBlockCorrupt {
+		t.Fatal("should fail with", block.ErrBlockCorrupt, err)
+	}
+
+	// Verification is off by default
+	vt.dev.SetVerifyOnRead(false)
+	if _, err = vt.dev.GetBlock(large.ID()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,257 @@
+package device
+
+import (
+	"encoding/hex"
+	"errors"
+
+	"github.com/hexablock/blox/block"
+	"github.com/hexablock/log"
+)
+
+var (
+	errGCRunning  = errors.New("garbage collection already running")
+	errGCDisabled = errors.New("garbage collection disabled")
+)
+
+// GCReport is the result of a garbage collection
+type GCReport struct {
+	// True if no blocks were removed
+	DryRun bool
+	// Blocks reachable from the roots
+	Reachable int
+	// Referenced blocks not found on the device
+	Missing int
+	// Unreachable blocks and their total size.  In a dry run these are the blocks
+	// that would be removed
+	Unreachable      int
+	UnreachableBytes uint64
+	// Unreachable blocks kept as they were written since the previous collection
+	// started
+	Skipped int
+}
+
+// gcState tracks the blocks written for garbage collection.  Blocks are tracked
+// over two generations so a block written just before a collection starts is
+// kept until the one after.
+type gcState struct {
+	// Set while a collection is running
+	running bool
+	// Ids written since the running or last collection started
+	written map[string]struct{}
+	// Ids written between the previous and the running collection
+	prev map[string]struct{}
+}
+
+// gcWrite records the id as written if garbage collection is enabled.  It is
+// called before the block is stored so an in-flight write is always tracked.
+func (dev *BlockDevice) gcWrite(id []byte) {
+	if dev.gc == nil || len(id) == 0 {
+		return
+	}
+	dev.gcMu.Lock()
+	dev.gc.written[string(id)] = struct{}{}
+	dev.gcMu.Unlock()
+}
+
+// GC removes all blocks that are not reachable from the root ids.  Index, tree,
+// HAMT and meta blocks are walked to mark the blocks they reference, including
+// data blocks whose hex id is a meta value.  All unmarked blocks in the index and
+// on the raw device are then removed.  In a dry run nothing is removed and only
+// the report is returned.
+//
+// Blocks written with SetBlock, including ones that already exist, since the
+// previous collection started are never removed.  A writer such as a sharder
+// whose blocks are only referenced once it finishes is safe as long as it
+// finishes, and its root is included, before the next collection starts.  Blocks
+// no longer reachable from the roots must not be referenced by new writes without
+// writing them again.  It returns an error if garbage collection is not enabled.
+func (dev *BlockDevice) GC(roots [][]byte, dryRun bool) (*GCReport, error) {
+	if dev.gc == nil {
+		return nil, errGCDisabled
+	}
+
+	dev.gcMu.Lock()
+	if dev.gc.running {
+		dev.gcMu.Unlock()
+		return nil, errGCRunning
+	}
+	dev.gc.running = true
+	dev.gc.prev = dev.gc.written
+	dev.gc.written = make(map[string]struct{})
+	dev.gcMu.Unlock()
+
+	defer func() {
+		dev.gcMu.Lock()
+		dev.gc.running = false
+		dev.gc.prev = nil
+		dev.gcMu.Unlock()
+	}()
+
+	report := &GCReport{DryRun: dryRun}
+	marked := make(map[string]struct{})
+	for _, id := range roots {
+		if err := dev.mark(id, marked, report); err != nil {
+			return nil, err
+		}
+	}
+	report.Reachable = len(marked)
+
+	// Collect the candidates first so the index is not locked while removing
+	sizes := make(map[string]uint64)
+	err := dev.idx.Iter(func(ent *IndexEntry) error {
+		if _, ok := marked[string(ent.id)]; !ok {
+			sizes[string(ent.id)] = ent.size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Data blocks on the raw device missing from the index
+	err = dev.raw.IterIDs(func(id []byte) error {
+		k := string(id)
+		if _, ok := marked[k]; ok {
+			return nil
+		}
+		if _, ok := sizes[k]; ok || dev.idx.Exists(id) {
+			return nil
+		}
+		blk, err := dev.raw.GetBlock(id)
+		if err == nil {
+			sizes[k] = blk.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for k, size := range sizes {
+		id := []byte(k)
+		removed, err := dev.sweep(id, dryRun)
+		if err != nil {
+			return nil, err
+		}
+		if !removed {
+			report.Skipped++
+			continue
+		}
+		report.Unreachable++
+		report.UnreachableBytes += size
+
+		if !dryRun && dev.delegate != nil {
+			dev.delegate.BlockRemove(id)
+		}
+	}
+
+	log.Printf("[INFO] BlockDevice.GC dry-run=%v reachable=%d missing=%d unreachable=%d bytes=%d skipped=%d",
+		dryRun, report.Reachable, report.Missing, report.Unreachable, report.UnreachableBytes, report.Skipped)
+
+	return report, nil
+}
+
+// sweep removes the unreachable block unless it was written since the previous
+// collection started.  The lock is held so a concurrent write of the block either
+// marks it before it is checked or writes it again after it is removed.  It
+// returns false if the block was kept.
+func (dev *BlockDevice) sweep(id []byte, dryRun bool) (bool, error) {
+	dev.gcMu.Lock()
+	defer dev.gcMu.Unlock()
+
+	if _, ok := dev.gc.prev[string(id)]; ok {
+		return false, nil
+	}
+	if _, ok := dev.gc.written[string(id)]; ok {
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+
+	err := dev.removeBlock(id)
+	if err == block.ErrBlockNotFound {
+		// Removed in the meantime
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// mark marks the block and all blocks it references as reachable
+func (dev *BlockDevice) mark(id []byte, marked map[string]struct{}, report *GCReport) error {
+	if len(id) == 0 {
+		return nil
+	}
+	if _, ok := marked[string(id)]; ok {
+		return nil
+	}
+
+	ent, err := dev.idx.Get(id)
+	if err == block.ErrBlockNotFound {
+		// Blocks only on the raw device are swept as well so they must be marked.
+		// They are always data blocks.
+		if !dev.raw.Exists(id) {
+			report.Missing++
+			return nil
+		}
+		marked[string(id)] = struct{}{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	marked[string(id)] = struct{}{}
+
+	// Data blocks do not reference other blocks
+	if ent.Type() == block.BlockTypeData {
+		return nil
+	}
+
+	blk, err := dev.GetBlock(id)
+	if err != nil {
+		return err
+	}
+
+	switch b := blk.(type) {
+	case *block.IndexBlock:
+		return b.IterEntries(func(index, offset, size uint64, id []byte) error {
+			return dev.mark(id, marked, report)
+		})
+
+	case *block.TreeBlock:
+		return b.Iter(func(node *block.TreeNode) error {
+			return dev.mark(node.Address, marked, report)
+		})
+
+	case *block.HAMTBlock:
+		return b.IterSlots(func(i int, slot *block.HAMTSlot) error {
+			if err := dev.mark(slot.Child, marked, report); err != nil {
+				return err
+			}
+			for _, node := range slot.Nodes {
+				if err := dev.mark(node.Address, marked, report); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+	case *block.MetaBlock:
+		if err = dev.mark(b.Reference(), marked, report); err != nil {
+			return err
+		}
+		// Values holding the hex id of a block as done by the Rehasher
+		for _, k := range b.Keys() {
+			v, ok := b.GetString(k)
+			if !ok {
+				continue
+			}
+			if ref, err := hex.DecodeString(v); err == nil && len(ref) > 0 && (dev.idx.Exists(ref) || dev.raw.Exists(ref)) {
+				if err = dev.mark(ref, marked, report); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,229 @@
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+type gcDelegate struct {
+	dev     *BlockDevice
+	blks    []block.Block
+	removed int
+}
+
+func (d *gcDelegate) BlockSet(ent IndexEntry) {}
+
+func (d *gcDelegate) BlockRemove(id []byte) {
+	d.removed++
+	if d.removed == 1 {
+		// Written while the sweep is running
+		for _, blk := range d.blks {
+			d.dev.SetBlock(blk)
+		}
+	}
+}
+
+func newTestDataBlock(vt *devTester, data []byte) block.Block {
+	blk := block.NewMemDataBlock(nil, vt.hasher)
+	wr, _ := blk.Writer()
+	wr.Write(data)
+	wr.Close()
+	return blk
+}
+
+func Test_BlockDevice_GC(t *testing.T) {
+	vt, err := newDevTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vt.cleanup()
+
+	if _, err = vt.dev.GC(nil, true); err != errGCDisabled {
+		t.Fatal("should be disabled", err)
+	}
+	vt.dev.SetGCEnabled(true)
+
+	d1 := newTestDataBlock(vt, testdata)
+	d2 := newTestDataBlock(vt, bytes.Repeat(testdata, 500))
+	d3 := newTestDataBlock(vt, bytes.Repeat([]byte("unreachable"), 1000))
+	d4 := newTestDataBlock(vt, []byte("unreachable small"))
+	d5 := newTestDataBlock(vt, []byte("thumbnail"))
+	sym := newTestDataBlock(vt, []byte("target"))
+
+	idx := block.NewIndexBlock(nil, vt.hasher)
+	idx.SetBlockSize(uint64(d2.Size()))
+	idx.IndexBlock(0, d1.ID(), d1.Size())
+	idx.IndexBlock(1, d2.ID(), d2.Size())
+	idx.Hash()
+
+	idx3 := block.NewIndexBlock(nil, vt.hasher)
+	idx3.SetBlockSize(d3.Size())
+	idx3.IndexBlock(0, d3.ID(), d3.Size())
+	idx3.Hash()
+
+	tree := block.NewTreeBlock(nil, vt.hasher)
+	tree.AddNodes(
+		block.NewFileTreeNode("file", idx.ID()),
+		block.NewSymlinkTreeNode("link", sym.ID()),
+	)
+
+	child := block.NewHAMTBlock(nil, vt.hasher)
+	child.SetDepth(1)
+	child.SetCount(1)
+	child.SetSlot(block.HAMTSlotIndex("x", 1), &block.HAMTSlot{
+		Nodes: []*block.TreeNode{block.NewDirTreeNode("x", tree.ID())},
+	})
+	child.Hash()
+
+	root := block.NewHAMTBlock(nil, vt.hasher)
+	root.SetCount(1)
+	root.SetSlot(block.HAMTSlotIndex("x", 0), &block.HAMTSlot{Child: child.ID()})
+	root.Hash()
+
+	meta := block.NewMetaBlock(nil, vt.hasher)
+	meta.SetReference(root.ID())
+	meta.SetString("thumb", hex.EncodeToString(d5.ID()))
+
+	reachable := []block.Block{d1, d2, d5, sym, idx, tree, child, root, meta}
+	unreachable := []block.Block{d3, d4, idx3}
+	for _, blk := range append(reachable, unreachable...) {
+		if _, err = vt.dev.SetBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Orphan on the raw device only
+	orphan := vt.raw.NewBlock()
+	wr, _ := orphan.Writer()
+	wr.Write(bytes.Repeat([]byte("orphan"), 1000))
+	if err = wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	unreachable = append(unreachable, orphan)
+
+	var size uint64
+	for _, blk := range unreachable {
+		size += blk.Size()
+	}
+
+	roots := [][]byte{meta.ID(), []byte("missing")}
+
+	// Blocks written since the previous collection are kept
+	report, err := vt.dev.GC(roots, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Unreachable != 1 || report.Skipped != len(unreachable)-1 {
+		t.Fatalf("written blocks not kept %+v", report)
+	}
+
+	report, err = vt.dev.GC(roots, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Reachable != len(reachable) || report.Missing != 1 {
+		t.Fatalf("wrong mark %+v", report)
+	}
+	if report.Unreachable != len(unreachable) || report.UnreachableBytes != size {
+		t.Fatalf("wrong sweep %+v want %d", report, size)
+	}
+	for _, blk := range unreachable {
+		if !vt.dev.idx.Exists(blk.ID()) && !vt.raw.Exists(blk.ID()) {
+			t.Fatal("removed in dry run", blk.Type())
+		}
+	}
+
+	report, err = vt.dev.GC(roots, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.DryRun || report.Unreachable != len(unreachable) {
+		t.Fatalf("wrong sweep %+v", report)
+	}
+	for _, blk := range unreachable {
+		if vt.dev.idx.Exists(blk.ID()) || vt.raw.Exists(blk.ID()) {
+			t.Fatal("unreachable block exists", blk.Type())
+		}
+	}
+	for _, blk := range reachable {
+		if _, err = vt.dev.GetBlock(blk.ID()); err != nil {
+			t.Fatal(blk.Type(), err)
+		}
+	}
+
+	// Unreachable blocks collected once they are old enough
+	for _, blk := range []block.Block{d4, idx3} {
+		if _, err = vt.dev.SetBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if report, err = vt.dev.GC(roots, false); err != nil || report.Skipped != 2 {
+		t.Fatalf("written blocks not kept %+v %v", report, err)
+	}
+
+	// File whose data is written before the collection starts and whose index is
+	// written while it sweeps
+	f1 := newTestDataBlock(vt, bytes.Repeat([]byte("file data"), 1000))
+	f2 := newTestDataBlock(vt, []byte("file tail"))
+	for _, blk := range []block.Block{f1, f2} {
+		if _, err = vt.dev.SetBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fidx := block.NewIndexBlock(nil, vt.hasher)
+	fidx.SetBlockSize(f1.Size())
+	fidx.IndexBlock(0, f1.ID(), f1.Size())
+	fidx.IndexBlock(1, f2.ID(), f2.Size())
+	fidx.Hash()
+
+	vt.dev.SetDelegate(&gcDelegate{dev: vt.dev, blks: []block.Block{d4, fidx}})
+	if report, err = vt.dev.GC(roots, false); err != nil {
+		t.Fatal(err)
+	}
+	// Depending on the sweep order d4 is either kept or written again
+	if report.Unreachable < 1 || report.Unreachable+report.Skipped != 4 {
+		t.Fatalf("wrong sweep %+v", report)
+	}
+	for _, blk := range []block.Block{d4, f1, f2, fidx} {
+		if _, err = vt.dev.GetBlock(blk.ID()); err != nil {
+			t.Fatal("written block removed", blk.Type(), err)
+		}
+	}
+
+	// The file is kept once referenced by a root
+	if report, err = vt.dev.GC(append(roots, fidx.ID()), false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Reachable != len(reachable)+3 {
+		t.Fatalf("file not reachable %+v", report)
+	}
+	for _, blk := range []block.Block{f1, f2, fidx} {
+		if _, err = vt.dev.GetBlock(blk.ID()); err != nil {
+			t.Fatal("reachable block removed", blk.Type(), err)
+		}
+	}
+
+	// Referenced block on the raw device only
+	rawOnly := vt.raw.NewBlock()
+	wr, _ = rawOnly.Writer()
+	wr.Write(bytes.Repeat([]byte("raw only"), 1000))
+	if err = wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ridx := block.NewIndexBlock(nil, vt.hasher)
+	ridx.SetBlockSize(rawOnly.Size())
+	ridx.IndexBlock(0, rawOnly.ID(), rawOnly.Size())
+	ridx.Hash()
+	if _, err = vt.dev.SetBlock(ridx); err != nil {
+		t.Fatal(err)
+	}
+	if report, err = vt.dev.GC(append(roots, ridx.ID()), false); err != nil {
+		t.Fatal(err)
+	}
+	if report.Missing != 1 || !vt.raw.Exists(rawOnly.ID()) {
+		t.Fatalf("raw only block removed %+v", report)
+	}
+}
@@ -4,13 +4,29 @@ import (
 	"bytes"
 	"encoding/binary"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash/crc32"
+	"math"
 	"sync"
 
 	"github.com/hexablock/blox/block"
 )
 
-// TODO: FIX IndexEntry serialization as it is not consistent
+const (
+	indexEntryV2 byte = 2
+
+	// indexEntryHeaderSize is the size of the fixed v2 header
+	indexEntryHeaderSize = 20
+)
+
+var (
+	// crc32c table used for index entries and journal records
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+	errEntryTruncated = errors.New("index entry truncated")
+	errEntryCorrupt   = errors.New("index entry corrupt")
+)
 
 // IndexEntry represents a single entry for a block
 type IndexEntry struct {
@@ -20,61 +36,104 @@ type IndexEntry struct {
 	data []byte
 }
 
-// MarshalBinary marshals the entry into a 1-8-hash-null-data - type, size, id,
-// followed by a null byte then the data
+// MarshalBinary marshals the entry into the v2 format.  It is a fixed 20-byte
+// header of a zero byte marker, 1-byte version, 1-byte type, 1-byte id length,
+// 8-byte size, 4-byte data length and the 4-byte crc32c of the header fields and
+// payload, all big-endian, followed by the payload i.e. the id then the data.
 func (je *IndexEntry) MarshalBinary() ([]byte, error) {
-	buf := make([]byte, 9)
-	buf[0] = byte(je.typ)
-	binary.BigEndian.PutUint64(buf[1:], je.size)
+	if len(je.id) == 0 || len(je.id) > math.MaxUint8 || uint64(len(je.data)) > math.MaxUint32 {
+		return nil, errEntryCorrupt
+	}
 
-	hexid := hex.EncodeToString(je.id)
-	hexid += "|"
-	buf = append(buf, []byte(hexid)...)
-	//buf = append(buf, je.id...)
-	// append marker
-	//buf = append(buf, byte('|'), byte(';'))
-	//buf = append(buf, '\x00')
-	return append(buf, je.data...), nil
+	buf := make([]byte, indexEntryHeaderSize, indexEntryHeaderSize+len(je.id)+len(je.data))
+	buf[1] = indexEntryV2
+	buf[2] = byte(je.typ)
+	buf[3] = byte(len(je.id))
+	binary.BigEndian.PutUint64(buf[4:], je.size)
+	binary.BigEndian.PutUint32(buf[12:], uint32(len(je.data)))
+	buf = append(buf, je.id...)
+	buf = append(buf, je.data...)
+
+	binary.BigEndian.PutUint32(buf[16:], entryChecksum(buf))
+	return buf, nil
 }
 
 // UnmarshalBinary unmarshals a byte slice into an IndexEntry.  It returns an
-// error if there is not enough data
+// error if the data is truncated or does not match the checksum.  Entries in the
+// legacy format are also accepted.
 func (je *IndexEntry) UnmarshalBinary(b []byte) error {
-	// Min sha1 check
-	if len(b) < 29 {
-		return fmt.Errorf("not enough data")
+	if len(b) > 0 && b[0] != 0 {
+		return je.unmarshalLegacy(b)
 	}
-	je.typ = block.BlockType(b[0])
-	je.size = binary.BigEndian.Uint64(b[1:9])
 
-	i := bytes.Index(b[9:], []byte("|"))
+	if len(b) < indexEntryHeaderSize {
+		return errEntryTruncated
+	}
+	if b[1] != indexEntryV2 {
+		return fmt.Errorf("unsupported index entry version: %d", b[1])
+	}
+
+	idlen := int(b[3])
+	dlen := uint64(binary.BigEndian.Uint32(b[12:]))
+	if n := uint64(indexEntryHeaderSize+idlen) + dlen; uint64(len(b)) < n {
+		return errEntryTruncated
+	} else if uint64(len(b)) > n || idlen == 0 {
+		return errEntryCorrupt
+	}
+	if binary.BigEndian.Uint32(b[16:]) != entryChecksum(b) {
+		return errEntryCorrupt
+	}
+
+	payload := b[indexEntryHeaderSize:]
+	je.typ = block.BlockType(b[2])
+	je.size = binary.BigEndian.Uint64(b[4:])
+	je.id = append([]byte{}, payload[:idlen]...)
+	je.data = nil
+	if dlen > 0 {
+		je.data = append([]byte{}, payload[idlen:]...)
+	}
+	return nil
+}
+
+// unmarshalLegacy unmarshals the original format of the 1-byte type, 8-byte size,
+// hex encoded id and a | delimiter followed by the data
+func (je *IndexEntry) unmarshalLegacy(b []byte) error {
+	if len(b) < 12 {
+		return errEntryTruncated
+	}
 
-	//i := bytes.IndexByte(b[9:], '\x00')
-	if i < 0 {
+	i := bytes.IndexByte(b[9:], '|')
+	if i < 1 {
 		return fmt.Errorf("id not found")
 	}
 	i += 9
-	//log.Println(string(b[9:i]), len(b[9:i]))
 
-	var err error
-	if je.id, err = hex.DecodeString(string(b[9:i])); err != nil {
+	id, err := hex.DecodeString(string(b[9:i]))
+	if err != nil {
 		return err
 	}
 
-	//je.id = make([]byte, i)
-	//i += 9
-	//copy(je.id, b[9:i])
+	je.typ = block.BlockType(b[0])
+	je.size = binary.BigEndian.Uint64(b[1:9])
+	je.id = id
+	je.data = nil
 
 	// marker increment
 	i++
-	l := len(b[i:])
-	if l > 0 {
+	if l := len(b[i:]); l > 0 {
 		je.data = make([]byte, l)
 		copy(je.data, b[i:])
 	}
 	return nil
 }
 
+// entryChecksum returns the crc32c of the marshalled entry excluding the checksum
+// itself
+func entryChecksum(b []byte) uint32 {
+	crc := crc32.Checksum(b[:16], crcTable)
+	return crc32.Update(crc, crcTable, b[indexEntryHeaderSize:])
+}
+
 // ID returns the id for the entry
 func (je *IndexEntry) ID() []byte {
 	return je.id
@@ -130,6 +189,8 @@ func (j *InmemIndex) Stats() *Stats {
 			stat.TreeBlocks++
 		case block.BlockTypeMeta:
 			stat.MetaBlocks++
+		case block.BlockTypeHAMT:
+			stat.HAMTBlocks++
 		}
 	}
 
@@ -41,3 +41,56 @@ func Test_IndexEntry(t *testing.T) {
 		t.Fatal("should fail")
 	}
 }
+
+func Test_IndexEntry_checksum(t *testing.T) {
+	// Short ids are supported
+	ie := &IndexEntry{id: []byte{1, 2, 3, 4}, typ: block.BlockTypeTree, size: 3, data: []byte("abc")}
+	b, err := ie.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out IndexEntry
+	if err = out.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.ID(), ie.ID()) || !bytes.Equal(out.Data(), ie.Data()) || out.Type() != ie.Type() {
+		t.Fatal("entry mismatch")
+	}
+
+	for i := range b {
+		if err = out.UnmarshalBinary(b[:i]); err == nil {
+			t.Fatal("truncated entry should fail", i)
+		}
+
+		c := append([]byte{}, b...)
+		c[i] ^= 0x10
+		if err = out.UnmarshalBinary(c); err == nil {
+			t.Fatal("corrupt entry should fail", i)
+		}
+	}
+}
+
+func Test_IndexEntry_legacy(t *testing.T) {
+	// type, size, hex id, delimiter and data
+	b := []byte{byte(block.BlockTypeData), 0, 0, 0, 0, 0, 0, 0, 5}
+	b = append(b, []byte("0a0b0c|he|lo")...)
+
+	var out IndexEntry
+	if err := out.UnmarshalBinary(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.ID(), []byte{10, 11, 12}) || string(out.Data()) != "he|lo" ||
+		out.Size() != 5 || out.Type() != block.BlockTypeData {
+		t.Fatal("entry mismatch")
+	}
+
+	// Upgraded on marshal
+	nb, err := out.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nb[0] != 0 || nb[1] != indexEntryV2 {
+		t.Fatal("not upgraded")
+	}
+}
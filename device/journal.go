@@ -0,0 +1,603 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hexablock/blox/block"
+	"github.com/hexablock/log"
+)
+
+const (
+	journalFile  = "index.journal"
+	snapshotFile = "index.snapshot"
+
+	// Journal record operations
+	journalOpSet    byte = 1
+	journalOpRemove byte = 2
+
+	// maxJournalPayload is the largest record payload.  An invalid record is only
+	// treated as a torn write if it starts within the largest record of the end
+	// of the journal.
+	maxJournalPayload = 16 << 20
+)
+
+var (
+	// journalMagic is the header of the journal and snapshot files
+	journalMagic = []byte("bloxidx\x01")
+
+	errJournalCorrupt = errors.New("journal corrupt")
+	// errJournalTorn is returned for an incomplete or corrupt last record
+	errJournalTorn    = errors.New("journal torn")
+	errJournalFailed  = errors.New("journal failed")
+	errRecordTooLarge = errors.New("journal record too large")
+)
+
+// SyncPolicy determines when journal writes are synced to stable storage
+type SyncPolicy uint8
+
+const (
+	// SyncAlways syncs the journal after every write.  A write is durable once it
+	// returns
+	SyncAlways SyncPolicy = iota
+	// SyncInterval syncs the journal periodically.  Writes since the last sync may
+	// be lost if the machine crashes
+	SyncInterval
+	// SyncNever leaves syncing to the operating system
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncAlways:
+		return "always"
+	case SyncInterval:
+		return "interval"
+	case SyncNever:
+		return "never"
+	}
+	return "unknown"
+}
+
+// JournalIndexOptions are options available when using the JournalIndex
+type JournalIndexOptions struct {
+	// When to sync the journal
+	Sync SyncPolicy
+	// Interval between syncs with SyncInterval
+	SyncInterval time.Duration
+	// Journal records after which the index is compacted into a new snapshot.  The
+	// journal is only compacted once it also has more records than the index has
+	// entries.  Less than 1 disables automatic compaction
+	CompactRecords int
+}
+
+// DefaultJournalIndexOptions returns a set of sane defaults syncing every write
+func DefaultJournalIndexOptions() JournalIndexOptions {
+	return JournalIndexOptions{
+		Sync:           SyncAlways,
+		SyncInterval:   time.Second,
+		CompactRecords: 100000,
+	}
+}
+
+// JournalIndex implements a persistent BlockIndex.  All entries are held in memory
+// and each change is appended to a journal file on disk as a checksummed record
+// which is replayed when the index is opened.  The journal is periodically
+// compacted into a snapshot of all entries.  A record is the 1-byte operation,
+// uvarint length and payload followed by the big-endian crc32c of all three.  The
+// payload of a set is the marshalled IndexEntry and that of a remove is the id.
+// An incomplete or corrupt record at the end of the journal, as left by a crash
+// while writing, is discarded on open.  A corrupt record followed by others fails
+// the open rather than discarding the records after it.  A record that fails to
+// be written is truncated from the journal.  If that fails too all further writes
+// are refused.
+type JournalIndex struct {
+	dir string
+	opt JournalIndexOptions
+
+	// Serializes journal writes with the in-memory changes
+	mu  sync.Mutex
+	mem *InmemIndex
+
+	journal journalWriter
+	// Offset after the last complete record in the journal
+	size int64
+	// Records in the journal
+	records int
+	// Set if a failed write could not be undone
+	failed error
+	// Unsynced writes with SyncInterval
+	dirty bool
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// journalWriter is the journal file being appended to
+type journalWriter interface {
+	io.WriteCloser
+	Sync() error
+	Truncate(size int64) error
+}
+
+// NewJournalIndex opens the journal index in the directory creating it if it does
+// not exist.  The snapshot and journal are replayed to load all entries.
+func NewJournalIndex(dir string, opt JournalIndexOptions) (*JournalIndex, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &JournalIndex{
+		dir:  dir,
+		opt:  opt,
+		mem:  NewInmemIndex(),
+		stop: make(chan struct{}),
+	}
+
+	if err := j.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	if err := j.openJournal(); err != nil {
+		return nil, err
+	}
+
+	if opt.Sync == SyncInterval && opt.SyncInterval > 0 {
+		j.wg.Add(1)
+		go j.syncLoop()
+	}
+
+	return j, nil
+}
+
+// Stats returns index stats
+func (j *JournalIndex) Stats() *Stats {
+	return j.mem.Stats()
+}
+
+// Get retreives the value for the given id.  It returns a ErrNotFoundError if the
+// id is not found
+func (j *JournalIndex) Get(id []byte) (*IndexEntry, error) {
+	return j.mem.Get(id)
+}
+
+// Exists returns true if the index contains the id
+func (j *JournalIndex) Exists(id []byte) bool {
+	return j.mem.Exists(id)
+}
+
+// Iter iterates over each entry issuing the callback for each
+func (j *JournalIndex) Iter(cb func(*IndexEntry) error) error {
+	return j.mem.Iter(cb)
+}
+
+// Set journals the entry and adds it to the index.  It returns an error if the
+// block exists.
+func (j *JournalIndex) Set(entry *IndexEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.mem.Exists(entry.id) {
+		return block.ErrBlockExists
+	}
+
+	b, err := entry.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	if err = j.append(journalOpSet, b); err != nil {
+		return err
+	}
+
+	j.mem.Set(entry)
+	j.maybeCompact()
+	return nil
+}
+
+// Remove journals the removal and removes the entry from the index returning it.
+// It returns an error if the id doesn't exist
+func (j *JournalIndex) Remove(id []byte) (*IndexEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if !j.mem.Exists(id) {
+		return nil, block.ErrBlockNotFound
+	}
+	if err := j.append(journalOpRemove, id); err != nil {
+		return nil, err
+	}
+
+	entry, err := j.mem.Remove(id)
+	if err == nil {
+		j.maybeCompact()
+	}
+	return entry, err
+}
+
+// Sync syncs the journal to stable storage
+func (j *JournalIndex) Sync() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.dirty = false
+	return j.journal.Sync()
+}
+
+// Compact writes a snapshot of all entries and truncates the journal
+func (j *JournalIndex) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.compact()
+}
+
+// Close syncs and closes the journal
+func (j *JournalIndex) Close() error {
+	close(j.stop)
+	j.wg.Wait()
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	err := j.journal.Sync()
+	if er := j.journal.Close(); er != nil && err == nil {
+		err = er
+	}
+	return err
+}
+
+// append writes a record to the journal syncing it as per the policy.  On failure
+// the record is truncated so later records are not written after a partial one.
+// If the record cannot be removed, or the sync failed in which case the state of
+// earlier records is unknown, the journal is marked failed.
+func (j *JournalIndex) append(op byte, payload []byte) error {
+	if j.failed != nil {
+		return j.failed
+	}
+	if len(payload) > maxJournalPayload {
+		return errRecordTooLarge
+	}
+
+	rec := encodeRecord(op, payload)
+	_, err := j.journal.Write(rec)
+	if err == nil && j.opt.Sync == SyncAlways {
+		if err = j.journal.Sync(); err != nil {
+			j.failed = errJournalFailed
+		}
+	}
+	if err != nil {
+		if er := j.journal.Truncate(j.size); er != nil {
+			j.failed = errJournalFailed
+		}
+		if j.failed != nil {
+			log.Printf("[ERROR] JournalIndex refusing writes offset=%d error='%v'", j.size, err)
+		}
+		return err
+	}
+
+	j.size += int64(len(rec))
+	j.records++
+	if j.opt.Sync == SyncInterval {
+		j.dirty = true
+	}
+	return nil
+}
+
+// maybeCompact compacts the journal once it has grown enough.  The change has
+// already been journaled so a failure is only logged.
+func (j *JournalIndex) maybeCompact() {
+	n := j.opt.CompactRecords
+	if n < 1 || j.records < n || j.records <= len(j.mem.m) {
+		return
+	}
+	if err := j.compact(); err != nil {
+		log.Printf("[ERROR] JournalIndex compaction failed error='%v'", err)
+	}
+}
+
+// compact atomically replaces the snapshot then starts a new journal.  If the
+// journal is not reset the old records are replayed on top of the new snapshot
+// on open, which results in the same entries.
+func (j *JournalIndex) compact() error {
+	// Sorted for a deterministic snapshot
+	entries := make([]*IndexEntry, 0, len(j.mem.m))
+	j.mem.Iter(func(entry *IndexEntry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	sort.Slice(entries, func(a, b int) bool {
+		return bytes.Compare(entries[a].id, entries[b].id) < 0
+	})
+
+	err := j.writeFile(snapshotFile, func(w io.Writer) error {
+		for _, entry := range entries {
+			b, err := entry.MarshalBinary()
+			if err != nil {
+				return err
+			}
+			if _, err = w.Write(encodeRecord(journalOpSet, b)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = j.writeFile(journalFile, func(io.Writer) error { return nil }); err != nil {
+		return err
+	}
+
+	// The old journal has been replaced so it is kept open only to be closed
+	fh, err := os.OpenFile(filepath.Join(j.dir, journalFile), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		j.failed = errJournalFailed
+		return err
+	}
+	j.journal.Close()
+	j.journal = fh
+	j.size = int64(len(journalMagic))
+	j.records = 0
+	j.dirty = false
+	return nil
+}
+
+// writeFile atomically writes the file in the directory with the journal header
+// followed by the data written by the callback
+func (j *JournalIndex) writeFile(name string, f func(io.Writer) error) error {
+	p := filepath.Join(j.dir, name)
+	tmp := p + ".tmp"
+
+	fh, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(fh)
+	if _, err = w.Write(journalMagic); err == nil {
+		if err = f(w); err == nil {
+			if err = w.Flush(); err == nil {
+				err = fh.Sync()
+			}
+		}
+	}
+	if er := fh.Close(); er != nil && err == nil {
+		err = er
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err = os.Rename(tmp, p); err != nil {
+		return err
+	}
+	return syncDir(j.dir)
+}
+
+// loadSnapshot loads all entries from the snapshot if there is one.  As snapshots
+// are written atomically any error is returned.
+func (j *JournalIndex) loadSnapshot() error {
+	fh, err := os.Open(filepath.Join(j.dir, snapshotFile))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer fh.Close()
+
+	n, err := j.replay(fh)
+	// Only journal records are counted
+	j.records = 0
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = fh.Stat(); err == nil && n != fi.Size() {
+			err = errJournalCorrupt
+		}
+	}
+	if err != nil {
+		return errors.New("index snapshot: " + err.Error())
+	}
+	return nil
+}
+
+// openJournal replays the journal and opens it for appending.  A new journal is
+// created if it does not exist.  An incomplete or corrupt last record is
+// truncated.  Any other corruption is returned as an error.  The journal is opened
+// in append mode so writes follow a truncation.
+func (j *JournalIndex) openJournal() error {
+	p := filepath.Join(j.dir, journalFile)
+
+	fh, err := os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
+	if os.IsNotExist(err) {
+		if err = j.writeFile(journalFile, func(io.Writer) error { return nil }); err != nil {
+			return err
+		}
+		fh, err = os.OpenFile(p, os.O_RDWR|os.O_APPEND, 0644)
+	}
+	if err != nil {
+		return err
+	}
+
+	fi, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	n, err := j.replay(fh)
+	switch err {
+	case errJournalTorn:
+		log.Printf("[WARN] JournalIndex discarding invalid journal tail offset=%d size=%d", n, fi.Size())
+		if err = fh.Truncate(n); err == nil {
+			err = fh.Sync()
+		}
+	case errJournalCorrupt:
+		err = fmt.Errorf("index journal: %v at offset %d", err, n)
+	}
+	if err != nil {
+		fh.Close()
+		return err
+	}
+
+	j.journal = fh
+	j.size = n
+	return nil
+}
+
+// replay applies the records read from the file.  It returns the offset after the
+// last valid record, errJournalTorn if the last record is invalid and
+// errJournalCorrupt if any other record is invalid
+func (j *JournalIndex) replay(fh *os.File) (int64, error) {
+	fi, err := fh.Stat()
+	if err != nil {
+		return 0, err
+	}
+	size := fi.Size()
+
+	rd := bufio.NewReader(fh)
+	magic := make([]byte, len(journalMagic))
+	if _, err = io.ReadFull(rd, magic); err != nil || !bytes.Equal(magic, journalMagic) {
+		return 0, errJournalCorrupt
+	}
+
+	offset := int64(len(magic))
+	for offset < size {
+		op, payload, n, err := readRecord(rd, size-offset)
+		if err != nil {
+			return offset, err
+		}
+
+		switch op {
+		case journalOpSet:
+			entry := &IndexEntry{}
+			if err = entry.UnmarshalBinary(payload); err != nil {
+				return offset, errJournalCorrupt
+			}
+			j.mem.Remove(entry.id)
+			j.mem.Set(entry)
+
+		case journalOpRemove:
+			j.mem.Remove(payload)
+
+		default:
+			return offset, errJournalCorrupt
+		}
+
+		offset += n
+		j.records++
+	}
+
+	return offset, nil
+}
+
+func (j *JournalIndex) syncLoop() {
+	defer j.wg.Done()
+
+	ticker := time.NewTicker(j.opt.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			j.mu.Lock()
+			if j.dirty {
+				if err := j.journal.Sync(); err != nil {
+					log.Printf("[ERROR] JournalIndex sync failed error='%v'", err)
+				} else {
+					j.dirty = false
+				}
+			}
+			j.mu.Unlock()
+
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+func encodeRecord(op byte, payload []byte) []byte {
+	b := make([]byte, 1, 1+binary.MaxVarintLen64+len(payload)+4)
+	b[0] = op
+	b = appendUvarint(b, uint64(len(payload)))
+	b = append(b, payload...)
+
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(b, crcTable))
+	return append(b, sum[:]...)
+}
+
+// readRecord reads a single record with at most max bytes remaining in the file.
+// It returns the operation, payload and the record size.  errJournalTorn is
+// returned if the record is invalid, extends to or past the end of the file and
+// starts within the largest record of it.
+func readRecord(rd *bufio.Reader, max int64) (byte, []byte, int64, error) {
+	buf := make([]byte, 1, 1+binary.MaxVarintLen64)
+
+	op, err := rd.ReadByte()
+	if err != nil {
+		return 0, nil, 0, errJournalTorn
+	}
+	buf[0] = op
+
+	l, err := binary.ReadUvarint(rd)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, nil, 0, errJournalTorn
+	} else if err != nil {
+		return 0, nil, 0, errJournalCorrupt
+	}
+	buf = appendUvarint(buf, l)
+
+	// A length that could not have been written is corrupt rather than torn so a
+	// record is only torn if it starts within the largest record of the end
+	if l > maxJournalPayload {
+		return 0, nil, 0, errJournalCorrupt
+	}
+	n := int64(len(buf)) + int64(l) + 4
+	if n > max {
+		return 0, nil, 0, errJournalTorn
+	}
+
+	rec := make([]byte, len(buf)+int(l)+4)
+	copy(rec, buf)
+	if _, err = io.ReadFull(rd, rec[len(buf):]); err != nil {
+		return 0, nil, 0, errJournalTorn
+	}
+
+	body := rec[:len(rec)-4]
+	if binary.BigEndian.Uint32(rec[len(body):]) != crc32.Checksum(body, crcTable) {
+		if n == max {
+			return 0, nil, 0, errJournalTorn
+		}
+		return 0, nil, 0, errJournalCorrupt
+	}
+	return op, body[len(buf):], n, nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// syncDir syncs the directory so renames within it are durable
+func syncDir(dir string) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = fh.Sync()
+	fh.Close()
+	return err
+}
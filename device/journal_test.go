@@ -0,0 +1,275 @@
+package device
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func testIndexEntry(i int) *IndexEntry {
+	id := sha256.Sum256([]byte(fmt.Sprint(i)))
+	data := []byte(fmt.Sprintf("data %d", i))
+	return &IndexEntry{id: id[:], typ: block.BlockTypeData, size: uint64(len(data)), data: data}
+}
+
+func Test_JournalIndex(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "journal")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultJournalIndexOptions()
+	opt.CompactRecords = 0
+	j, err := NewJournalIndex(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err = j.Set(testIndexEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = j.Set(testIndexEntry(0)); err != block.ErrBlockExists {
+		t.Fatal("should exist", err)
+	}
+	if _, err = j.Remove(testIndexEntry(3).id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = j.Remove(testIndexEntry(3).id); err != block.ErrBlockNotFound {
+		t.Fatal("should not exist", err)
+	}
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(j *JournalIndex, n int) {
+		if j.Stats().TotalBlocks != n-1 {
+			t.Fatal("wrong count", j.Stats().TotalBlocks)
+		}
+		for i := 0; i < n; i++ {
+			want := testIndexEntry(i)
+			ent, err := j.Get(want.id)
+			if i == 3 {
+				if err != block.ErrBlockNotFound {
+					t.Fatal("removed entry replayed")
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatal(i, err)
+			}
+			if ent.Size() != want.Size() || !bytes.Equal(ent.Data(), want.Data()) {
+				t.Fatal("entry mismatch", i)
+			}
+		}
+	}
+
+	// Replayed on open
+	if j, err = NewJournalIndex(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	check(j, 10)
+
+	// Compacted into a snapshot
+	if err = j.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Set(testIndexEntry(10)); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if j, err = NewJournalIndex(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	check(j, 11)
+	j.Close()
+
+	// Torn record at the end of the journal
+	jp := filepath.Join(dir, journalFile)
+	fi, _ := os.Stat(jp)
+	if err = os.Truncate(jp, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+	if j, err = NewJournalIndex(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	check(j, 10)
+	if err = j.Set(testIndexEntry(10)); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if j, err = NewJournalIndex(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	check(j, 11)
+}
+
+func Test_JournalIndex_compact(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "journal")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultJournalIndexOptions()
+	opt.Sync = SyncInterval
+	opt.CompactRecords = 8
+	j, err := NewJournalIndex(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		ent := testIndexEntry(i / 2)
+		if i%2 == 0 {
+			err = j.Set(ent)
+		} else {
+			_, err = j.Remove(ent.id)
+		}
+		if err != nil {
+			t.Fatal(i, err)
+		}
+	}
+	if j.records >= opt.CompactRecords {
+		t.Fatal("not compacted", j.records)
+	}
+	if err = j.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if j, err = NewJournalIndex(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	if j.Stats().TotalBlocks != 0 {
+		t.Fatal("wrong count", j.Stats().TotalBlocks)
+	}
+
+	// Corrupt snapshots are not silently ignored
+	sp := filepath.Join(dir, snapshotFile)
+	b, _ := ioutil.ReadFile(sp)
+	ioutil.WriteFile(sp, append(b, 1, 2, 3), 0644)
+	if _, err = NewJournalIndex(dir, opt); err == nil {
+		t.Fatal("should fail")
+	}
+}
+
+func Test_JournalIndex_corrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "journal")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultJournalIndexOptions()
+	opt.CompactRecords = 0
+	j, err := NewJournalIndex(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err = j.Set(testIndexEntry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	j.Close()
+
+	// Flip a byte of the first record
+	jp := filepath.Join(dir, journalFile)
+	b, _ := ioutil.ReadFile(jp)
+	b[len(journalMagic)+10] ^= 0xff
+	ioutil.WriteFile(jp, b, 0644)
+
+	if _, err = NewJournalIndex(dir, opt); err == nil {
+		t.Fatal("should fail")
+	}
+	if fi, _ := os.Stat(jp); fi.Size() != int64(len(b)) {
+		t.Fatal("journal truncated", fi.Size(), len(b))
+	}
+
+	// Length of the second record pointing past the end
+	b[len(journalMagic)+10] ^= 0xff
+	l, n := binary.Uvarint(b[len(journalMagic)+1:])
+	off := len(journalMagic) + 1 + n + int(l) + 4
+	copy(b[off+1:], []byte{0xff, 0xff, 0xff, 0xff, 0x0f})
+	ioutil.WriteFile(jp, b, 0644)
+
+	if _, err = NewJournalIndex(dir, opt); err == nil {
+		t.Fatal("should fail")
+	}
+	if fi, _ := os.Stat(jp); fi.Size() != int64(len(b)) {
+		t.Fatal("journal truncated", fi.Size(), len(b))
+	}
+}
+
+// failingJournal fails writes after writing part of the record
+type failingJournal struct {
+	*os.File
+	truncate error
+}
+
+func (fj *failingJournal) Write(p []byte) (int, error) {
+	n, _ := fj.File.Write(p[:len(p)/2])
+	return n, io.ErrShortWrite
+}
+
+func (fj *failingJournal) Truncate(size int64) error {
+	if fj.truncate != nil {
+		return fj.truncate
+	}
+	return fj.File.Truncate(size)
+}
+
+func Test_JournalIndex_failedWrite(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "journal")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultJournalIndexOptions()
+	opt.CompactRecords = 0
+	j, err := NewJournalIndex(dir, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = j.Set(testIndexEntry(0)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Partial record is removed and later writes succeed
+	fh := j.journal.(*os.File)
+	j.journal = &failingJournal{File: fh}
+	if err = j.Set(testIndexEntry(1)); err != io.ErrShortWrite {
+		t.Fatal("should fail", err)
+	}
+	j.journal = fh
+	if err = j.Set(testIndexEntry(2)); err != nil {
+		t.Fatal(err)
+	}
+	j.Close()
+
+	if j, err = NewJournalIndex(dir, opt); err != nil {
+		t.Fatal(err)
+	}
+	if j.Stats().TotalBlocks != 2 || j.Exists(testIndexEntry(1).id) || !j.Exists(testIndexEntry(2).id) {
+		t.Fatal("wrong entries", j.Stats().TotalBlocks)
+	}
+
+	// Writes are refused if the partial record cannot be removed
+	fh = j.journal.(*os.File)
+	j.journal = &failingJournal{File: fh, truncate: errors.New("truncate failed")}
+	if err = j.Set(testIndexEntry(3)); err != io.ErrShortWrite {
+		t.Fatal("should fail", err)
+	}
+	j.journal = fh
+	if err = j.Set(testIndexEntry(4)); err != errJournalFailed {
+		t.Fatal("should refuse writes", err)
+	}
+	if _, err = j.Remove(testIndexEntry(0).id); err != errJournalFailed {
+		t.Fatal("should refuse writes", err)
+	}
+	j.Close()
+}
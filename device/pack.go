@@ -0,0 +1,1011 @@
+package device
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexablock/blox/block"
+	"github.com/hexablock/blox/utils"
+	"github.com/hexablock/log"
+)
+
+const (
+	packSegmentExt = ".pack"
+
+	// packHeaderSize is the size of the fixed record header
+	packHeaderSize = 27
+
+	// Pack record operations
+	packOpSet    byte = 1
+	packOpRemove byte = 2
+)
+
+var (
+	// packMagic is the header of each segment file
+	packMagic = []byte("bloxpak\x01")
+
+	errPackCorrupt = errors.New("pack segment corrupt")
+	// errPackTorn is returned for an invalid record reaching the end of a segment
+	errPackTorn      = errors.New("pack segment torn")
+	errReadOnlyBlock = errors.New("block is read-only")
+	errBlockTooLarge = errors.New("block too large")
+)
+
+// PackRawDeviceOptions are options available when using the PackRawDevice
+type PackRawDeviceOptions struct {
+	// Size after which a new segment is started
+	SegmentSize int64
+	// When to sync segment writes
+	Sync SyncPolicy
+	// Interval between syncs with SyncInterval
+	SyncInterval time.Duration
+	// Interval between background compactions.  Zero disables them
+	CompactInterval time.Duration
+	// Fraction of a segment made up of removed blocks above which it is compacted
+	CompactRatio float64
+	// Largest block stored.  Blocks are buffered in memory before being appended
+	MaxBlockSize uint64
+}
+
+// DefaultPackRawDeviceOptions returns a set of sane defaults syncing every write
+func DefaultPackRawDeviceOptions() PackRawDeviceOptions {
+	return PackRawDeviceOptions{
+		SegmentSize:     256 * 1024 * 1024,
+		Sync:            SyncAlways,
+		SyncInterval:    time.Second,
+		CompactInterval: 10 * time.Minute,
+		CompactRatio:    0.5,
+		MaxBlockSize:    16 * 1024 * 1024,
+	}
+}
+
+// packRecord is a single record of a segment.  A record is a fixed header of the
+// 1-byte operation, 1-byte codec type, 1-byte id length, 8-byte logical size,
+// 8-byte stored data length, 4-byte crc32c of the stored data and 4-byte crc32c of
+// the preceding header fields and id, all big-endian, followed by the id and the
+// stored data.  A remove i.e. tombstone has no data.
+type packRecord struct {
+	op     byte
+	codec  block.CodecType
+	id     []byte
+	size   uint64
+	length int64
+	crc    uint32
+
+	// Offset of the record in the segment
+	offset int64
+}
+
+// len returns the total size of the record
+func (rec *packRecord) len() int64 {
+	return packHeaderSize + int64(len(rec.id)) + rec.length
+}
+
+// dataOffset returns the offset of the stored data in the segment
+func (rec *packRecord) dataOffset() int64 {
+	return rec.offset + packHeaderSize + int64(len(rec.id))
+}
+
+// marshal returns the record with the data
+func (rec *packRecord) marshal(data []byte) []byte {
+	b := make([]byte, packHeaderSize, packHeaderSize+len(rec.id)+len(data))
+	b[0] = rec.op
+	b[1] = byte(rec.codec)
+	b[2] = byte(len(rec.id))
+	binary.BigEndian.PutUint64(b[3:], rec.size)
+	binary.BigEndian.PutUint64(b[11:], uint64(rec.length))
+	binary.BigEndian.PutUint32(b[19:], rec.crc)
+	b = append(b, rec.id...)
+
+	crc := crc32.Checksum(b[:23], crcTable)
+	binary.BigEndian.PutUint32(b[23:], crc32.Update(crc, crcTable, rec.id))
+	return append(b, data...)
+}
+
+// readPackRecord reads the record header at the offset of a segment of the size.
+// errPackTorn is returned if the record is invalid and its header or its claimed
+// length reaches the end of the segment.
+func readPackRecord(r io.ReaderAt, offset, size int64) (*packRecord, error) {
+	if size-offset < packHeaderSize {
+		return nil, errPackTorn
+	}
+	hdr := make([]byte, packHeaderSize)
+	if _, err := r.ReadAt(hdr, offset); err != nil {
+		return nil, err
+	}
+
+	rec := &packRecord{
+		op:     hdr[0],
+		codec:  block.CodecType(hdr[1]),
+		id:     make([]byte, hdr[2]),
+		size:   binary.BigEndian.Uint64(hdr[3:]),
+		length: int64(binary.BigEndian.Uint64(hdr[11:])),
+		crc:    binary.BigEndian.Uint32(hdr[19:]),
+		offset: offset,
+	}
+	if size-offset < packHeaderSize+int64(len(rec.id)) {
+		return nil, errPackTorn
+	}
+	if _, err := r.ReadAt(rec.id, offset+packHeaderSize); err != nil {
+		return nil, err
+	}
+
+	// Stored data remaining in the segment
+	remain := size - offset - packHeaderSize - int64(len(rec.id))
+	crc := crc32.Update(crc32.Checksum(hdr[:23], crcTable), crcTable, rec.id)
+	if crc != binary.BigEndian.Uint32(hdr[23:]) {
+		if rec.length >= remain {
+			return nil, errPackTorn
+		}
+		return nil, errPackCorrupt
+	}
+	switch {
+	case len(rec.id) == 0:
+		return nil, errPackCorrupt
+	case rec.op != packOpSet && rec.op != packOpRemove:
+		return nil, errPackCorrupt
+	case rec.length < 0:
+		return nil, errPackCorrupt
+	case rec.length > remain:
+		return nil, errPackTorn
+	case rec.op == packOpRemove && rec.length != 0:
+		return nil, errPackCorrupt
+	}
+	return rec, nil
+}
+
+// iterPackRecords iterates over the records of a segment of the size.  It returns
+// the offset after the last valid record, and errPackTorn or errPackCorrupt if an
+// invalid record was found.
+func iterPackRecords(r io.ReaderAt, size int64, f func(*packRecord) error) (int64, error) {
+	magic := make([]byte, len(packMagic))
+	if _, err := r.ReadAt(magic, 0); err != nil || !bytes.Equal(magic, packMagic) {
+		return 0, errPackCorrupt
+	}
+
+	offset := int64(len(packMagic))
+	for offset < size {
+		rec, err := readPackRecord(r, offset, size)
+		if err != nil {
+			return offset, err
+		}
+		if err = f(rec); err != nil {
+			return offset, err
+		}
+		offset += rec.len()
+	}
+	return offset, nil
+}
+
+// isZeroTail returns true if the segment only holds zeros from the offset to the
+// size, as left by a file system extending the file before a crash
+func isZeroTail(r io.ReaderAt, offset, size int64) bool {
+	buf := make([]byte, 32*1024)
+	for offset < size {
+		n := int64(len(buf))
+		if size-offset < n {
+			n = size - offset
+		}
+		if _, err := r.ReadAt(buf[:n], offset); err != nil {
+			return false
+		}
+		for _, b := range buf[:n] {
+			if b != 0 {
+				return false
+			}
+		}
+		offset += n
+	}
+	return true
+}
+
+// packSegment is a single segment file
+type packSegment struct {
+	num  uint32
+	path string
+	// Open only for the active segment
+	fh *os.File
+	// Bytes written including the header
+	size int64
+	// Bytes of removed or replaced records and tombstones
+	dead int64
+	// Ids of removed or replaced records in the segment.  Tombstones of these
+	// ids are kept when other segments are compacted.
+	deadIDs map[string]struct{}
+}
+
+// packLocation is the location of a stored block
+type packLocation struct {
+	seg *packSegment
+	rec *packRecord
+}
+
+// PackRawDevice implements a RawDevice appending blocks to large segment files in
+// the data directory rather than using a file per block.  The offset of each block
+// is held in memory and rebuilt from the record headers when the device is opened.
+// Removed blocks are marked with a tombstone record and the space is reclaimed by
+// compacting segments, copying the remaining blocks to the active segment.  An
+// incomplete record at the end of the last segment, as left by a crash while
+// writing, is discarded on open.  Blocks are buffered in memory when stored so
+// their size is limited.
+type PackRawDevice struct {
+	dir    string
+	hasher func() hash.Hash
+	opt    PackRawDeviceOptions
+
+	mu   sync.RWMutex
+	locs map[string]*packLocation
+	segs map[uint32]*packSegment
+	// Segment appended to.  This is the highest numbered segment
+	active *packSegment
+	// Unsynced writes with SyncInterval
+	dirty bool
+
+	// Serializes compactions
+	cmu sync.Mutex
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewPackRawDevice opens the pack device in the directory creating it if it does
+// not exist.  All segments are scanned to load the block locations.
+func NewPackRawDevice(dir string, hasher func() hash.Hash, opt PackRawDeviceOptions) (*PackRawDevice, error) {
+	dabs, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dabs, 0755); err != nil {
+		return nil, err
+	}
+
+	dev := &PackRawDevice{
+		dir:    dabs,
+		hasher: hasher,
+		opt:    opt,
+		locs:   make(map[string]*packLocation),
+		segs:   make(map[uint32]*packSegment),
+		stop:   make(chan struct{}),
+	}
+
+	if err = dev.load(); err != nil {
+		if dev.active != nil && dev.active.fh != nil {
+			dev.active.fh.Close()
+		}
+		return nil, err
+	}
+
+	if opt.CompactInterval > 0 || (opt.Sync == SyncInterval && opt.SyncInterval > 0) {
+		dev.wg.Add(1)
+		go dev.loop()
+	}
+
+	return dev, nil
+}
+
+// Hasher returns the underlying hash function generator used to generate hash
+// id
+func (dev *PackRawDevice) Hasher() func() hash.Hash {
+	return dev.hasher
+}
+
+// NewBlock returns a new in-memory Block that is written to the device when its
+// writer is closed
+func (dev *PackRawDevice) NewBlock() block.Block {
+	return &packNewBlock{MemDataBlock: block.NewMemDataBlock(nil, dev.hasher), dev: dev}
+}
+
+// SetBlock appends the block to the active segment.  The data is hashed as it is
+// read and the id returned.  It returns a ErrBlockExists if the block exists
+// along with the id.  If the provided block has a codec the data is stored encoded
+// with it.  Blocks larger than the MaxBlockSize option are rejected.
+func (dev *PackRawDevice) SetBlock(blk block.Block) ([]byte, error) {
+	if blk.Size() > dev.opt.MaxBlockSize {
+		log.Printf("[ERROR] PackRawDevice.SetBlock id=%x size=%d error='%v'", blk.ID(), blk.Size(), errBlockTooLarge)
+		return nil, errBlockTooLarge
+	}
+
+	src, err := blk.Reader()
+	if err != nil {
+		log.Printf("[ERROR] PackRawDevice.SetBlock id=%x error='%v'", blk.ID(), err)
+		return nil, err
+	}
+
+	// Hashed with the same function as the source so multihash ids of any
+	// algorithm are preserved
+	h := block.SelectHasher(blk.ID(), dev.hasher)()
+	h.Write([]byte{byte(block.BlockTypeData)})
+
+	codec := block.BlockCodec(blk)
+	buf := bytes.NewBuffer(nil)
+	var (
+		wr io.Writer = buf
+		cw io.WriteCloser
+	)
+	if codec != nil {
+		if cw, err = codec.NewWriter(buf); err != nil {
+			src.Close()
+			return nil, err
+		}
+		wr = cw
+	}
+
+	err = utils.CopyNAndCheck(io.MultiWriter(h, wr), src, int64(blk.Size()))
+	src.Close()
+	if cw != nil {
+		if e := cw.Close(); err == nil {
+			err = e
+		}
+	}
+	if err != nil {
+		log.Printf("[ERROR] PackRawDevice.SetBlock id=%x error='%v'", blk.ID(), err)
+		return nil, err
+	}
+
+	data := buf.Bytes()
+	rec := &packRecord{
+		op:     packOpSet,
+		codec:  block.CodecTypeOf(codec),
+		id:     h.Sum(nil),
+		size:   blk.Size(),
+		length: int64(len(data)),
+		crc:    crc32.Checksum(data, crcTable),
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if _, ok := dev.locs[string(rec.id)]; ok {
+		return rec.id, block.ErrBlockExists
+	}
+	if err = dev.append(rec, data); err != nil {
+		log.Printf("[ERROR] PackRawDevice.SetBlock id=%x error='%v'", rec.id, err)
+		return nil, err
+	}
+	dev.locs[string(rec.id)] = &packLocation{seg: dev.active, rec: rec}
+
+	log.Printf("[DEBUG] PackRawDevice.SetBlock id=%x size=%d segment=%d", rec.id, rec.size, dev.active.num)
+
+	return rec.id, nil
+}
+
+// GetBlock returns a block with the given id if it exists.  The data is read from
+// the segment when the block reader is opened.
+func (dev *PackRawDevice) GetBlock(id []byte) (block.Block, error) {
+	dev.mu.RLock()
+	loc, ok := dev.locs[string(id)]
+	dev.mu.RUnlock()
+	if !ok {
+		return nil, block.ErrBlockNotFound
+	}
+
+	codec, err := block.GetCodec(loc.rec.codec)
+	if err != nil {
+		return nil, err
+	}
+
+	return &packBlock{
+		dev:    dev,
+		id:     loc.rec.id,
+		size:   loc.rec.size,
+		codec:  codec,
+		hasher: block.SelectHasher(id, dev.hasher),
+		uri:    block.NewURI("file://" + loc.seg.path),
+	}, nil
+}
+
+// RemoveBlock appends a tombstone for the block.  The space is reclaimed when its
+// segment is compacted
+func (dev *PackRawDevice) RemoveBlock(id []byte) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	loc, ok := dev.locs[string(id)]
+	if !ok {
+		return block.ErrBlockNotFound
+	}
+
+	rec := &packRecord{op: packOpRemove, id: loc.rec.id}
+	if err := dev.append(rec, nil); err != nil {
+		return err
+	}
+	dev.active.dead += rec.len()
+
+	dev.markDead(loc)
+	delete(dev.locs, string(id))
+	return nil
+}
+
+// Exists returns true if the block exists
+func (dev *PackRawDevice) Exists(id []byte) bool {
+	dev.mu.RLock()
+	_, ok := dev.locs[string(id)]
+	dev.mu.RUnlock()
+	return ok
+}
+
+// IterIDs iterates over all block ids
+func (dev *PackRawDevice) IterIDs(f func(id []byte) error) error {
+	dev.mu.RLock()
+	ids := make([][]byte, 0, len(dev.locs))
+	for _, loc := range dev.locs {
+		ids = append(ids, loc.rec.id)
+	}
+	dev.mu.RUnlock()
+
+	for _, id := range ids {
+		if err := f(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Count returns the total number of blocks about the device
+func (dev *PackRawDevice) Count() int {
+	dev.mu.RLock()
+	defer dev.mu.RUnlock()
+	return len(dev.locs)
+}
+
+// Compact rewrites each segment other than the active one in which removed blocks
+// make up at least the configured ratio, copying the remaining blocks to the
+// active segment and deleting it.  It is called periodically in the background if
+// a compaction interval is set.
+func (dev *PackRawDevice) Compact() error {
+	dev.cmu.Lock()
+	defer dev.cmu.Unlock()
+
+	dev.mu.RLock()
+	segs := make([]*packSegment, 0)
+	for _, seg := range dev.segs {
+		used := seg.size - int64(len(packMagic))
+		if seg != dev.active && seg.dead > 0 && float64(seg.dead) >= dev.opt.CompactRatio*float64(used) {
+			segs = append(segs, seg)
+		}
+	}
+	dev.mu.RUnlock()
+
+	sort.Slice(segs, func(i, j int) bool { return segs[i].num < segs[j].num })
+	for _, seg := range segs {
+		if err := dev.compactSegment(seg); err != nil {
+			return fmt.Errorf("compact %s: %v", seg.path, err)
+		}
+	}
+	return nil
+}
+
+// Close stops background operations then syncs and closes the active segment
+func (dev *PackRawDevice) Close() error {
+	close(dev.stop)
+	dev.wg.Wait()
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	err := dev.active.fh.Sync()
+	if er := dev.active.fh.Close(); er != nil && err == nil {
+		err = er
+	}
+	return err
+}
+
+// compactSegment copies the live blocks and required tombstones of the sealed
+// segment to the active segment then deletes it.  Segments are immutable once
+// sealed so they are read without holding the lock.
+func (dev *PackRawDevice) compactSegment(seg *packSegment) error {
+	fh, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	_, err = iterPackRecords(fh, seg.size, func(rec *packRecord) error {
+		if rec.op == packOpRemove {
+			return dev.moveTombstone(seg, rec)
+		}
+		return dev.moveRecord(fh, seg, rec)
+	})
+	if err != nil {
+		return err
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	// Copies must be durable before the original is removed
+	if err = dev.active.fh.Sync(); err != nil {
+		return err
+	}
+	delete(dev.segs, seg.num)
+	if err = os.Remove(seg.path); err != nil {
+		return err
+	}
+
+	log.Printf("[INFO] PackRawDevice compacted segment=%d size=%d dead=%d", seg.num, seg.size, seg.dead)
+	return syncDir(dev.dir)
+}
+
+// moveRecord copies the record to the active segment if it is the current location
+// of the block
+func (dev *PackRawDevice) moveRecord(r io.ReaderAt, seg *packSegment, rec *packRecord) error {
+	dev.mu.RLock()
+	live := dev.isLive(seg, rec)
+	dev.mu.RUnlock()
+	if !live {
+		return nil
+	}
+
+	data := make([]byte, rec.length)
+	if _, err := r.ReadAt(data, rec.dataOffset()); err != nil {
+		return err
+	}
+
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	// Removed while reading
+	if !dev.isLive(seg, rec) {
+		return nil
+	}
+
+	nrec := *rec
+	if err := dev.append(&nrec, data); err != nil {
+		return err
+	}
+	dev.locs[string(rec.id)] = &packLocation{seg: dev.active, rec: &nrec}
+	return nil
+}
+
+// moveTombstone copies the tombstone to the active segment if another segment
+// still contains a removed record of the block which would otherwise be loaded
+// again on open
+func (dev *PackRawDevice) moveTombstone(seg *packSegment, rec *packRecord) error {
+	dev.mu.Lock()
+	defer dev.mu.Unlock()
+
+	if _, ok := dev.locs[string(rec.id)]; ok {
+		// Stored again after the removal
+		return nil
+	}
+
+	for _, s := range dev.segs {
+		if s == seg {
+			continue
+		}
+		if _, ok := s.deadIDs[string(rec.id)]; ok {
+			nrec := *rec
+			if err := dev.append(&nrec, nil); err != nil {
+				return err
+			}
+			dev.active.dead += nrec.len()
+			return nil
+		}
+	}
+	return nil
+}
+
+// isLive returns true if the record is the current location of the block
+func (dev *PackRawDevice) isLive(seg *packSegment, rec *packRecord) bool {
+	loc, ok := dev.locs[string(rec.id)]
+	return ok && loc.seg == seg && loc.rec.offset == rec.offset
+}
+
+// markDead marks the block at the location as removed or replaced
+func (dev *PackRawDevice) markDead(loc *packLocation) {
+	loc.seg.dead += loc.rec.len()
+	loc.seg.deadIDs[string(loc.rec.id)] = struct{}{}
+}
+
+// append writes the record to the active segment starting a new segment if it is
+// full.  The record offset is set to its location in the active segment
+func (dev *PackRawDevice) append(rec *packRecord, data []byte) error {
+	b := rec.marshal(data)
+	if dev.active.size+int64(len(b)) > dev.opt.SegmentSize && dev.active.size > int64(len(packMagic)) {
+		if err := dev.roll(); err != nil {
+			return err
+		}
+	}
+
+	seg := dev.active
+	if _, err := seg.fh.WriteAt(b, seg.size); err != nil {
+		return err
+	}
+	rec.offset = seg.size
+	seg.size += int64(len(b))
+
+	switch dev.opt.Sync {
+	case SyncAlways:
+		return seg.fh.Sync()
+	case SyncInterval:
+		dev.dirty = true
+	}
+	return nil
+}
+
+// roll seals the active segment and starts a new one
+func (dev *PackRawDevice) roll() error {
+	var num uint32 = 1
+	if dev.active != nil {
+		num = dev.active.num + 1
+	}
+
+	seg := &packSegment{
+		num:     num,
+		path:    filepath.Join(dev.dir, fmt.Sprintf("%08d%s", num, packSegmentExt)),
+		deadIDs: make(map[string]struct{}),
+	}
+	fh, err := os.OpenFile(seg.path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = fh.Write(packMagic); err == nil {
+		if err = fh.Sync(); err == nil {
+			err = syncDir(dev.dir)
+		}
+	}
+	if err != nil {
+		fh.Close()
+		os.Remove(seg.path)
+		return err
+	}
+	seg.fh = fh
+	seg.size = int64(len(packMagic))
+
+	if prev := dev.active; prev != nil {
+		err = prev.fh.Sync()
+		if er := prev.fh.Close(); er != nil && err == nil {
+			err = er
+		}
+		prev.fh = nil
+	}
+
+	dev.segs[num] = seg
+	dev.active = seg
+	return err
+}
+
+// load scans all segments in order to build the block locations.  Data after the
+// last valid record of the last segment is truncated.
+func (dev *PackRawDevice) load() error {
+	files, err := ioutil.ReadDir(dev.dir)
+	if err != nil {
+		return err
+	}
+
+	nums := make([]uint32, 0, len(files))
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasSuffix(name, packSegmentExt) {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, packSegmentExt), 10, 32)
+		if err != nil || n == 0 {
+			continue
+		}
+		nums = append(nums, uint32(n))
+	}
+	sort.Slice(nums, func(i, j int) bool { return nums[i] < nums[j] })
+
+	if len(nums) == 0 {
+		return dev.roll()
+	}
+
+	for i, num := range nums {
+		seg := &packSegment{
+			num:     num,
+			path:    filepath.Join(dev.dir, fmt.Sprintf("%08d%s", num, packSegmentExt)),
+			deadIDs: make(map[string]struct{}),
+		}
+		dev.segs[num] = seg
+
+		if i == len(nums)-1 {
+			err = dev.loadActive(seg)
+		} else {
+			err = dev.loadSegment(seg)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", seg.path, err)
+		}
+	}
+	return nil
+}
+
+// loadSegment loads the records of a sealed segment.  Any invalid record is an
+// error
+func (dev *PackRawDevice) loadSegment(seg *packSegment) error {
+	fh, err := os.Open(seg.path)
+	if err != nil {
+		return err
+	}
+	defer fh.Close()
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	seg.size, err = iterPackRecords(fh, fi.Size(), func(rec *packRecord) error {
+		dev.apply(seg, rec)
+		return nil
+	})
+	return err
+}
+
+// loadActive loads the records of the last segment and opens it for appending.
+// An invalid record reaching the end of the segment, or followed only by zeros, is
+// truncated.  Any other invalid record is an error.
+func (dev *PackRawDevice) loadActive(seg *packSegment) error {
+	fh, err := os.OpenFile(seg.path, os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	seg.fh = fh
+	dev.active = seg
+
+	fi, err := fh.Stat()
+	if err != nil {
+		return err
+	}
+
+	// Crashed while creating the segment
+	if fi.Size() < int64(len(packMagic)) {
+		if _, err = fh.WriteAt(packMagic, 0); err != nil {
+			return err
+		}
+		seg.size = int64(len(packMagic))
+		return fh.Sync()
+	}
+
+	seg.size, err = iterPackRecords(fh, fi.Size(), func(rec *packRecord) error {
+		dev.apply(seg, rec)
+		return nil
+	})
+	if err == errPackCorrupt && seg.size > 0 && isZeroTail(fh, seg.size, fi.Size()) {
+		// Extended but not written
+		err = errPackTorn
+	}
+	if err == errPackTorn && seg.size > 0 {
+		log.Printf("[WARN] PackRawDevice discarding invalid segment tail segment=%d offset=%d size=%d",
+			seg.num, seg.size, fi.Size())
+		if err = fh.Truncate(seg.size); err == nil {
+			err = fh.Sync()
+		}
+	}
+	return err
+}
+
+// apply applies the record read from the segment to the block locations
+func (dev *PackRawDevice) apply(seg *packSegment, rec *packRecord) {
+	k := string(rec.id)
+	if loc, ok := dev.locs[k]; ok {
+		dev.markDead(loc)
+		delete(dev.locs, k)
+	}
+
+	if rec.op == packOpSet {
+		dev.locs[k] = &packLocation{seg: seg, rec: rec}
+	} else {
+		seg.dead += rec.len()
+	}
+}
+
+func (dev *PackRawDevice) loop() {
+	defer dev.wg.Done()
+
+	var syncC, compactC <-chan time.Time
+	if dev.opt.Sync == SyncInterval && dev.opt.SyncInterval > 0 {
+		ticker := time.NewTicker(dev.opt.SyncInterval)
+		defer ticker.Stop()
+		syncC = ticker.C
+	}
+	if dev.opt.CompactInterval > 0 {
+		ticker := time.NewTicker(dev.opt.CompactInterval)
+		defer ticker.Stop()
+		compactC = ticker.C
+	}
+
+	for {
+		select {
+		case <-syncC:
+			dev.mu.Lock()
+			if dev.dirty {
+				if err := dev.active.fh.Sync(); err != nil {
+					log.Printf("[ERROR] PackRawDevice sync failed error='%v'", err)
+				} else {
+					dev.dirty = false
+				}
+			}
+			dev.mu.Unlock()
+
+		case <-compactC:
+			if err := dev.Compact(); err != nil {
+				log.Printf("[ERROR] PackRawDevice compaction failed error='%v'", err)
+			}
+
+		case <-dev.stop:
+			return
+		}
+	}
+}
+
+// open opens a reader to the stored data of the block.  The segment is opened
+// while holding the lock so it cannot be removed by a compaction in between.
+func (dev *PackRawDevice) open(id []byte) (io.ReadCloser, error) {
+	dev.mu.RLock()
+	loc, ok := dev.locs[string(id)]
+	if !ok {
+		dev.mu.RUnlock()
+		return nil, block.ErrBlockNotFound
+	}
+	fh, err := os.Open(loc.seg.path)
+	rec := loc.rec
+	dev.mu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	codec, err := block.GetCodec(rec.codec)
+	if err != nil {
+		fh.Close()
+		return nil, err
+	}
+
+	pr := &packReader{
+		Reader: &checkedReader{rd: io.NewSectionReader(fh, rec.dataOffset(), rec.length), crc: rec.crc},
+		fh:     fh,
+	}
+	if codec != nil {
+		dec, err := codec.NewReader(pr.Reader)
+		if err != nil {
+			fh.Close()
+			return nil, err
+		}
+		pr.Reader = dec
+		pr.dec = dec
+	}
+	return pr, nil
+}
+
+// checkedReader verifies the crc32c of the stored data once it has been read in
+// full
+type checkedReader struct {
+	rd  io.Reader
+	crc uint32
+	sum uint32
+}
+
+func (r *checkedReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.sum = crc32.Update(r.sum, crcTable, p[:n])
+	if err == io.EOF && r.sum != r.crc {
+		err = block.ErrBlockCorrupt
+	}
+	return n, err
+}
+
+// packReader reads the data of a block from its segment
+type packReader struct {
+	io.Reader
+	dec io.Closer
+	fh  *os.File
+}
+
+func (r *packReader) Close() error {
+	var err error
+	if r.dec != nil {
+		err = r.dec.Close()
+	}
+	if e := r.fh.Close(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// packBlock is a data block stored in a segment
+type packBlock struct {
+	dev    *PackRawDevice
+	id     []byte
+	size   uint64
+	codec  block.Codec
+	hasher func() hash.Hash
+	uri    *block.URI
+}
+
+// ID returns the hash id of the block
+func (blk *packBlock) ID() []byte {
+	return blk.id
+}
+
+// Type returns BlockTypeData
+func (blk *packBlock) Type() block.BlockType {
+	return block.BlockTypeData
+}
+
+// Size returns the logical size of the block data
+func (blk *packBlock) Size() uint64 {
+	return blk.size
+}
+
+// SetSize sets the size of the block data
+func (blk *packBlock) SetSize(size uint64) {
+	blk.size = size
+}
+
+// URI returns the uri of the segment containing the block
+func (blk *packBlock) URI() *block.URI {
+	return blk.uri
+}
+
+// Codec returns the codec the stored data is encoded with
+func (blk *packBlock) Codec() block.Codec {
+	return blk.codec
+}
+
+// Hasher returns the hash function of the block id
+func (blk *packBlock) Hasher() func() hash.Hash {
+	return blk.hasher
+}
+
+// Reader returns a reader to the decoded data of the block
+func (blk *packBlock) Reader() (io.ReadCloser, error) {
+	return blk.dev.open(blk.id)
+}
+
+// Writer returns an error as stored blocks cannot be modified
+func (blk *packBlock) Writer() (io.WriteCloser, error) {
+	return nil, errReadOnlyBlock
+}
+
+// Hash computes the hash of the type and data returning it.  It returns nil if the
+// data cannot be read.
+func (blk *packBlock) Hash() []byte {
+	rd, err := blk.Reader()
+	if err != nil {
+		return nil
+	}
+	defer rd.Close()
+
+	h := blk.hasher()
+	h.Write([]byte{byte(block.BlockTypeData)})
+	if _, err = io.Copy(h, rd); err != nil {
+		return nil
+	}
+	blk.id = h.Sum(nil)
+	return blk.id
+}
+
+// packNewBlock is an in-memory block written to the device when its writer is
+// closed
+type packNewBlock struct {
+	*block.MemDataBlock
+	dev *PackRawDevice
+}
+
+// Writer returns the block as the writer so the data is stored on close
+func (blk *packNewBlock) Writer() (io.WriteCloser, error) {
+	_, err := blk.MemDataBlock.Writer()
+	return blk, err
+}
+
+// Close closes the writer storing the block on the device
+func (blk *packNewBlock) Close() error {
+	if err := blk.MemDataBlock.Close(); err != nil {
+		return err
+	}
+	_, err := blk.dev.SetBlock(blk.MemDataBlock)
+	return err
+}
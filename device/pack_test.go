@@ -0,0 +1,264 @@
+package device
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func newTestPackBlock(t *testing.T, i int, codec block.Codec) block.Block {
+	blk := block.NewMemDataBlock(nil, sha256.New)
+	blk.SetCodec(codec)
+	wr, _ := blk.Writer()
+	wr.Write(bytes.Repeat([]byte(fmt.Sprintf("pack block %d ", i)), 500))
+	if err := wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return blk
+}
+
+func checkPackBlock(t *testing.T, dev *PackRawDevice, want block.Block) {
+	blk, err := dev.GetBlock(want.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blk.Size() != want.Size() {
+		t.Fatal("size mismatch", blk.Size(), want.Size())
+	}
+	if err = block.Verify(blk); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_PackRawDevice(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "pack")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultPackRawDeviceOptions()
+	opt.SegmentSize = 32 * 1024
+	opt.CompactInterval = 0
+	dev, err := NewPackRawDevice(dir, sha256.New, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blocks := make([]block.Block, 20)
+	for i := range blocks {
+		var codec block.Codec
+		if i%2 == 0 {
+			codec = &block.GzipCodec{Level: 1}
+		}
+		blocks[i] = newTestPackBlock(t, i, codec)
+		id, err := dev.SetBlock(blocks[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(id, blocks[i].ID()) {
+			t.Fatal("id mismatch")
+		}
+	}
+	if _, err = dev.SetBlock(blocks[0]); err != block.ErrBlockExists {
+		t.Fatal("should exist", err)
+	}
+	if len(dev.segs) < 2 {
+		t.Fatal("segments not rolled", len(dev.segs))
+	}
+
+	for i := 0; i < 15; i++ {
+		if err = dev.RemoveBlock(blocks[i].ID()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = dev.RemoveBlock(blocks[0].ID()); err != block.ErrBlockNotFound {
+		t.Fatal("should not exist", err)
+	}
+	// Stored again after removal
+	if _, err = dev.SetBlock(blocks[1]); err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+
+	// Reloaded from the segments
+	if dev, err = NewPackRawDevice(dir, sha256.New, opt); err != nil {
+		t.Fatal(err)
+	}
+	check := func() {
+		if dev.Count() != 6 {
+			t.Fatal("wrong count", dev.Count())
+		}
+		for i, blk := range blocks {
+			if i == 1 || i >= 15 {
+				checkPackBlock(t, dev, blk)
+			} else if dev.Exists(blk.ID()) {
+				t.Fatal("removed block exists", i)
+			}
+		}
+	}
+	check()
+
+	nsegs := len(dev.segs)
+	if err = dev.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if len(dev.segs) >= nsegs {
+		t.Fatal("segments not compacted", len(dev.segs), nsegs)
+	}
+	check()
+	dev.Close()
+
+	if dev, err = NewPackRawDevice(dir, sha256.New, opt); err != nil {
+		t.Fatal(err)
+	}
+	check()
+
+	// Torn write at the end of the active segment
+	last := blocks[len(blocks)-1]
+	if err = dev.RemoveBlock(last.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dev.SetBlock(last); err != nil {
+		t.Fatal(err)
+	}
+	dev.Close()
+
+	fi, _ := os.Stat(dev.active.path)
+	if err = os.Truncate(dev.active.path, fi.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+	if dev, err = NewPackRawDevice(dir, sha256.New, opt); err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+	if dev.Exists(last.ID()) {
+		t.Fatal("torn block should not exist")
+	}
+}
+
+func Test_PackRawDevice_corrupt(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "pack")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultPackRawDeviceOptions()
+	opt.CompactInterval = 0
+	dev, err := NewPackRawDevice(dir, sha256.New, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dev.Close()
+
+	blk := newTestPackBlock(t, 1, nil)
+	if _, err = dev.SetBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flip a byte of the stored data
+	fh, _ := os.OpenFile(dev.active.path, os.O_RDWR, 0644)
+	fh.WriteAt([]byte{0xff}, dev.active.size-1)
+	fh.Close()
+
+	rd, _ := dev.GetBlock(blk.ID())
+	r, err := rd.Reader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err = ioutil.ReadAll(r); err != block.ErrBlockCorrupt {
+		t.Fatal("should be corrupt", err)
+	}
+}
+
+func Test_PackRawDevice_invalidRecord(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "pack")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultPackRawDeviceOptions()
+	opt.CompactInterval = 0
+	opt.MaxBlockSize = 16 * 1024
+	dev, err := NewPackRawDevice(dir, sha256.New, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := block.NewMemDataBlock(nil, sha256.New)
+	wr, _ := large.Writer()
+	wr.Write(make([]byte, 32*1024))
+	wr.Close()
+	if _, err = dev.SetBlock(large); err != errBlockTooLarge {
+		t.Fatal("should be too large", err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = dev.SetBlock(newTestPackBlock(t, i, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	path, size := dev.active.path, dev.active.size
+	dev.Close()
+
+	// Zeros after the last record are discarded
+	fh, _ := os.OpenFile(path, os.O_RDWR, 0644)
+	fh.WriteAt(make([]byte, 100), size)
+	fh.Close()
+	if dev, err = NewPackRawDevice(dir, sha256.New, opt); err != nil {
+		t.Fatal(err)
+	}
+	if dev.active.size != size {
+		t.Fatal("zero tail not truncated", dev.active.size, size)
+	}
+	dev.Close()
+
+	// Flip a byte of the header of the first record
+	fh, _ = os.OpenFile(path, os.O_RDWR, 0644)
+	fh.WriteAt([]byte{0xff}, int64(len(packMagic))+packHeaderSize-1)
+	fh.Close()
+	if _, err = NewPackRawDevice(dir, sha256.New, opt); err == nil {
+		t.Fatal("should fail to open")
+	}
+	if fi, _ := os.Stat(path); fi.Size() != size {
+		t.Fatal("corrupt segment truncated", fi.Size(), size)
+	}
+}
+
+func Test_PackRawDevice_BlockDevice(t *testing.T) {
+	dir, _ := ioutil.TempDir(testdir, "pack")
+	defer os.RemoveAll(dir)
+
+	opt := DefaultPackRawDeviceOptions()
+	opt.Sync = SyncInterval
+	raw, err := NewPackRawDevice(filepath.Join(dir, "data"), sha256.New, opt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := NewBlockDevice(NewInmemIndex(), raw)
+	dev.SetVerifyOnRead(true)
+
+	// Written through the raw device
+	nb := raw.NewBlock()
+	wr, _ := nb.Writer()
+	wr.Write(bytes.Repeat([]byte("new block"), 1000))
+	if err = wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blk := newTestPackBlock(t, 1, nil)
+	if _, err = dev.SetBlock(blk); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = dev.GetBlock(blk.ID()); err != nil {
+		t.Fatal(err)
+	}
+
+	dev.Reindex()
+	if _, err = dev.GetBlock(nb.ID()); err != nil {
+		t.Fatal(err)
+	}
+	if err = dev.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -4,9 +4,10 @@ import (
 	"encoding/hex"
 	"errors"
 	"hash"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 
 	"github.com/hexablock/blox/block"
 	"github.com/hexablock/blox/utils"
@@ -17,8 +18,34 @@ import (
 // disk.
 const DefaultFilePerms = 0444
 
+// FileLayout determines where block files are stored in the data directory
+type FileLayout uint8
+
+const (
+	// FileLayoutFlat stores all block files directly in the data directory
+	FileLayoutFlat FileLayout = iota
+	// FileLayoutFanout stores block files two directories deep named after the
+	// first two bytes of the hash digest e.g. ab/cd/<hex id>.  The digest of a
+	// multihash id is used so its prefix does not put all blocks in one directory.
+	FileLayoutFanout
+)
+
+func (layout FileLayout) String() string {
+	switch layout {
+	case FileLayoutFlat:
+		return "flat"
+	case FileLayoutFanout:
+		return "fanout"
+	}
+	return "unknown"
+}
+
+// readDirBatch is the number of directory entries read at a time
+const readDirBatch = 256
+
 // FileRawDevice implements a file based block device.  Blocks are stored in
-// files 1 file per block in the data dir.
+// files 1 file per block in the data dir, either directly or in fan-out sub
+// directories depending on the layout.
 type FileRawDevice struct {
 	// Directory where blocks are stored
 	datadir string
@@ -28,10 +55,19 @@ type FileRawDevice struct {
 
 	// Hash function used to hash data
 	hasher func() hash.Hash
+
+	// Layout new blocks are stored in.  Blocks in the other layout are still found
+	// until migrated
+	layout FileLayout
+
+	// Number of blocks on the device
+	count int64
 }
 
 // NewFileRawDevice instantiates a new FileRawDevice setting the defaults
-// permissions, flush interval provided data directory.
+// permissions, flush interval provided data directory.  Existing blocks are
+// counted once here after which the count is maintained as blocks are written and
+// removed.
 func NewFileRawDevice(datadir string, hasher func() hash.Hash) (*FileRawDevice, error) {
 	dabs, err := filepath.Abs(datadir)
 	if err == nil {
@@ -43,21 +79,72 @@ func NewFileRawDevice(datadir string, hasher func() hash.Hash) (*FileRawDevice,
 			}
 		}
 
-		return &FileRawDevice{dabs, DefaultFilePerms, hasher}, nil
+		st := &FileRawDevice{datadir: dabs, defaultSetPerm: DefaultFilePerms, hasher: hasher}
+		st.walk(true, true, func([]byte, string) error {
+			st.count++
+			return nil
+		})
+		return st, nil
 	}
 
 	return nil, err
 }
 
+// SetLayout sets the layout new blocks are stored in.  Existing blocks are moved to
+// the layout by calling Migrate.  It should be set before the device is used as it
+// is not thread-safe
+func (st *FileRawDevice) SetLayout(layout FileLayout) {
+	st.layout = layout
+}
+
 // Hasher returns the underlying hash function generator used to generate hash
 // id
 func (st *FileRawDevice) Hasher() func() hash.Hash {
 	return st.hasher
 }
 
-// returns the absolute path to the given block from the data directory
+// returns the absolute path to the given block in the layout
+func (st *FileRawDevice) layoutPath(id []byte, layout FileLayout) string {
+	name := hex.EncodeToString(id)
+	if layout == FileLayoutFlat {
+		return filepath.Join(st.datadir, name)
+	}
+
+	key := id
+	if _, digest, err := block.DecodeMultihash(id); err == nil {
+		key = digest
+	}
+	for len(key) < 2 {
+		key = append([]byte{0}, key...)
+	}
+	return filepath.Join(st.datadir, hex.EncodeToString(key[:1]), hex.EncodeToString(key[1:2]), name)
+}
+
+// returns the absolute path to the given block in the current layout
 func (st *FileRawDevice) abspath(id []byte) string {
-	return filepath.Join(st.datadir, hex.EncodeToString(id))
+	return st.layoutPath(id, st.layout)
+}
+
+// locate returns the path of the block file checking the current then the other
+// layout.  It returns false if the block does not exist
+func (st *FileRawDevice) locate(id []byte) (string, bool) {
+	p := st.abspath(id)
+	if _, err := os.Stat(p); err == nil {
+		return p, true
+	}
+
+	p = st.layoutPath(id, st.otherLayout())
+	if _, err := os.Stat(p); err == nil {
+		return p, true
+	}
+	return "", false
+}
+
+func (st *FileRawDevice) otherLayout() FileLayout {
+	if st.layout == FileLayoutFlat {
+		return FileLayoutFanout
+	}
+	return FileLayoutFlat
 }
 
 // NewBlock returns a new Block backed by the store.  It initially sets the block uri to the
@@ -65,36 +152,52 @@ func (st *FileRawDevice) abspath(id []byte) string {
 // hash id
 func (st *FileRawDevice) NewBlock() block.Block {
 	uri := block.NewURI("file://" + st.datadir)
-	return block.NewFileDataBlock(uri, st.hasher)
+	return &fileNewBlock{FileDataBlock: block.NewFileDataBlock(uri, st.hasher), st: st}
 }
 
 // RemoveBlock removes a Block from the in-mem buffer as well as stable store.
 func (st *FileRawDevice) RemoveBlock(id []byte) error {
-	p := st.abspath(id)
-	return os.Remove(p)
+	err := os.Remove(st.abspath(id))
+	if os.IsNotExist(err) {
+		if e := os.Remove(st.layoutPath(id, st.otherLayout())); !os.IsNotExist(e) {
+			err = e
+		}
+	}
+	if err == nil {
+		atomic.AddInt64(&st.count, -1)
+	}
+	return err
 }
 
 // GetBlock returns a block with the given id if it exists.  It loads the type
 // and size from the file then closes the file.
 func (st *FileRawDevice) GetBlock(id []byte) (block.Block, error) {
-	ap := st.abspath(id)
-	uri := block.NewURI("file://" + ap)
-	return block.LoadFileDataBlock(uri, st.hasher)
+	// Retried once in case the block was moved by a migration in between
+	for i := 0; i < 2; i++ {
+		ap, ok := st.locate(id)
+		if !ok {
+			break
+		}
+		uri := block.NewURI("file://" + ap)
+		blk, err := block.LoadFileDataBlock(uri, block.SelectHasher(id, st.hasher))
+		if err != block.ErrBlockNotFound {
+			return blk, err
+		}
+	}
+	return nil, block.ErrBlockNotFound
 }
 
 // Exists stats the block file and returns whether it exists
 func (st *FileRawDevice) Exists(id []byte) bool {
-	ap := st.abspath(id)
-	if _, err := os.Stat(ap); err == nil {
-		return true
-	}
-	return false
+	_, ok := st.locate(id)
+	return ok
 }
 
 // SetBlock writes the block to the store. It gets a reader from the provided
 // Block, instantiates a new Block in the store and copies the data to the new
 // Block.  It returns the id i.e. hash of the newly written block.  It returns a
-// ErrBlockExists if the block exists along with the id.
+// ErrBlockExists if the block exists along with the id.  If the provided block
+// has a codec the data is stored encoded with it.
 func (st *FileRawDevice) SetBlock(blk block.Block) ([]byte, error) {
 	// if st.Exists(blk.ID()) {
 	// 	return blk.ID(), block.ErrBlockExists
@@ -107,9 +210,11 @@ func (st *FileRawDevice) SetBlock(blk block.Block) ([]byte, error) {
 		return nil, err
 	}
 
-	// New Block
+	// New Block hashed with the same function as the source so multihash ids of
+	// any algorithm are preserved
 	uri := block.NewURI("file://" + st.datadir)
-	dstBlk := block.NewFileDataBlock(uri, st.hasher)
+	dstBlk := block.NewFileDataBlock(uri, block.SelectHasher(blk.ID(), st.hasher))
+	dstBlk.SetCodec(block.BlockCodec(blk))
 	// Get dest. writer
 	dst, err := dstBlk.Writer()
 	if err != nil {
@@ -125,21 +230,101 @@ func (st *FileRawDevice) SetBlock(blk block.Block) ([]byte, error) {
 		return nil, err
 	}
 	src.Close()
-	err = dst.Close()
+	if err = dst.Close(); err == nil {
+		err = st.place(dstBlk)
+	}
 
 	log.Printf("[DEBUG] FileRawDevice.SetBlock id=%x size=%d error='%v'", dstBlk.ID(), dstBlk.Size(), err)
 
 	return dstBlk.ID(), err
 }
 
+// place moves a newly written block file from the data directory to its path in
+// the layout and counts it.  It returns ErrBlockExists if the block is already
+// stored in the other layout
+func (st *FileRawDevice) place(blk *block.FileDataBlock) error {
+	id := blk.ID()
+	flat := st.layoutPath(id, FileLayoutFlat)
+
+	if st.layout == FileLayoutFlat {
+		if _, err := os.Stat(st.layoutPath(id, FileLayoutFanout)); err == nil {
+			os.Remove(flat)
+			return block.ErrBlockExists
+		}
+		atomic.AddInt64(&st.count, 1)
+		return nil
+	}
+
+	p := st.abspath(id)
+	if _, err := os.Stat(p); err == nil {
+		os.Remove(flat)
+		return block.ErrBlockExists
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	// Moved by a concurrent migration if it no longer exists
+	if err := os.Rename(flat, p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	blk.URI().Path = p
+	atomic.AddInt64(&st.count, 1)
+	return nil
+}
+
 // Count returns the total number of blocks about the device
 func (st *FileRawDevice) Count() int {
-	list, err := ioutil.ReadDir(st.datadir)
-	if err == nil {
-		return len(list)
+	return int(atomic.LoadInt64(&st.count))
+}
+
+// Migrate moves all blocks stored in the other layout to the current one returning
+// the number of blocks moved.  It can be run while the device is in use.  Blocks
+// obtained before being moved must be retrieved again to be read.
+func (st *FileRawDevice) Migrate() (int, error) {
+	var moved int
+	fromFlat := st.layout != FileLayoutFlat
+	err := st.walk(fromFlat, !fromFlat, func(id []byte, p string) error {
+		np := st.abspath(id)
+		if np == p {
+			return nil
+		}
+
+		// Already stored in the current layout
+		if _, err := os.Stat(np); err == nil {
+			return os.Remove(p)
+		}
+		if err := os.MkdirAll(filepath.Dir(np), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(p, np); err != nil {
+			if os.IsNotExist(err) {
+				// Removed in the meantime
+				return nil
+			}
+			return err
+		}
+		moved++
+		return nil
+	})
+
+	if !fromFlat {
+		// Remove the emptied fan-out directories
+		readDirNames(st.datadir, func(name string) error {
+			if isFanoutDir(name) {
+				dir := filepath.Join(st.datadir, name)
+				readDirNames(dir, func(sub string) error {
+					os.Remove(filepath.Join(dir, sub))
+					return nil
+				})
+				os.Remove(dir)
+			}
+			return nil
+		})
 	}
 
-	return 0
+	log.Printf("[INFO] FileRawDevice migrated layout=%s blocks=%d error='%v'", st.layout, moved, err)
+	return moved, err
 }
 
 // ReleaseBlock marks a block to be released (eventually removed) from the store.
@@ -155,47 +340,86 @@ func (st *FileRawDevice) Count() int {
 // 	return errors.New("TBI")
 // }
 
-// IterIDs iterates over all block ids
+// IterIDs iterates over all block ids.  The directories are read in batches rather
+// than loading the full listing.
 func (st *FileRawDevice) IterIDs(f func(id []byte) error) error {
-	// Traverse in-mem blocks
-	//var i int
-	// st.mu.RLock()
-	// inMem := make([][]byte, len(st.buf))
-	// for k := range st.buf {
-	// 	inMem[i] = []byte(k)
-	// 	i++
-	// }
-	// st.mu.RUnlock()
-	//
-	// for _, v := range inMem {
-	// 	if err := f(v); err != nil {
-	// 		return err
-	// 	}
-	// }
+	return st.walk(true, true, func(id []byte, p string) error {
+		return f(id)
+	})
+}
 
-	// Traverse all block files
-	files, err := ioutil.ReadDir(st.datadir)
-	if err != nil {
-		return err
-	}
+// walk calls the function with the id and path of each block file stored directly
+// in the data directory and/or in the fan-out directories
+func (st *FileRawDevice) walk(flat, fanout bool, f func(id []byte, p string) error) error {
+	return readDirNames(st.datadir, func(name string) error {
+		p := filepath.Join(st.datadir, name)
 
-	for _, fl := range files {
-		if fl.IsDir() {
-			continue
+		if isFanoutDir(name) {
+			if !fanout {
+				return nil
+			}
+			return readDirNames(p, func(sub string) error {
+				if !isFanoutDir(sub) {
+					return nil
+				}
+				dir := filepath.Join(p, sub)
+				return readDirNames(dir, func(name string) error {
+					return walkFile(filepath.Join(dir, name), f)
+				})
+			})
 		}
 
-		id, er := hex.DecodeString(fl.Name())
-		if er != nil {
-			continue
+		if !flat {
+			return nil
 		}
+		return walkFile(p, f)
+	})
+}
 
-		if er := f(id); er != nil {
-			err = er
-			break
+// walkFile calls the function if the base name of the path is a block id
+func walkFile(p string, f func(id []byte, p string) error) error {
+	id, err := hex.DecodeString(filepath.Base(p))
+	if err != nil || len(id) < 2 {
+		return nil
+	}
+	return f(id, p)
+}
+
+// isFanoutDir returns true if the name is that of a fan-out directory
+func isFanoutDir(name string) bool {
+	if len(name) != 2 {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+// readDirNames calls the function with the name of each entry of the directory
+// reading it in batches.  A missing directory has no entries
+func readDirNames(dir string, f func(name string) error) error {
+	fh, err := os.Open(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
 		}
+		return err
 	}
+	defer fh.Close()
 
-	return err
+	for {
+		names, err := fh.Readdirnames(readDirBatch)
+		for _, name := range names {
+			if er := f(name); er != nil {
+				return er
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
 }
 
 // Iter iterates over blocks in theh store.  If an error is returned by the callback
@@ -244,3 +468,24 @@ func (st *FileRawDevice) IterIDs(f func(id []byte) error) error {
 func (st *FileRawDevice) Close() error {
 	return nil
 }
+
+// fileNewBlock is a block written to the data directory that is moved to its path
+// in the layout when its writer is closed
+type fileNewBlock struct {
+	*block.FileDataBlock
+	st *FileRawDevice
+}
+
+// Writer returns the block as the writer so it is placed on close
+func (blk *fileNewBlock) Writer() (io.WriteCloser, error) {
+	_, err := blk.FileDataBlock.Writer()
+	return blk, err
+}
+
+// Close closes the writer placing the block
+func (blk *fileNewBlock) Close() error {
+	if err := blk.FileDataBlock.Close(); err != nil {
+		return err
+	}
+	return blk.st.place(blk.FileDataBlock)
+}
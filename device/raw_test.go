@@ -183,3 +183,93 @@ func TestFileDataBlockStore(t *testing.T) {
 	}
 
 }
+
+func TestFileRawDevice_fanout(t *testing.T) {
+	df, _ := ioutil.TempDir(testdir, "data")
+	defer os.RemoveAll(df)
+
+	fbs, err := NewFileRawDevice(df, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeBlock := func(i int) []byte {
+		blk := fbs.NewBlock()
+		wr, _ := blk.Writer()
+		fmt.Fprintf(wr, "fanout block %d", i)
+		if err := wr.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return blk.ID()
+	}
+
+	ids := make([][]byte, 10)
+	for i := range ids {
+		ids[i] = writeBlock(i)
+	}
+	if fbs.Count() != len(ids) {
+		t.Fatal("wrong count", fbs.Count())
+	}
+
+	// Flat blocks are still found
+	fbs.SetLayout(FileLayoutFanout)
+	for _, id := range ids {
+		if _, err = fbs.GetBlock(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	n, err := fbs.Migrate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(ids) {
+		t.Fatal("wrong number migrated", n)
+	}
+	for _, id := range ids {
+		name := hex.EncodeToString(id)
+		if _, err = os.Stat(filepath.Join(df, name[:2], name[2:4], name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids = append(ids, writeBlock(len(ids)))
+	name := hex.EncodeToString(ids[len(ids)-1])
+	if _, err = os.Stat(filepath.Join(df, name[:2], name[2:4], name)); err != nil {
+		t.Fatal(err)
+	}
+	if err = fbs.RemoveBlock(ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	ids = ids[1:]
+
+	// Counted when reopened
+	if fbs, err = NewFileRawDevice(df, sha256.New); err != nil {
+		t.Fatal(err)
+	}
+	if fbs.Count() != len(ids) {
+		t.Fatal("wrong count", fbs.Count())
+	}
+	var count int
+	fbs.IterIDs(func(id []byte) error {
+		count++
+		return nil
+	})
+	if count != len(ids) {
+		t.Fatal("wrong iter count", count)
+	}
+
+	// And back
+	if n, err = fbs.Migrate(); err != nil || n != len(ids) {
+		t.Fatal("wrong number migrated", n, err)
+	}
+	list, _ := ioutil.ReadDir(df)
+	if len(list) != len(ids) {
+		t.Fatal("fan-out directories not removed", len(list))
+	}
+	for _, id := range ids {
+		if _, err = fbs.GetBlock(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package device
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+
+	"github.com/hexablock/blox/block"
+	"github.com/hexablock/blox/utils"
+)
+
+// Rehasher migrates all blocks of a device to a new hash function.  Blocks are
+// re-hashed in dependency order i.e. data blocks before the index, tree, HAMT and
+// meta blocks referencing them, with all references rewritten to the new ids.  The
+// re-hashed blocks are written to the destination device, leaving the source
+// untouched.  Metadata values containing the hex id of a source block are also
+// rewritten.
+type Rehasher struct {
+	src *BlockDevice
+	dst *BlockDevice
+
+	// New hash function
+	hasher func() hash.Hash
+
+	// Old to new id map
+	ids map[string][]byte
+}
+
+// NewRehasher inits a new Rehasher migrating blocks from src to dst using the
+// hasher.  The hasher would typically be a multihash hasher.
+func NewRehasher(src, dst *BlockDevice, hasher func() hash.Hash) *Rehasher {
+	return &Rehasher{
+		src:    src,
+		dst:    dst,
+		hasher: hasher,
+		ids:    make(map[string][]byte),
+	}
+}
+
+// Run re-hashes every block in the source device index
+func (r *Rehasher) Run() error {
+	// Collect ids first so the index is not locked while blocks are written
+	ids := make([][]byte, 0)
+	err := r.src.idx.Iter(func(ent *IndexEntry) error {
+		ids = append(ids, ent.ID())
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if _, err = r.rehash(id); err != nil {
+			return fmt.Errorf("rehash %x: %v", id, err)
+		}
+	}
+
+	return nil
+}
+
+// ID returns the new id of the block with the old id
+func (r *Rehasher) ID(old []byte) ([]byte, bool) {
+	id, ok := r.ids[string(old)]
+	return id, ok
+}
+
+// WriteMap writes the old to new id map as hex encoded old and new id pairs, one
+// per line sorted by the old id
+func (r *Rehasher) WriteMap(w io.Writer) error {
+	keys := make([]string, 0, len(r.ids))
+	for k := range r.ids {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	for _, k := range keys {
+		if _, err := fmt.Fprintf(bw, "%x %x\n", k, r.ids[k]); err != nil {
+			return err
+		}
+	}
+	return bw.Flush()
+}
+
+// rehash re-hashes the block with the id after re-hashing all blocks it references
+// and returns its new id
+func (r *Rehasher) rehash(id []byte) ([]byte, error) {
+	if nid, ok := r.ids[string(id)]; ok {
+		return nid, nil
+	}
+
+	blk, err := r.src.GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var nblk block.Block
+	switch b := blk.(type) {
+	case *block.IndexBlock:
+		nblk, err = r.rehashIndex(b)
+	case *block.TreeBlock:
+		nblk, err = r.rehashTree(b)
+	case *block.HAMTBlock:
+		nblk, err = r.rehashHAMT(b)
+	case *block.MetaBlock:
+		nblk, err = r.rehashMeta(b)
+	default:
+		if blk.Type() != block.BlockTypeData {
+			return nil, block.ErrInvalidBlockType
+		}
+		nblk, err = r.rehashData(blk)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nid, err := r.dst.SetBlock(nblk)
+	if err != nil && err != block.ErrBlockExists {
+		return nil, err
+	}
+
+	r.ids[string(id)] = nid
+	return nid, nil
+}
+
+func (r *Rehasher) rehashData(blk block.Block) (block.Block, error) {
+	rd, err := blk.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	nblk := block.NewMemDataBlock(nil, r.hasher)
+	nblk.SetCodec(block.BlockCodec(blk))
+
+	wr, _ := nblk.Writer()
+	if err = utils.CopyNAndCheck(wr, rd, int64(blk.Size())); err != nil {
+		return nil, err
+	}
+	err = wr.Close()
+
+	return nblk, err
+}
+
+func (r *Rehasher) rehashIndex(idx *block.IndexBlock) (block.Block, error) {
+	nidx := block.NewIndexBlock(nil, r.hasher)
+	nidx.SetBlockSize(idx.BlockSize())
+	nidx.SetReplicas(idx.Replicas())
+	nidx.SetHeight(idx.Height())
+
+	err := idx.IterEntries(func(index, offset, size uint64, id []byte) error {
+		nid, err := r.rehash(id)
+		if err == nil {
+			nidx.IndexBlock(index, nid, size)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nidx.Hash()
+	return nidx, nil
+}
+
+func (r *Rehasher) rehashTree(tree *block.TreeBlock) (block.Block, error) {
+	nodes := make([]*block.TreeNode, 0, tree.NodeCount())
+	err := tree.Iter(func(node *block.TreeNode) error {
+		nid, err := r.rehash(node.Address)
+		if err == nil {
+			nn := *node
+			nn.Address = nid
+			nodes = append(nodes, &nn)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ntree := block.NewTreeBlock(nil, r.hasher)
+	err = ntree.AddNodes(nodes...)
+	return ntree, err
+}
+
+func (r *Rehasher) rehashHAMT(h *block.HAMTBlock) (block.Block, error) {
+	nh := block.NewHAMTBlock(nil, r.hasher)
+	nh.SetDepth(h.Depth())
+	nh.SetCount(h.Count())
+
+	err := h.IterSlots(func(i int, slot *block.HAMTSlot) error {
+		nslot := &block.HAMTSlot{}
+		if slot.Child != nil {
+			nid, err := r.rehash(slot.Child)
+			if err != nil {
+				return err
+			}
+			nslot.Child = nid
+		}
+
+		for _, node := range slot.Nodes {
+			nid, err := r.rehash(node.Address)
+			if err != nil {
+				return err
+			}
+			nn := *node
+			nn.Address = nid
+			nslot.Nodes = append(nslot.Nodes, &nn)
+		}
+
+		nh.SetSlot(i, nslot)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	nh.Hash()
+	return nh, nil
+}
+
+func (r *Rehasher) rehashMeta(meta *block.MetaBlock) (block.Block, error) {
+	// Start from a copy to keep the value types and format of the original
+	nmeta := block.NewMetaBlock(nil, r.hasher)
+	if err := nmeta.UnmarshalBinary(meta.MarshalBinary()); err != nil {
+		return nil, err
+	}
+
+	if ref := meta.Reference(); len(ref) > 0 {
+		nid, err := r.rehash(ref)
+		if err != nil {
+			return nil, err
+		}
+		nmeta.SetReference(nid)
+	}
+
+	for _, k := range meta.Keys() {
+		v, ok := meta.GetString(k)
+		if !ok {
+			continue
+		}
+		if id, err := hex.DecodeString(v); err == nil && len(id) > 0 && r.src.idx.Exists(id) {
+			nid, err := r.rehash(id)
+			if err != nil {
+				return nil, err
+			}
+			nmeta.SetString(k, hex.EncodeToString(nid))
+		}
+	}
+
+	return nmeta, nil
+}
@@ -0,0 +1,124 @@
+package device
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func TestRehasher(t *testing.T) {
+	vt, err := newDevTester()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer vt.cleanup()
+
+	mh, _ := block.MultiHasher(block.HashCodeBlake2b256)
+	df, _ := ioutil.TempDir(testdir, "data")
+	defer os.RemoveAll(df)
+	raw, err := NewFileRawDevice(df, mh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := NewBlockDevice(NewInmemIndex(), raw)
+
+	// Inline and on disk data blocks referenced by an index, tree and meta block
+	idx := block.NewIndexBlock(nil, vt.hasher)
+	idx.SetBlockSize(8192)
+	for i, data := range [][]byte{testdata, bytes.Repeat(testdata, 500)} {
+		db := block.NewMemDataBlock(nil, vt.hasher)
+		wr, _ := db.Writer()
+		wr.Write(data)
+		wr.Close()
+		if _, err = vt.dev.SetBlock(db); err != nil {
+			t.Fatal(err)
+		}
+		idx.AddBlock(uint64(i), db)
+	}
+	idx.Hash()
+
+	tree := block.NewTreeBlock(nil, vt.hasher)
+	tree.AddNodes(block.NewFileTreeNode("file", idx.ID()))
+
+	meta := block.NewMetaBlock(nil, vt.hasher)
+	meta.SetReference(tree.ID())
+	meta.SetMetadata(map[string]string{"index": hex.EncodeToString(idx.ID())})
+
+	for _, blk := range []block.Block{idx, tree, meta} {
+		if _, err = vt.dev.SetBlock(blk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rh := NewRehasher(vt.dev, dst, mh)
+	if err = rh.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Stats().TotalBlocks != vt.dev.Stats().TotalBlocks {
+		t.Fatalf("block count mismatch %d != %d", dst.Stats().TotalBlocks, vt.dev.Stats().TotalBlocks)
+	}
+
+	// References are rewritten
+	nid, ok := rh.ID(meta.ID())
+	if !ok {
+		t.Fatal("meta block not migrated")
+	}
+	if code, _, err := block.DecodeMultihash(nid); err != nil || code != block.HashCodeBlake2b256 {
+		t.Fatalf("not a blake2b id %x", nid)
+	}
+	blk, err := dst.GetBlock(nid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ntid, _ := rh.ID(tree.ID())
+	nidx, _ := rh.ID(idx.ID())
+	if !bytes.Equal(blk.(*block.MetaBlock).Reference(), ntid) {
+		t.Fatal("meta reference not rewritten")
+	}
+
+	if blk.(*block.MetaBlock).Metadata()["index"] != hex.EncodeToString(nidx) {
+		t.Fatal("metadata id not rewritten")
+	}
+
+	blk, err = dst.GetBlock(ntid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _ := blk.(*block.TreeBlock).GetNodeByName("file")
+	if !bytes.Equal(node.Address, nidx) {
+		t.Fatal("tree node address not rewritten")
+	}
+
+	blk, err = dst.GetBlock(nidx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(blk.Hash(), nidx) {
+		t.Fatal("index id mismatch")
+	}
+	err = blk.(*block.IndexBlock).Iter(func(index uint64, id []byte) error {
+		dblk, err := dst.GetBlock(id)
+		if err == nil && !bytes.Equal(dblk.ID(), id) {
+			t.Errorf("data id mismatch %x != %x", dblk.ID(), id)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = rh.WriteMap(buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(rh.ids) {
+		t.Fatalf("map should have %d lines have %d", len(rh.ids), len(lines))
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"hash"
 
 	"github.com/hexablock/blox/block"
+	"github.com/hexablock/blox/device"
 )
 
 // NetDevice is a network BlockDevice. It allows to make direct block operations on a
@@ -47,6 +48,12 @@ func (dev *NetDevice) BlockExists(id []byte) (bool, error) {
 	return dev.client.BlockExists(dev.remote, id)
 }
 
+// Stats returns empty stats as device statistics are not available over the
+// network transport
+func (dev *NetDevice) Stats() *device.Stats {
+	return &device.Stats{}
+}
+
 // Close shutdowns the underlying network transport
 func (dev *NetDevice) Close() error {
 	dev.client.Shutdown()
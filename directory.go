@@ -0,0 +1,404 @@
+package blox
+
+import (
+	"sort"
+
+	"github.com/hexablock/blox/block"
+)
+
+// DefaultShardThreshold is the default number of entries above which a directory
+// is stored as a HAMT rather than a single TreeBlock
+const DefaultShardThreshold = 1024
+
+// directory is a read-only view of a directory stored either as a TreeBlock or as
+// the root of a HAMT
+type directory struct {
+	dev  BlockDevice
+	tree *block.TreeBlock
+	hamt *block.HAMTBlock
+}
+
+// openDirectory gets the TreeBlock or HAMT root block with the id from the device
+func openDirectory(dev BlockDevice, id []byte) (*directory, error) {
+	blk, err := dev.GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+
+	switch b := blk.(type) {
+	case *block.TreeBlock:
+		return &directory{dev: dev, tree: b}, nil
+	case *block.HAMTBlock:
+		if b.Depth() != 0 {
+			return nil, errNotTreeBlock
+		}
+		return &directory{dev: dev, hamt: b}, nil
+	}
+	return nil, errNotTreeBlock
+}
+
+// ID returns the id of the TreeBlock or HAMT root
+func (d *directory) ID() []byte {
+	if d.hamt != nil {
+		return d.hamt.ID()
+	}
+	return d.tree.ID()
+}
+
+// Type returns the block type of the directory
+func (d *directory) Type() block.BlockType {
+	if d.hamt != nil {
+		return block.BlockTypeHAMT
+	}
+	return block.BlockTypeTree
+}
+
+// Count returns the number of entries in the directory
+func (d *directory) Count() int {
+	if d.hamt != nil {
+		return int(d.hamt.Count())
+	}
+	return d.tree.NodeCount()
+}
+
+// Get returns the node with the name.  Only the HAMT blocks along the path to the
+// name are retrieved.
+func (d *directory) Get(name string) (*block.TreeNode, bool, error) {
+	if d.tree != nil {
+		node, ok := d.tree.GetNodeByName(name)
+		return node, ok, nil
+	}
+
+	h := d.hamt
+	for {
+		slot := h.Slot(block.HAMTSlotIndex(name, h.Depth()))
+		if slot == nil {
+			return nil, false, nil
+		}
+		if slot.Child == nil {
+			for _, node := range slot.Nodes {
+				if node.Name == name {
+					return node, true, nil
+				}
+			}
+			return nil, false, nil
+		}
+
+		var err error
+		if h, err = getHAMTBlock(d.dev, slot.Child); err != nil {
+			return nil, false, err
+		}
+	}
+}
+
+// Iter iterates over each node sorted by name
+func (d *directory) Iter(f func(*block.TreeNode) error) error {
+	if d.tree != nil {
+		return d.tree.Iter(f)
+	}
+
+	nodes := make([]*block.TreeNode, 0, d.hamt.Count())
+	err := iterHAMT(d.dev, d.hamt, func(node *block.TreeNode) error {
+		nodes = append(nodes, node)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	for _, node := range nodes {
+		if err = f(node); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Nodes returns all nodes by name
+func (d *directory) Nodes() (map[string]*block.TreeNode, error) {
+	nodes := make(map[string]*block.TreeNode, d.Count())
+	err := d.Iter(func(node *block.TreeNode) error {
+		nodes[node.Name] = node
+		return nil
+	})
+	return nodes, err
+}
+
+// iterHAMT iterates over all nodes of the HAMT in slot order
+func iterHAMT(dev BlockDevice, h *block.HAMTBlock, f func(*block.TreeNode) error) error {
+	return h.IterSlots(func(i int, slot *block.HAMTSlot) error {
+		if slot.Child == nil {
+			for _, node := range slot.Nodes {
+				if err := f(node); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		child, err := getHAMTBlock(dev, slot.Child)
+		if err != nil {
+			return err
+		}
+		return iterHAMT(dev, child, f)
+	})
+}
+
+// getHAMTBlock gets the block from the device ensuring it is a HAMT block
+func getHAMTBlock(dev BlockDevice, id []byte) (*block.HAMTBlock, error) {
+	blk, err := dev.GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+
+	h, ok := blk.(*block.HAMTBlock)
+	if !ok {
+		return nil, block.ErrInvalidBlockType
+	}
+	return h, nil
+}
+
+// dirWriter writes directories as a TreeBlock or a HAMT depending on the number of
+// entries.  The layout of a HAMT only depends on the entries it contains so the
+// same directory always has the same id however it was built.
+type dirWriter struct {
+	dev BlockDevice
+	// Entries above which a HAMT is used.  Less than 1 never uses a HAMT
+	threshold int
+}
+
+// useHAMT returns true if a directory with the number of entries is a HAMT
+func (dw *dirWriter) useHAMT(count int) bool {
+	return dw.threshold > 0 && count > dw.threshold
+}
+
+// write writes the nodes as a directory returning its id and block type
+func (dw *dirWriter) write(nodes []*block.TreeNode) ([]byte, block.BlockType, error) {
+	if !dw.useHAMT(len(nodes)) {
+		tree := block.NewTreeBlock(nil, dw.dev.Hasher())
+		if err := tree.AddNodes(nodes...); err != nil {
+			return nil, 0, err
+		}
+		id, err := dw.store(tree)
+		return id, block.BlockTypeTree, err
+	}
+
+	// Apply the same validation as a TreeBlock
+	names := make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		if err := block.ValidateNodeName(node.Name); err != nil {
+			return nil, 0, err
+		}
+		if _, ok := names[node.Name]; ok {
+			return nil, 0, block.ErrDuplicateNode
+		}
+		names[node.Name] = struct{}{}
+	}
+
+	h, err := dw.build(nodes, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := dw.store(h)
+	return id, block.BlockTypeHAMT, err
+}
+
+// update applies the changes to the directory returning the id and block type of
+// the new directory.  A nil node removes the name.  A node whose name differs from
+// its key is invalid.  Only the HAMT blocks along the paths to the changed names
+// are rewritten.
+func (dw *dirWriter) update(d *directory, changes map[string]*block.TreeNode) ([]byte, block.BlockType, error) {
+	// Nodes must be keyed by their name whatever the layout of the directory
+	for name, node := range changes {
+		if node == nil {
+			continue
+		}
+		if node.Name != name {
+			return nil, 0, errInvalidTreeOp
+		}
+		if err := block.ValidateNodeName(name); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	count := d.Count()
+	for name, node := range changes {
+		_, exists, err := d.Get(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		if node != nil && !exists {
+			count++
+		} else if node == nil && exists {
+			count--
+		}
+	}
+
+	if d.hamt == nil || !dw.useHAMT(count) {
+		nodes, err := d.Nodes()
+		if err != nil {
+			return nil, 0, err
+		}
+		list := make([]*block.TreeNode, 0, count)
+		for name, node := range nodes {
+			if _, ok := changes[name]; !ok {
+				list = append(list, node)
+			}
+		}
+		for _, node := range changes {
+			if node != nil {
+				list = append(list, node)
+			}
+		}
+		return dw.write(list)
+	}
+
+	h, err := dw.updateHAMT(d.hamt, changes)
+	if err != nil {
+		return nil, 0, err
+	}
+	id, err := dw.store(h)
+	return id, block.BlockTypeHAMT, err
+}
+
+// build builds the HAMT block at the depth containing the nodes.  Child blocks are
+// stored but the returned block is not.
+func (dw *dirWriter) build(nodes []*block.TreeNode, depth int) (*block.HAMTBlock, error) {
+	groups := make(map[int][]*block.TreeNode)
+	for _, node := range nodes {
+		i := block.HAMTSlotIndex(node.Name, depth)
+		groups[i] = append(groups[i], node)
+	}
+
+	h := block.NewHAMTBlock(nil, dw.dev.Hasher())
+	h.SetDepth(depth)
+	h.SetCount(uint64(len(nodes)))
+	for i, group := range groups {
+		slot, err := dw.nodeSlot(group, depth)
+		if err != nil {
+			return nil, err
+		}
+		h.SetSlot(i, slot)
+	}
+	h.Hash()
+
+	return h, nil
+}
+
+// updateHAMT applies the changes to the HAMT block returning the new block which is
+// not stored
+func (dw *dirWriter) updateHAMT(h *block.HAMTBlock, changes map[string]*block.TreeNode) (*block.HAMTBlock, error) {
+	depth := h.Depth()
+	groups := make(map[int]map[string]*block.TreeNode)
+	for name, node := range changes {
+		i := block.HAMTSlotIndex(name, depth)
+		if groups[i] == nil {
+			groups[i] = make(map[string]*block.TreeNode)
+		}
+		groups[i][name] = node
+	}
+
+	nh := block.NewHAMTBlock(nil, dw.dev.Hasher())
+	nh.SetDepth(depth)
+	h.IterSlots(func(i int, slot *block.HAMTSlot) error {
+		nh.SetSlot(i, slot)
+		return nil
+	})
+
+	count := int64(h.Count())
+	for i, group := range groups {
+		slot := h.Slot(i)
+
+		var (
+			nslot *block.HAMTSlot
+			delta int64
+			err   error
+		)
+		if slot != nil && slot.Child != nil {
+			child, err := getHAMTBlock(dw.dev, slot.Child)
+			if err != nil {
+				return nil, err
+			}
+			nchild, err := dw.updateHAMT(child, group)
+			if err != nil {
+				return nil, err
+			}
+			delta = int64(nchild.Count()) - int64(child.Count())
+			if nslot, err = dw.childSlot(nchild); err != nil {
+				return nil, err
+			}
+
+		} else {
+			nodes := make([]*block.TreeNode, 0)
+			if slot != nil {
+				for _, node := range slot.Nodes {
+					if _, ok := group[node.Name]; !ok {
+						nodes = append(nodes, node)
+					}
+				}
+				delta -= int64(len(slot.Nodes))
+			}
+			for _, node := range group {
+				if node != nil {
+					nodes = append(nodes, node)
+				}
+			}
+			delta += int64(len(nodes))
+			if nslot, err = dw.nodeSlot(nodes, depth); err != nil {
+				return nil, err
+			}
+		}
+
+		nh.SetSlot(i, nslot)
+		count += delta
+	}
+
+	nh.SetCount(uint64(count))
+	nh.Hash()
+	return nh, nil
+}
+
+// nodeSlot returns the slot holding the nodes at the depth.  If there are too many
+// nodes they are moved to a new child block.
+func (dw *dirWriter) nodeSlot(nodes []*block.TreeNode, depth int) (*block.HAMTSlot, error) {
+	if len(nodes) == 0 {
+		return nil, nil
+	}
+	if len(nodes) <= block.HAMTBucketSize || depth == block.MaxHAMTDepth {
+		return &block.HAMTSlot{Nodes: nodes}, nil
+	}
+
+	child, err := dw.build(nodes, depth+1)
+	if err != nil {
+		return nil, err
+	}
+	id, err := dw.store(child)
+	return &block.HAMTSlot{Child: id}, err
+}
+
+// childSlot returns the slot pointing to the child block storing it.  A child with
+// few enough nodes is collapsed into the slot.
+func (dw *dirWriter) childSlot(child *block.HAMTBlock) (*block.HAMTSlot, error) {
+	if child.Count() > block.HAMTBucketSize {
+		id, err := dw.store(child)
+		return &block.HAMTSlot{Child: id}, err
+	}
+
+	nodes := make([]*block.TreeNode, 0, child.Count())
+	err := iterHAMT(dw.dev, child, func(node *block.TreeNode) error {
+		nodes = append(nodes, node)
+		return nil
+	})
+	if err != nil || len(nodes) == 0 {
+		return nil, err
+	}
+	return &block.HAMTSlot{Nodes: nodes}, nil
+}
+
+func (dw *dirWriter) store(blk block.Block) ([]byte, error) {
+	if _, err := dw.dev.SetBlock(blk); err != nil && err != block.ErrBlockExists {
+		return nil, err
+	}
+	return blk.ID(), nil
+}
@@ -0,0 +1,312 @@
+package blox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func writeManyFiles(t *testing.T, dir string, from, to int) {
+	os.MkdirAll(dir, 0755)
+	for i := from; i < to; i++ {
+		p := filepath.Join(dir, fmt.Sprintf("file-%04d", i))
+		if err := ioutil.WriteFile(p, []byte(fmt.Sprintf("content %d", i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func Test_Blox_ShardedDirectory(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+	bx.SetShardThreshold(100)
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeTestTree(t, src)
+	writeManyFiles(t, filepath.Join(src, "big"), 0, 300)
+
+	root, err := bx.WriteTree(src, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := bx.Stat(root, "big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Type != block.BlockTypeHAMT || !info.IsDir() {
+		t.Fatal("big should be sharded", info.Type)
+	}
+	if info, err = bx.Stat(root, "sub"); err != nil || info.Type != block.BlockTypeTree {
+		t.Fatal("sub should not be sharded", err)
+	}
+
+	for _, i := range []int{0, 123, 299} {
+		p := fmt.Sprintf("big/file-%04d", i)
+		node, blk, err := bx.Resolve(root, p)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		if node.Name != filepath.Base(p) || blk.Type() != block.BlockTypeIndex {
+			t.Fatal("wrong node", node.Name)
+		}
+	}
+	if _, err = bx.Stat(root, "big/missing"); err != ErrPathNotFound {
+		t.Fatalf(errCheckStr, ErrPathNotFound, err)
+	}
+
+	// Restore
+	dst, _ := ioutil.TempDir(testdir, "dst")
+	defer os.RemoveAll(dst)
+	if err = bx.ReadTree(root, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := ioutil.ReadDir(filepath.Join(dst, "big"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 300 {
+		t.Fatal("entry count mismatch", len(entries))
+	}
+	data, _ := ioutil.ReadFile(filepath.Join(dst, "big", "file-0042"))
+	if string(data) != "content 42" {
+		t.Fatal("content mismatch", string(data))
+	}
+
+	// Updates give the same ids as writing the same content
+	idx, err := bx.WriteIndex(ioutil.NopCloser(bytes.NewReader([]byte("content 300"))), 1)
+	if err != nil && err != block.ErrBlockExists {
+		t.Fatal(err)
+	}
+	node := block.NewFileTreeNode("", idx.ID())
+	node.Mode = 0644
+	updated, err := bx.UpdateTree(root,
+		PutOp("big/file-0300", node),
+		DeleteOp("big/file-0007"),
+		RenameOp("a.txt", "big/a.txt"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeManyFiles(t, filepath.Join(src, "big"), 300, 301)
+	os.Remove(filepath.Join(src, "big", "file-0007"))
+	os.Rename(filepath.Join(src, "a.txt"), filepath.Join(src, "big", "a.txt"))
+	expected, err := bx.WriteTree(src, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(updated, expected) {
+		t.Fatalf("updated id mismatch %x != %x", updated, expected)
+	}
+
+	changes, err := bx.DiffTrees(root, updated, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 4 {
+		t.Fatal("should have 4 changes", len(changes))
+	}
+
+	// Shrinking below the threshold converts back to a TreeBlock
+	ops := make([]TreeOp, 0)
+	for i := 0; i < 250; i++ {
+		if i != 7 {
+			ops = append(ops, DeleteOp(fmt.Sprintf("big/file-%04d", i)))
+		}
+	}
+	shrunk, err := bx.UpdateTree(updated, ops...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err = bx.Stat(shrunk, "big"); err != nil || info.Type != block.BlockTypeTree {
+		t.Fatal("big should not be sharded", err)
+	}
+
+	// Growing a TreeBlock past the threshold converts it to a HAMT
+	grown, err := bx.UpdateTree(shrunk, RenameOp("big", "sub/big"), PutOp("sub/big/x", node))
+	if err != nil {
+		t.Fatal(err)
+	}
+	regrown := make([]TreeOp, 0)
+	for i := 0; i < 60; i++ {
+		regrown = append(regrown, PutOp(fmt.Sprintf("sub/big/y%d", i), node))
+	}
+	if grown, err = bx.UpdateTree(grown, regrown...); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = bx.Stat(grown, "sub/big"); err != nil || info.Type != block.BlockTypeHAMT {
+		t.Fatal("sub/big should be sharded", err)
+	}
+	if _, err = bx.Stat(grown, "sub/big/y59"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_Blox_MergeShardedDirectory(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+	bx.SetShardThreshold(50)
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeManyFiles(t, filepath.Join(src, "big"), 0, 120)
+
+	base, err := bx.WriteTree(src, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ours, err := bx.UpdateTree(base, DeleteOp("big/file-0001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := bx.UpdateTree(base, RenameOp("big/file-0002", "big/renamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, conflicts, err := bx.MergeTrees(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Fatal("should not conflict", conflicts)
+	}
+
+	expected, err := bx.UpdateTree(ours, RenameOp("big/file-0002", "big/renamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, expected) {
+		t.Fatalf("merged id mismatch %x != %x", merged, expected)
+	}
+}
+
+// hamtCounter counts the HAMT blocks retrieved from the device
+type hamtCounter struct {
+	BlockDevice
+	gets int
+}
+
+func (hc *hamtCounter) GetBlock(id []byte) (block.Block, error) {
+	blk, err := hc.BlockDevice.GetBlock(id)
+	if err == nil && blk.Type() == block.BlockTypeHAMT {
+		hc.gets++
+	}
+	return blk, err
+}
+
+func Test_Blox_DiffShardedDirectory(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+	bx.SetShardThreshold(50)
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeManyFiles(t, filepath.Join(src, "big"), 0, 1000)
+
+	base, err := bx.WriteTree(src, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ours, err := bx.UpdateTree(base, DeleteOp("big/file-0001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := bx.UpdateTree(base, RenameOp("big/file-0002", "big/renamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hc := &hamtCounter{BlockDevice: bx.dev}
+	bx.dev = hc
+
+	changes, err := bx.DiffTrees(base, ours, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Type != ChangeRemoved || changes[0].Path != "big/file-0001" {
+		t.Fatalf("wrong changes %+v", changes)
+	}
+
+	// Total HAMT blocks of the directory
+	info, _ := bx.Stat(base, "big")
+	d, _ := openDirectory(hc.BlockDevice, info.ID)
+	total := 1
+	var count func(h *block.HAMTBlock)
+	count = func(h *block.HAMTBlock) {
+		h.IterSlots(func(i int, slot *block.HAMTSlot) error {
+			if slot.Child != nil {
+				total++
+				child, _ := getHAMTBlock(hc.BlockDevice, slot.Child)
+				count(child)
+			}
+			return nil
+		})
+	}
+	count(d.hamt)
+	if hc.gets >= total/2 {
+		t.Fatalf("unchanged HAMT blocks walked gets=%d total=%d", hc.gets, total)
+	}
+
+	hc.gets = 0
+	merged, conflicts, err := bx.MergeTrees(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Fatal("should not conflict", conflicts)
+	}
+	if hc.gets >= total {
+		t.Fatalf("unchanged HAMT blocks walked gets=%d total=%d", hc.gets, total)
+	}
+
+	bx.dev = hc.BlockDevice
+	expected, err := bx.UpdateTree(ours, RenameOp("big/file-0002", "big/renamed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, expected) {
+		t.Fatalf("merged id mismatch %x != %x", merged, expected)
+	}
+}
+
+func Test_dirWriter_updateName(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+	bx.SetShardThreshold(50)
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeManyFiles(t, filepath.Join(src, "small"), 0, 10)
+	writeManyFiles(t, filepath.Join(src, "big"), 0, 100)
+
+	root, err := bx.WriteTree(src, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dw := bx.dirWriter()
+	for _, name := range []string{"small", "big"} {
+		info, err := bx.Stat(root, name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		d, err := openDirectory(bx.dev, info.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node, _, _ := d.Get("file-0001")
+		changes := map[string]*block.TreeNode{"renamed": node}
+		if _, _, err = dw.update(d, changes); err != errInvalidTreeOp {
+			t.Fatal(name, "should fail", err)
+		}
+	}
+}
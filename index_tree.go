@@ -0,0 +1,138 @@
+package blox
+
+import (
+	"errors"
+
+	"github.com/hexablock/blox/block"
+)
+
+// DefaultIndexFanout is the default max number of entries in a single index
+// block.  With the default block size a single index covers 4GB of data.
+const DefaultIndexFanout = 4096
+
+var errNotIndexBlock = errors.New("not an index block")
+
+// indexTreeBuilder builds a tree of index blocks with a bounded fanout from an
+// ordered stream of data blocks.  Index blocks are written to the device as soon
+// as they are full so only a single index block per tree level is held in memory.
+type indexTreeBuilder struct {
+	dev BlockDevice
+
+	// Template for the settings of each new index block
+	tmpl *block.IndexBlock
+
+	// Max entries per index.  0 means unbounded
+	fanout int
+
+	// Index block currently being filled at each level.  Index 0 holds data blocks
+	levels []*block.IndexBlock
+}
+
+func newIndexTreeBuilder(dev BlockDevice, tmpl *block.IndexBlock, fanout int) *indexTreeBuilder {
+	return &indexTreeBuilder{dev: dev, tmpl: tmpl, fanout: fanout}
+}
+
+func (b *indexTreeBuilder) newIndex(height int) *block.IndexBlock {
+	idx := block.NewIndexBlock(nil, b.dev.Hasher())
+	idx.SetBlockSize(b.tmpl.BlockSize())
+	idx.SetReplicas(b.tmpl.Replicas())
+	idx.SetHeight(uint8(height))
+	return idx
+}
+
+// add appends the block to the index at the given level.  A full index is only
+// flushed once an additional entry arrives so that the root never has a single
+// entry.
+func (b *indexTreeBuilder) add(level int, id []byte, size uint64) error {
+	if level == len(b.levels) {
+		b.levels = append(b.levels, b.newIndex(level))
+	}
+
+	idx := b.levels[level]
+	if b.fanout > 0 && idx.BlockCount() >= b.fanout {
+		if err := b.flush(level); err != nil {
+			return err
+		}
+		idx = b.levels[level]
+	}
+
+	idx.IndexBlock(uint64(idx.BlockCount()), id, size)
+	return nil
+}
+
+// flush writes the index at the level to the device, adds it to its parent and
+// starts a new index at the level
+func (b *indexTreeBuilder) flush(level int) error {
+	idx := b.levels[level]
+	idx.Hash()
+
+	if _, err := b.dev.SetBlock(idx); err != nil && err != block.ErrBlockExists {
+		return err
+	}
+
+	b.levels[level] = b.newIndex(level)
+	return b.add(level+1, idx.ID(), idx.FileSize())
+}
+
+// finish flushes all partially filled levels and returns the root index.  The root
+// index is not written to the device.
+func (b *indexTreeBuilder) finish() (*block.IndexBlock, error) {
+	if len(b.levels) == 0 {
+		b.levels = append(b.levels, b.newIndex(0))
+	}
+
+	for i := 0; i < len(b.levels)-1; i++ {
+		if b.levels[i].BlockCount() == 0 {
+			continue
+		}
+		if err := b.flush(i); err != nil {
+			return nil, err
+		}
+	}
+
+	root := b.levels[len(b.levels)-1]
+	root.Hash()
+	return root, nil
+}
+
+// iterIndexTree walks the index tree rooted at idx in order issuing the callback
+// with the sequential index, and id of each data block.  Child index blocks are
+// retrieved from the device as they are reached.
+func iterIndexTree(dev BlockDevice, idx *block.IndexBlock, f func(index uint64, id []byte) error) error {
+	var i uint64
+	return walkIndexTree(dev, idx, func(id []byte) error {
+		err := f(i, id)
+		i++
+		return err
+	})
+}
+
+func walkIndexTree(dev BlockDevice, idx *block.IndexBlock, f func(id []byte) error) error {
+	if idx.Height() == 0 {
+		return idx.Iter(func(index uint64, id []byte) error {
+			return f(id)
+		})
+	}
+
+	return idx.Iter(func(index uint64, id []byte) error {
+		child, err := getIndexBlock(dev, id)
+		if err != nil {
+			return err
+		}
+		return walkIndexTree(dev, child, f)
+	})
+}
+
+// getIndexBlock gets the block from the device ensuring it is an index block
+func getIndexBlock(dev BlockDevice, id []byte) (*block.IndexBlock, error) {
+	blk, err := dev.GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+
+	idx, ok := blk.(*block.IndexBlock)
+	if !ok {
+		return nil, errNotIndexBlock
+	}
+	return idx, nil
+}
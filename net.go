@@ -111,9 +111,16 @@ func (trans *NetTransport) listen() {
 	log.Println("[INFO] Network transport shutdown!")
 }
 
-func (trans *NetTransport) setBlockServe(id []byte, conn *protoConn) (bool, error) {
+func (trans *NetTransport) setBlockServe(req *request, conn *protoConn) (bool, error) {
+	id := req.Hash
 	//log.Printf("[DEBUG] Server SetBlock block=%x", id)
 
+	// The request flags contain the codec the block should be stored with
+	codec, err := block.GetCodec(block.CodecType(req.Flags))
+	if err != nil {
+		return false, err
+	}
+
 	// If we already have the block, simply return
 	if ok, _ := trans.dev.BlockExists(id); ok {
 		return false, block.ErrBlockExists
@@ -137,7 +144,8 @@ func (trans *NetTransport) setBlockServe(id []byte, conn *protoConn) (bool, erro
 	// source address
 	us := "tcp://" + conn.RemoteAddr().String() + "/" + hex.EncodeToString(id)
 	uri := block.NewURI(us)
-	netblk := block.NewStreamedBlock(typ, uri, trans.hasher, conn, size)
+	netblk := block.NewStreamedBlock(typ, uri, block.SelectHasher(id, trans.hasher), conn, size)
+	netblk.SetCodec(codec)
 	nid, err := trans.dev.SetBlock(netblk)
 	if err != nil {
 		//log.Printf("[ERROR] setBlockServe %v", err)
@@ -228,7 +236,7 @@ func (trans *NetTransport) handleConn(conn *protoConn) {
 	// Request handler loop
 	for {
 		// Get request
-		req, err := conn.readRequest(trans.blockHashSize)
+		req, err := conn.readRequest()
 		if err != nil {
 			if err != io.EOF {
 				log.Println("[ERROR] Reading request:", err)
@@ -256,7 +264,7 @@ func (trans *NetTransport) handleConn(conn *protoConn) {
 			}
 
 		case reqTypeSet:
-			disconnect, err = trans.setBlockServe(req.Hash, conn)
+			disconnect, err = trans.setBlockServe(req, conn)
 
 		default:
 			log.Printf("[ERROR] Invalid request client=%s op=%x id=%x", caddr, req.Type, req.Hash)
@@ -54,12 +54,9 @@ func DefaultNetClientOptions(hasher func() hash.Hash) NetClientOptions {
 
 // NetClient is a network client to perform block operations remotely
 type NetClient struct {
-	// Hash function to use
+	// Hash function to use for ids that are not multihashes
 	hasher func() hash.Hash
 
-	// hash size calculated internally
-	blockHashSize int
-
 	// Outbound connection pool
 	reapInterval time.Duration
 	pool         *outPool
@@ -69,10 +66,9 @@ type NetClient struct {
 // connection reap interval and hash size of ids
 func NewNetClient(opt NetClientOptions) *NetClient {
 	client := &NetClient{
-		pool:          newOutPool(opt.Timeout, opt.MaxIdle),
-		reapInterval:  opt.ReapInterval,
-		hasher:        opt.Hasher,
-		blockHashSize: opt.Hasher().Size(),
+		pool:         newOutPool(opt.Timeout, opt.MaxIdle),
+		reapInterval: opt.ReapInterval,
+		hasher:       opt.Hasher,
 	}
 
 	go client.reap()
@@ -82,7 +78,7 @@ func NewNetClient(opt NetClientOptions) *NetClient {
 
 // BlockExists returns true if the block exists on a remote host
 func (trans *NetClient) BlockExists(host string, id []byte) (bool, error) {
-	if len(id) != trans.blockHashSize {
+	if len(id) == 0 || len(id) > maxIDSize {
 		return false, block.ErrInvalidBlock
 	}
 
@@ -116,7 +112,7 @@ func (trans *NetClient) BlockExists(host string, id []byte) (bool, error) {
 
 // GetBlock makes a GetBlock request to the remote host.
 func (trans *NetClient) GetBlock(host string, id []byte) (block.Block, error) {
-	if len(id) != trans.blockHashSize {
+	if len(id) == 0 || len(id) > maxIDSize {
 		return nil, block.ErrInvalidBlock
 	}
 
@@ -149,12 +145,12 @@ func (trans *NetClient) GetBlock(host string, id []byte) (block.Block, error) {
 	if typ == block.BlockTypeData {
 		// Return the new Block with the conn attached as the reader that can be read later.
 		uri := block.NewURI("tcp://" + host + "/" + hex.EncodeToString(id))
-		strBlk := block.NewStreamedBlock(typ, uri, trans.hasher, conn, size)
+		strBlk := block.NewStreamedBlock(typ, uri, block.SelectHasher(id, trans.hasher), conn, size)
 		netBlk := &NetBlock{StreamedBlock: strBlk, pool: trans.pool, conn: conn}
 		return netBlk, nil
 	}
 
-	blk, err := block.New(typ, nil, trans.hasher)
+	blk, err := block.New(typ, nil, block.SelectHasher(id, trans.hasher))
 	if err != nil {
 		//trans.pool.returnConn(conn)
 		conn.Close()
@@ -188,10 +184,12 @@ func (trans *NetClient) SetBlock(host string, blk block.Block) ([]byte, error) {
 		return nil, err
 	}
 
-	// Write request
+	// Write request.  The flags contain the codec the block should be stored with.
+	// The data itself is sent decoded.
 	//log.Printf("NetClient.SetBlock request op=%d id=%x", reqTypeSet, blk.ID())
 	id := blk.ID()
-	if err = writeHeaderAndID(conn, Header{reqTypeSet, 0}, id); err != nil {
+	codec := block.CodecTypeOf(block.BlockCodec(blk))
+	if err = writeHeaderAndID(conn, Header{reqTypeSet, byte(codec)}, id); err != nil {
 		conn.Close()
 		return nil, err
 	}
@@ -235,8 +233,7 @@ func (trans *NetClient) SetBlock(host string, blk block.Block) ([]byte, error) {
 	}
 
 	// Confirmation hash id
-	cid := make([]byte, trans.blockHashSize)
-	_, err = conn.Read(cid)
+	cid, err := conn.readID()
 	if err == nil {
 		if bytes.Compare(cid, blk.ID()) != 0 {
 			err = fmt.Errorf("id mismatch %x != %x", cid, blk.ID())
@@ -13,6 +13,8 @@ import (
 const (
 	maxFrameSize uint64 = 0xFFFFFFFFFFFFFFFF
 	headerSize   uint8  = 2
+	// Ids are prefixed with a single byte length on the wire
+	maxIDSize = 0xFF
 )
 
 // Header is an arbitrary header for future purposes.
@@ -132,13 +134,31 @@ func (conn *protoConn) readResponseHeader() error {
 }
 
 // readRequest reads the op and id for the request made by a client
-//func (conn *protoConn) readRequest(hashSize int) (byte, []byte, error) {
-func (conn *protoConn) readRequest(hashSize int) (*request, error) {
-	raw := make([]byte, 2+hashSize)
+func (conn *protoConn) readRequest() (*request, error) {
+	hdr := make([]byte, headerSize)
+	if _, err := io.ReadFull(conn, hdr); err != nil {
+		return nil, err
+	}
+
+	id, err := conn.readID()
+	if err != nil {
+		return nil, err
+	}
+
+	return &request{Type: hdr[0], Flags: hdr[1], Hash: id}, nil
+}
 
-	if _, err := io.ReadFull(conn, raw); err != nil {
+// readID reads a length prefixed id
+func (conn *protoConn) readID() ([]byte, error) {
+	sz := make([]byte, 1)
+	if _, err := io.ReadFull(conn, sz); err != nil {
 		return nil, err
 	}
+	if sz[0] == 0 {
+		return nil, block.ErrInvalidBlock
+	}
 
-	return &request{Type: raw[0], Flags: raw[1], Hash: raw[2:]}, nil
+	id := make([]byte, sz[0])
+	_, err := io.ReadFull(conn, id)
+	return id, err
 }
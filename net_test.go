@@ -2,6 +2,7 @@ package blox
 
 import (
 	"bytes"
+	"io/ioutil"
 	"strings"
 	"testing"
 
@@ -158,6 +159,76 @@ func TestNetTransport(t *testing.T) {
 	// 	t.Fatal("should fail with", block.ErrBlockNotFound, err)
 	// }
 
+	mb := block.NewMetaBlock(nil, ts2.hasher)
+	mb.SetReference(sid)
+	mb.SetMetadata(map[string]string{"name": "test"})
+	mid, err := ts2.trans.SetBlock(ts1.addr(), mb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(mb.ID(), mid) != 0 {
+		t.Fatal("id mismatch")
+	}
+	rmb, err := ts2.trans.GetBlock(ts1.addr(), mid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Compare(rmb.ID(), mid) != 0 {
+		t.Fatalf("id mismatch want=%x have=%x", mid, rmb.ID())
+	}
+	if bytes.Compare(rmb.(*block.MetaBlock).Reference(), sid) != 0 {
+		t.Fatal("reference mismatch")
+	}
+
+	// The codec is carried over the network
+	cb := block.NewMemDataBlock(nil, ts2.hasher)
+	cb.SetCodec(&block.DeflateCodec{Level: 9})
+	wr, _ = cb.Writer()
+	wr.Write(bytes.Repeat([]byte("compressible"), 1024))
+	wr.Close()
+	if _, err = ts2.trans.SetBlock(ts1.addr(), cb); err != nil {
+		t.Fatal(err)
+	}
+	rcb, err := ts1.rdev.GetBlock(cb.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block.CodecTypeOf(block.BlockCodec(rcb)) != block.CodecTypeDeflate {
+		t.Fatal("block should be stored with the deflate codec")
+	}
+
+	// Multihash ids of different lengths live side by side with the default ids
+	for _, code := range []block.HashCode{block.HashCodeSHA512, block.HashCodeBlake2b256} {
+		mh, _ := block.MultiHasher(code)
+		for _, data := range [][]byte{[]byte("inline"), bytes.Repeat([]byte("x"), 8192)} {
+			mblk := block.NewMemDataBlock(nil, mh)
+			wr, _ = mblk.Writer()
+			wr.Write(data)
+			wr.Close()
+
+			mhid, err := ts2.trans.SetBlock(ts1.addr(), mblk)
+			if err != nil {
+				t.Fatal(code, err)
+			}
+			if bytes.Compare(mhid, mblk.ID()) != 0 {
+				t.Fatalf("%s id mismatch %x != %x", code, mhid, mblk.ID())
+			}
+			rblk, err := ts2.trans.GetBlock(ts1.addr(), mhid)
+			if err != nil {
+				t.Fatal(code, err)
+			}
+			rd, _ := rblk.Reader()
+			got, err := ioutil.ReadAll(rd)
+			rblk.(*NetBlock).Close()
+			if err != nil {
+				t.Fatal(code, err)
+			}
+			if bytes.Compare(got, data) != 0 {
+				t.Fatalf("%s data mismatch", code)
+			}
+		}
+	}
+
 	if err = ts2.trans.RemoveBlock(ts1.addr(), sid); err != nil {
 		t.Fatal(err)
 	}
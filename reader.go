@@ -0,0 +1,276 @@
+package blox
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+	"sync/atomic"
+
+	"github.com/hexablock/blox/block"
+)
+
+// DefaultReaderCacheSize is the default number of blocks cached by a FileReader
+const DefaultReaderCacheSize = 8
+
+var (
+	errReaderClosed  = errors.New("reader closed")
+	errInvalidWhence = errors.New("invalid whence")
+	errNegativeSeek  = errors.New("negative position")
+)
+
+// FileReader provides random access to the data of a stored index.  It maps
+// offsets to blocks walking the index tree and only retrieves the blocks needed
+// to satisfy a read.  Recently used index and data blocks are cached.  It
+// implements io.ReadSeeker, io.ReaderAt and io.Closer.  ReadAt is safe for
+// concurrent use.
+type FileReader struct {
+	dev BlockDevice
+
+	// Root index
+	root *block.IndexBlock
+
+	// Current position for Read and Seek
+	mu  sync.Mutex
+	pos int64
+
+	// Set to 1 once the reader is closed
+	closed int32
+
+	// Cached index and data blocks
+	cache *blockCache
+}
+
+// NewFileReader inits a new FileReader for the root index caching up to
+// cacheSize blocks
+func NewFileReader(dev BlockDevice, root *block.IndexBlock, cacheSize int) *FileReader {
+	return &FileReader{
+		dev:   dev,
+		root:  root,
+		cache: newBlockCache(cacheSize),
+	}
+}
+
+// Open returns a FileReader for the index with the given id
+func (blox *Blox) Open(id []byte) (*FileReader, error) {
+	root, err := getIndexBlock(blox.dev, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFileReader(blox.dev, root, DefaultReaderCacheSize), nil
+}
+
+// Size returns the total size of the data
+func (fr *FileReader) Size() int64 {
+	return int64(fr.root.FileSize())
+}
+
+// Read reads from the current position advancing it by the bytes read
+func (fr *FileReader) Read(p []byte) (int, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	n, err := fr.ReadAt(p, fr.pos)
+	fr.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek sets the position for the next Read
+func (fr *FileReader) Seek(offset int64, whence int) (int64, error) {
+	if atomic.LoadInt32(&fr.closed) == 1 {
+		return 0, errReaderClosed
+	}
+
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = fr.pos + offset
+	case io.SeekEnd:
+		pos = fr.Size() + offset
+	default:
+		return 0, errInvalidWhence
+	}
+
+	if pos < 0 {
+		return 0, errNegativeSeek
+	}
+
+	fr.pos = pos
+	return pos, nil
+}
+
+// ReadAt reads len(p) bytes starting at the offset.  It returns io.EOF if fewer
+// bytes are available.
+func (fr *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	if atomic.LoadInt32(&fr.closed) == 1 {
+		return 0, errReaderClosed
+	}
+	if off < 0 {
+		return 0, errNegativeSeek
+	}
+
+	size := fr.Size()
+	var n int
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= size {
+			return n, io.EOF
+		}
+
+		data, start, err := fr.blockAt(uint64(pos))
+		if err != nil {
+			return n, err
+		}
+
+		if uint64(pos)-start >= uint64(len(data)) {
+			return n, block.ErrInvalidBlock
+		}
+		n += copy(p[n:], data[uint64(pos)-start:])
+	}
+
+	return n, nil
+}
+
+// Close releases all cached blocks.  The reader cannot be used once closed.
+func (fr *FileReader) Close() error {
+	atomic.StoreInt32(&fr.closed, 1)
+	fr.cache.purge()
+	return nil
+}
+
+// blockAt returns the data of the block containing the offset along with the
+// offset at which the block starts
+func (fr *FileReader) blockAt(off uint64) ([]byte, uint64, error) {
+	var (
+		idx   = fr.root
+		start uint64
+	)
+
+	for {
+		i, ok := idx.Locate(off - start)
+		if !ok {
+			return nil, 0, fmt.Errorf("offset not indexed: %d", off)
+		}
+		id, eoff, _, _ := idx.Entry(i)
+		start += eoff
+
+		if idx.Height() == 0 {
+			data, err := fr.getData(id)
+			return data, start, err
+		}
+
+		child, err := fr.getIndex(id)
+		if err != nil {
+			return nil, 0, err
+		}
+		idx = child
+	}
+}
+
+func (fr *FileReader) getIndex(id []byte) (*block.IndexBlock, error) {
+	if val, ok := fr.cache.get(id); ok {
+		return val.(*block.IndexBlock), nil
+	}
+
+	idx, err := getIndexBlock(fr.dev, id)
+	if err == nil {
+		fr.cache.add(id, idx)
+	}
+	return idx, err
+}
+
+func (fr *FileReader) getData(id []byte) ([]byte, error) {
+	if val, ok := fr.cache.get(id); ok {
+		return val.([]byte), nil
+	}
+
+	blk, err := fr.dev.GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+
+	rd, err := blk.Reader()
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(rd)
+	rd.Close()
+
+	if err == nil {
+		fr.cache.add(id, data)
+	}
+	return data, err
+}
+
+// blockCache is a thread-safe LRU cache of blocks keyed by id
+type blockCache struct {
+	mu    sync.Mutex
+	size  int
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key string
+	val interface{}
+}
+
+func newBlockCache(size int) *blockCache {
+	if size < 1 {
+		size = 1
+	}
+	return &blockCache{
+		size:  size,
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (c *blockCache) get(id []byte) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[string(id)]; ok {
+		c.ll.MoveToFront(el)
+		return el.Value.(*cacheEntry).val, true
+	}
+	return nil, false
+}
+
+func (c *blockCache) add(id []byte, val interface{}) {
+	k := string(id)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[k]; ok {
+		c.ll.MoveToFront(el)
+		el.Value.(*cacheEntry).val = val
+		return
+	}
+
+	c.items[k] = c.ll.PushFront(&cacheEntry{key: k, val: val})
+	if c.ll.Len() > c.size {
+		el := c.ll.Back()
+		c.ll.Remove(el)
+		delete(c.items, el.Value.(*cacheEntry).key)
+	}
+}
+
+func (c *blockCache) purge() {
+	c.mu.Lock()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.mu.Unlock()
+}
@@ -0,0 +1,97 @@
+package blox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"testing"
+
+	"github.com/hexablock/blox/device"
+)
+
+func Test_FileReader(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "reader-")
+	defer os.RemoveAll(tmpdir)
+
+	d, err := device.NewFileRawDevice(tmpdir, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewBlockDevice(device.NewInmemIndex(), d)
+
+	data := make([]byte, 300*1024)
+	rnd := rand.New(rand.NewSource(5))
+	rnd.Read(data)
+
+	chunker, _ := NewCDCChunker(2048, 8192, 32768)
+	sharder := NewStreamSharder(dev, 3)
+	sharder.SetChunker(chunker)
+	sharder.SetFanout(4)
+	if err = sharder.Shard(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	root := sharder.IndexBlock()
+	if _, err = dev.SetBlock(root); err != nil {
+		t.Fatal(err)
+	}
+
+	bx := NewBlox(dev)
+	fr, err := bx.Open(root.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fr.Close()
+
+	if fr.Size() != int64(len(data)) {
+		t.Fatal("size mismatch", fr.Size())
+	}
+
+	// Random ranges
+	for i := 0; i < 50; i++ {
+		off := rnd.Int63n(int64(len(data)))
+		p := make([]byte, rnd.Intn(40000)+1)
+		n, err := fr.ReadAt(p, off)
+		if err != nil && err != io.EOF {
+			t.Fatal(err)
+		}
+		if err == io.EOF && off+int64(len(p)) <= int64(len(data)) {
+			t.Fatal("unexpected EOF", off, len(p))
+		}
+		if !bytes.Equal(p[:n], data[off:off+int64(n)]) {
+			t.Fatalf("data mismatch offset=%d size=%d", off, len(p))
+		}
+	}
+
+	// Seek and read to the end
+	if _, err = fr.Seek(-1000, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tail, data[len(data)-1000:]) {
+		t.Fatal("tail mismatch")
+	}
+
+	if _, err = fr.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	all, err := ioutil.ReadAll(fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(all, data) {
+		t.Fatal("data mismatch")
+	}
+
+	if _, err = fr.Seek(-1, io.SeekStart); err == nil {
+		t.Fatal("should fail with negative position")
+	}
+	if _, err = fr.ReadAt(make([]byte, 1), int64(len(data))); err != io.EOF {
+		t.Fatal("should fail with EOF", err)
+	}
+}
@@ -0,0 +1,134 @@
+package blox
+
+import (
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/hexablock/blox/block"
+)
+
+// ErrPathNotFound is used when a path does not exist in a tree
+var ErrPathNotFound = errors.New("path not found")
+
+// NodeInfo describes a resolved path in a tree
+type NodeInfo struct {
+	// Base name of the path.  Empty for the root
+	Name string
+	// Id of the index or tree block the path points to
+	ID []byte
+	// Type of block the path points to
+	Type block.BlockType
+	// Mode of the file or directory
+	Mode os.FileMode
+	// Size of the file data.  For directories this is the size of the TreeBlock or
+	// HAMT root block
+	Size uint64
+	// Modification time if recorded in the tree
+	ModTime time.Time
+}
+
+// IsDir returns true if the path is a directory
+func (info *NodeInfo) IsDir() bool {
+	return info.Type == block.BlockTypeTree || info.Type == block.BlockTypeHAMT
+}
+
+// Resolve walks the slash separated path starting at the root directory.  It
+// returns the TreeNode of the target along with the block it points to.  Only the
+// TreeBlocks, or HAMT blocks of sharded directories, along the path are
+// retrieved.  An empty path or "/" resolves to the root itself.  ErrPathNotFound
+// is returned if a segment does not exist and ErrNotDirectory if a non-final
+// segment is not a directory.
+func (blox *Blox) Resolve(root []byte, p string) (*block.TreeNode, block.Block, error) {
+	node, err := blox.resolveNode(root, p)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	blk, err := blox.dev.GetBlock(node.Address)
+	if err != nil {
+		return nil, nil, err
+	}
+	return node, blk, nil
+}
+
+// resolveNode walks the path returning the TreeNode of the target without
+// retrieving the block it points to
+func (blox *Blox) resolveNode(root []byte, p string) (*block.TreeNode, error) {
+	d, err := openDirectory(blox.dev, root)
+	if err != nil {
+		return nil, err
+	}
+
+	node := block.NewDirTreeNode("", root)
+	node.Type = d.Type()
+	segs := splitPath(p)
+	for i, seg := range segs {
+		var ok bool
+		if node, ok, err = d.Get(seg); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, ErrPathNotFound
+		}
+
+		// Last segment
+		if i == len(segs)-1 {
+			break
+		}
+
+		if !node.IsDir() {
+			return nil, ErrNotDirectory
+		}
+		if d, err = openDirectory(blox.dev, node.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	return node, nil
+}
+
+// Stat resolves the path starting at the root directory and returns information
+// about it.  The file size is taken from the recorded attributes if present,
+// otherwise from the FileSize of its index.
+func (blox *Blox) Stat(root []byte, p string) (*NodeInfo, error) {
+	node, err := blox.resolveNode(root, p)
+	if err != nil {
+		return nil, err
+	}
+
+	info := &NodeInfo{
+		Name: node.Name,
+		ID:   node.Address,
+		Type: node.Type,
+		Mode: node.Mode,
+	}
+	if node.Attrs != nil {
+		info.ModTime = node.Attrs.ModTime
+		if node.Type == block.BlockTypeIndex {
+			info.Size = node.Attrs.Size
+			return info, nil
+		}
+	}
+
+	blk, err := blox.dev.GetBlock(node.Address)
+	if err != nil {
+		return nil, err
+	}
+	info.Size = blk.Size()
+	if idx, ok := blk.(*block.IndexBlock); ok {
+		info.Size = idx.FileSize()
+	}
+
+	return info, nil
+}
+
+// splitPath cleans the slash separated path and returns its segments
+func splitPath(p string) []string {
+	p = strings.Trim(path.Clean("/"+p), "/")
+	if p == "" {
+		return nil
+	}
+	return strings.Split(p, "/")
+}
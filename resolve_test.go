@@ -0,0 +1,79 @@
+package blox
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func Test_Blox_Resolve(t *testing.T) {
+	ts, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.cleanup()
+	defer ts.trans.Shutdown()
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	files := writeTestTree(t, src)
+
+	root, err := NewBlox(ts.dev).WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Resolve over the network
+	netdev := NewNetDevice(ts.addr(), DefaultNetClientOptions(ts.hasher))
+	defer netdev.Close()
+	bx := NewBlox(netdev)
+
+	for _, p := range []string{"sub/deep/c.bin", "/sub/deep/c.bin", "sub/./deep/../deep/c.bin"} {
+		info, err := bx.Stat(root, p)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		if info.Name != "c.bin" || info.IsDir() {
+			t.Fatalf("%s wrong node %+v", p, info)
+		}
+		if info.Size != uint64(len(files["sub/deep/c.bin"])) {
+			t.Fatalf("%s size mismatch want=%d have=%d", p, len(files["sub/deep/c.bin"]), info.Size)
+		}
+	}
+
+	node, blk, err := bx.Resolve(root, "sub/deep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Type != block.BlockTypeTree || blk.Type() != block.BlockTypeTree {
+		t.Fatal("should be a tree")
+	}
+	if _, ok := blk.(*block.TreeBlock).GetNodeByName("dup"); !ok {
+		t.Fatal("dup should exist")
+	}
+
+	info, err := bx.Stat(root, "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.IsDir() || string(info.ID) != string(root) {
+		t.Fatal("should resolve to the root")
+	}
+
+	info, err = bx.Stat(root, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode.Perm() != 0600 {
+		t.Fatal("wrong mode", info.Mode)
+	}
+
+	if _, err = bx.Stat(root, "sub/missing"); err != ErrPathNotFound {
+		t.Fatalf(errCheckStr, ErrPathNotFound, err)
+	}
+	if _, err = bx.Stat(root, "a.txt/foo"); err != ErrNotDirectory {
+		t.Fatalf(errCheckStr, ErrNotDirectory, err)
+	}
+}
@@ -37,6 +37,20 @@ type StreamSharder struct {
 	// Block device used to store blocks
 	dev BlockDevice
 
+	// Chunker used to split the stream.  If nil fixed size chunks of the index
+	// block size are used
+	chunker Chunker
+
+	// Max entries per index block.  Larger streams produce a tree of index blocks
+	fanout int
+
+	// Codec data blocks are stored with.  If nil blocks are stored as is
+	codec block.Codec
+
+	// Optional transform applied to the data of each shard before it is written
+	// as a block.  It must preserve the size of the data.
+	transform func(index uint64, data []byte) ([]byte, error)
+
 	// shard run time
 	runtime time.Duration
 }
@@ -48,6 +62,7 @@ func NewStreamSharder(dev BlockDevice, numRoutines int) *StreamSharder {
 		dev:         dev,
 		numRoutines: numRoutines,
 		idx:         block.NewIndexBlock(nil, dev.Hasher()),
+		fanout:      DefaultIndexFanout,
 	}
 	if sh.numRoutines < 1 {
 		sh.numRoutines = 1
@@ -55,7 +70,9 @@ func NewStreamSharder(dev BlockDevice, numRoutines int) *StreamSharder {
 	return sh
 }
 
-// IndexBlock returns the index block os the shard stream
+// IndexBlock returns the index block os the shard stream.  For streams with more
+// blocks than the fanout this is the root of the index tree.  The root is not
+// written to the device.
 func (sh *StreamSharder) IndexBlock() *block.IndexBlock {
 	return sh.idx
 }
@@ -66,11 +83,35 @@ func (sh *StreamSharder) Runtime() time.Duration {
 }
 
 // SetBlockSize sets the block size for the sharder.  This should be called
-// before Shard is called in order to take affect
+// before Shard is called in order to take affect.  It is only used when no
+// Chunker has been set.
 func (sh *StreamSharder) SetBlockSize(blockSize uint64) {
 	sh.idx.SetBlockSize(blockSize)
 }
 
+// SetChunker sets the Chunker used to split the stream into blocks.  The index
+// block size is set to the max chunk size.  This should be called before Shard is
+// called in order to take affect
+func (sh *StreamSharder) SetChunker(chunker Chunker) {
+	sh.chunker = chunker
+	sh.idx.SetBlockSize(chunker.BlockSize())
+}
+
+// SetFanout sets the max number of entries in a single index block.  Streams with
+// more blocks produce a tree of index blocks whose non-root members are written to
+// the device.  A fanout of 0 produces a single index block.  This should be called
+// before Shard is called in order to take affect
+func (sh *StreamSharder) SetFanout(fanout int) {
+	sh.fanout = fanout
+}
+
+// SetCodec sets the codec data blocks are stored with.  The ids of the blocks are
+// not affected by the codec.  This should be called before Shard is called in
+// order to take affect
+func (sh *StreamSharder) SetCodec(codec block.Codec) {
+	sh.codec = codec
+}
+
 // Shard starts sharding a given stream.  It returns an IndexBlock or an error
 func (sh *StreamSharder) Shard(rd io.ReadCloser) error {
 	start := time.Now()
@@ -81,7 +122,12 @@ func (sh *StreamSharder) Shard(rd io.ReadCloser) error {
 	done := make(chan struct{})
 	defer close(done)
 
-	shards, errc := generateShards(done, rd, sh.idx.BlockSize())
+	chunker := sh.chunker
+	if chunker == nil {
+		chunker = NewFixedChunker(sh.idx.BlockSize())
+	}
+
+	shards, errc := generateShards(done, rd, chunker)
 
 	// Start a fixed number of goroutines to read
 	c := make(chan result)
@@ -102,14 +148,31 @@ func (sh *StreamSharder) Shard(rd io.ReadCloser) error {
 	}()
 	// End of pipeline.
 
-	// Read results and update index
+	// Read results and add them to the index tree in order
+	var (
+		tree    = newIndexTreeBuilder(sh.dev, sh.idx, sh.fanout)
+		next    uint64
+		pending = make(map[uint64]result)
+	)
 	for r := range c {
 
 		if r.err != nil {
 			return r.err
 		}
 
-		sh.idx.IndexBlock(r.idx, r.id, r.size)
+		pending[r.idx] = r
+		for {
+			rslt, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+
+			if err := tree.add(0, rslt.id, rslt.size); err != nil {
+				return err
+			}
+		}
 
 	}
 
@@ -118,22 +181,34 @@ func (sh *StreamSharder) Shard(rd io.ReadCloser) error {
 		return err
 	}
 
-	// Generate id
-	sh.idx.Hash()
+	// Generate root index and its id
+	root, err := tree.finish()
+	if err == nil {
+		sh.idx = root
+	}
 
-	return nil
+	return err
 }
 
 func (sh *StreamSharder) newBlockFromShard(shrd *shard) (block.Block, error) {
+	data := shrd.Data
+	if sh.transform != nil {
+		var err error
+		if data, err = sh.transform(shrd.Index, data); err != nil {
+			return nil, err
+		}
+	}
+
+	blk := block.NewMemDataBlock(nil, sh.dev.Hasher())
+	blk.SetCodec(sh.codec)
 
-	blk := block.NewDataBlock(nil, sh.dev.Hasher())
 	wr, err := blk.Writer()
 	if err != nil {
 		return nil, err
 	}
 
 	// Write the data
-	if _, err = wr.Write(shrd.Data); err != nil {
+	if _, err = wr.Write(data); err != nil {
 		wr.Close()
 		return nil, err
 	}
@@ -175,8 +250,8 @@ func (sh *StreamSharder) consume(done <-chan struct{}, shards <-chan shard, c ch
 	}
 }
 
-// generate shards from a ReadCloser
-func generateShards(done <-chan struct{}, rd io.ReadCloser, blockSize uint64) (<-chan shard, <-chan error) {
+// generate shards from a ReadCloser using the chunker to split the stream
+func generateShards(done <-chan struct{}, rd io.ReadCloser, chunker Chunker) (<-chan shard, <-chan error) {
 	chunks := make(chan shard)
 	errc := make(chan error, 1)
 
@@ -187,28 +262,23 @@ func generateShards(done <-chan struct{}, rd io.ReadCloser, blockSize uint64) (<
 		defer fh.Close()
 
 		var (
-			i   uint64
-			buf = make([]byte, blockSize)
-			eof bool
+			i      uint64
+			offset uint64
+			cr     = chunker.NewReader(fh)
 		)
 
 		for {
 
-			n, err := io.ReadFull(fh, buf)
+			data, err := cr.Next()
 			if err != nil {
 				if err == io.EOF {
 					break
-				} else if err == io.ErrUnexpectedEOF {
-					eof = true
-				} else {
-					errc <- err
-					return
 				}
-
+				errc <- err
+				return
 			}
 
-			sh := shard{Data: make([]byte, n), Index: i, Offset: i * blockSize}
-			copy(sh.Data, buf[:n])
+			sh := shard{Data: data, Index: i, Offset: offset}
 
 			select {
 			case chunks <- sh:
@@ -217,10 +287,7 @@ func generateShards(done <-chan struct{}, rd io.ReadCloser, blockSize uint64) (<
 				return
 			}
 
-			if eof {
-				break
-			}
-
+			offset += uint64(len(data))
 			i++
 		}
 
@@ -1,11 +1,14 @@
 package blox
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"io/ioutil"
+	"math/rand"
 	"os"
 	"testing"
 
+	"github.com/hexablock/blox/block"
 	"github.com/hexablock/blox/device"
 )
 
@@ -76,3 +79,160 @@ func Test_StreamSharder(t *testing.T) {
 	}
 	//t.Log(s1.Name())
 }
+
+func Test_StreamSharder_CDC(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "sharder-")
+	defer os.RemoveAll(tmpdir)
+
+	d, err := device.NewFileRawDevice(tmpdir, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewBlockDevice(device.NewInmemIndex(), d)
+
+	data := make([]byte, 512*1024)
+	rand.New(rand.NewSource(3)).Read(data)
+
+	chunker, _ := NewCDCChunker(4096, 16384, 65536)
+	bx := NewBlox(dev)
+	bx.SetChunker(chunker)
+
+	idx, err := bx.WriteIndex(ioutil.NopCloser(bytes.NewReader(data)), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if idx.FileSize() != uint64(len(data)) {
+		t.Fatalf("file size mismatch %d != %d", idx.FileSize(), len(data))
+	}
+	if idx.BlockSize() != chunker.Max {
+		t.Fatal("block size should be the max chunk size")
+	}
+
+	// Index block read back from the device
+	blk, err := dev.GetBlock(idx.ID())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if blk.(*block.IndexBlock).BlockCount() != idx.BlockCount() {
+		t.Fatalf("block count mismatch %d != %d", blk.(*block.IndexBlock).BlockCount(), idx.BlockCount())
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = bx.ReadIndex(idx.ID(), buf, 3); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data mismatch")
+	}
+}
+
+func Test_StreamSharder_IndexTree(t *testing.T) {
+	tmpdir, _ := ioutil.TempDir("/tmp", "sharder-")
+	defer os.RemoveAll(tmpdir)
+
+	d, err := device.NewFileRawDevice(tmpdir, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewBlockDevice(device.NewInmemIndex(), d)
+
+	// 25 blocks with a fanout of 4 gives a tree of height 2
+	data := make([]byte, 25*1024-100)
+	rand.New(rand.NewSource(4)).Read(data)
+
+	sharder := NewStreamSharder(dev, 3)
+	sharder.SetBlockSize(1024)
+	sharder.SetFanout(4)
+	if err = sharder.Shard(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+
+	root := sharder.IndexBlock()
+	if root.Height() != 2 {
+		t.Fatalf("height want=2 have=%d", root.Height())
+	}
+	if root.FileSize() != uint64(len(data)) {
+		t.Fatalf("file size mismatch %d != %d", root.FileSize(), len(data))
+	}
+	if root.BlockCount() > 4 {
+		t.Fatal("root exceeds fanout", root.BlockCount())
+	}
+	if _, err = dev.SetBlock(root); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	bx := NewBlox(dev)
+	if err = bx.ReadIndex(root.ID(), buf, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data mismatch")
+	}
+
+	// Exactly fanout blocks should produce a single index
+	sharder = NewStreamSharder(dev, 3)
+	sharder.SetBlockSize(1024)
+	sharder.SetFanout(4)
+	if err = sharder.Shard(ioutil.NopCloser(bytes.NewReader(data[:4096]))); err != nil {
+		t.Fatal(err)
+	}
+	if sharder.IndexBlock().Height() != 0 || sharder.IndexBlock().BlockCount() != 4 {
+		t.Fatal("should be a single index")
+	}
+}
+
+func Test_StreamSharder_codec(t *testing.T) {
+	ts, err := newTestServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ts.cleanup()
+
+	data := bytes.Repeat([]byte("compressible-data-"), 4096)
+
+	bx := NewBlox(ts.dev)
+	bx.SetCodec(&block.GzipCodec{Level: 9})
+	bx.SetChunker(NewFixedChunker(16384))
+
+	idx, err := bx.WriteIndex(ioutil.NopCloser(bytes.NewReader(data)), 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Same ids as an uncompressed index
+	plain := NewStreamSharder(ts.dev, 2)
+	plain.SetBlockSize(16384)
+	if err = plain.Shard(ioutil.NopCloser(bytes.NewReader(data))); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(plain.IndexBlock().ID(), idx.ID()) {
+		t.Fatal("index id mismatch")
+	}
+
+	// Stored data blocks are encoded
+	var stored int64
+	ts.rdev.IterIDs(func(id []byte) error {
+		blk, er := ts.rdev.GetBlock(id)
+		if er != nil {
+			return er
+		}
+		if block.CodecTypeOf(blk.(*block.FileDataBlock).Codec()) != block.CodecTypeGzip {
+			t.Errorf("block not encoded %x", id)
+		}
+		stat, _ := os.Stat(blk.URI().Path)
+		stored += stat.Size()
+		return nil
+	})
+	if stored == 0 || stored >= int64(len(data)) {
+		t.Fatalf("data not compressed stored=%d", stored)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err = bx.ReadIndex(idx.ID(), buf, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf.Bytes(), data) {
+		t.Fatal("data mismatch")
+	}
+}
@@ -0,0 +1,364 @@
+package blox
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"time"
+
+	"github.com/hexablock/blox/block"
+)
+
+// ImportTar reads the tar stream and writes it to blox storage returning the id of
+// the root directory.  File content is sharded with a StreamSharder as it is read.
+// Modes, modification times, symbolic links and hard links are preserved.
+// Ownership, sizes and xattrs are also recorded if enabled with SetTreeAttrs.
+// Missing parent directories are created and later entries replace earlier ones
+// with the same path.  Entries other than regular files, directories and links
+// are skipped.
+func (blox *Blox) ImportTar(rd io.Reader) ([]byte, error) {
+	ti := &tarImporter{
+		blox:  blox,
+		root:  newTarDir(),
+		links: make(map[*tarEntry]bool),
+	}
+
+	tr := tar.NewReader(rd)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		if err = ti.add(hdr, tr); err != nil {
+			return nil, fmt.Errorf("%s: %v", hdr.Name, err)
+		}
+	}
+
+	ti.resolveLinks()
+
+	id, _, err := ti.write(ti.root)
+	return id, err
+}
+
+// tarEntry is an imported entry.  Directories have their child entries set.
+type tarEntry struct {
+	node *block.TreeNode
+	// Child entries by name of a directory
+	dir map[string]*tarEntry
+	// Path segments of the entry and of the file a hard link points to
+	segs []string
+	link []string
+}
+
+func newTarDir() *tarEntry {
+	return &tarEntry{dir: make(map[string]*tarEntry)}
+}
+
+type tarImporter struct {
+	blox *Blox
+	root *tarEntry
+	// Hard links
+	links map[*tarEntry]bool
+}
+
+// parent returns the parent directory of the path segments creating missing
+// directories
+func (ti *tarImporter) parent(segs []string) *tarEntry {
+	dir := ti.root
+	for i, seg := range segs[:len(segs)-1] {
+		ent, ok := dir.dir[seg]
+		if !ok || ent.dir == nil {
+			ent = newTarDir()
+			ent.node = block.NewDirTreeNode(seg, nil)
+			ent.node.Mode = os.ModeDir | 0755
+			ent.segs = segs[:i+1]
+			dir.dir[seg] = ent
+		}
+		dir = ent
+	}
+	return dir
+}
+
+// get returns the entry at the path segments
+func (ti *tarImporter) get(segs []string) (*tarEntry, bool) {
+	ent := ti.root
+	for _, seg := range segs {
+		if ent.dir == nil {
+			return nil, false
+		}
+		var ok bool
+		if ent, ok = ent.dir[seg]; !ok {
+			return nil, false
+		}
+	}
+	return ent, true
+}
+
+func (ti *tarImporter) add(hdr *tar.Header, rd io.Reader) error {
+	segs := splitPath(hdr.Name)
+	if len(segs) == 0 {
+		// Root directory
+		return nil
+	}
+	name := segs[len(segs)-1]
+	if err := block.ValidateNodeName(name); err != nil {
+		return err
+	}
+
+	ent := &tarEntry{segs: segs}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		ent.node = block.NewDirTreeNode(name, nil)
+		// Keep the contents of an existing directory
+		if prev, ok := ti.get(segs); ok && prev.dir != nil {
+			ent.dir = prev.dir
+		} else {
+			ent.dir = make(map[string]*tarEntry)
+		}
+
+	case tar.TypeReg, tar.TypeRegA:
+		idx, err := ti.blox.WriteIndex(ioutil.NopCloser(rd), runtime.NumCPU())
+		if err != nil && err != block.ErrBlockExists {
+			return err
+		}
+		ent.node = block.NewFileTreeNode(name, idx.ID())
+
+	case tar.TypeSymlink:
+		id, err := ti.blox.writeData([]byte(hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		ent.node = block.NewSymlinkTreeNode(name, id)
+
+	case tar.TypeLink:
+		target, ok := ti.get(splitPath(hdr.Linkname))
+		if !ok || target.node.Type != block.BlockTypeIndex {
+			return fmt.Errorf("hard link target not found: %s", hdr.Linkname)
+		}
+		ent.node = block.NewFileTreeNode(name, target.node.Address)
+		ent.link = target.segs
+		if target.link != nil {
+			ent.link = target.link
+		}
+		ti.links[ent] = true
+
+	default:
+		return nil
+	}
+
+	fi := hdr.FileInfo()
+	ent.node.Mode = fi.Mode()
+	if ti.blox.attrs {
+		ent.node.Attrs = tarAttrs(hdr)
+	} else if hdr.ModTime.Unix() != 0 {
+		// Only the time.  The epoch is what entries without a time are exported with
+		ent.node.Attrs = &block.NodeAttrs{ModTime: hdr.ModTime.UTC()}
+	}
+
+	ti.parent(segs).dir[name] = ent
+	return nil
+}
+
+// resolveLinks makes the first link of each hard linked file in tree order the
+// file the others link to, as is done when writing a directory, so they can be
+// restored in order.  Links whose file has been replaced are left as plain files.
+func (ti *tarImporter) resolveLinks() {
+	groups := make(map[string][]*tarEntry)
+	for ent := range ti.links {
+		target, ok := ti.get(ent.link)
+		if !ok || target.node.Type != block.BlockTypeIndex ||
+			string(target.node.Address) != string(ent.node.Address) {
+			continue
+		}
+		// Only entries still in the tree
+		if cur, ok := ti.get(ent.segs); !ok || cur != ent {
+			continue
+		}
+		key := path.Join(ent.link...)
+		if groups[key] == nil {
+			groups[key] = []*tarEntry{target}
+		}
+		groups[key] = append(groups[key], ent)
+	}
+
+	for _, group := range groups {
+		sort.Slice(group, func(i, j int) bool { return segsLess(group[i].segs, group[j].segs) })
+
+		first := path.Join(group[0].segs...)
+		group[0].node.Link = ""
+		for _, ent := range group[1:] {
+			ent.node.Link = first
+		}
+	}
+}
+
+// write writes the directory entry bottom-up returning its id and type
+func (ti *tarImporter) write(dir *tarEntry) ([]byte, block.BlockType, error) {
+	nodes := make([]*block.TreeNode, 0, len(dir.dir))
+	for _, ent := range dir.dir {
+		if ent.dir != nil {
+			id, typ, err := ti.write(ent)
+			if err != nil {
+				return nil, 0, err
+			}
+			ent.node.Address = id
+			ent.node.Type = typ
+		}
+		nodes = append(nodes, ent.node)
+	}
+	return ti.blox.dirWriter().write(nodes)
+}
+
+func tarAttrs(hdr *tar.Header) *block.NodeAttrs {
+	attrs := &block.NodeAttrs{
+		ModTime: hdr.ModTime.UTC(),
+		UID:     uint32(hdr.Uid),
+		GID:     uint32(hdr.Gid),
+	}
+	if hdr.Typeflag == tar.TypeReg || hdr.Typeflag == tar.TypeRegA {
+		attrs.Size = uint64(hdr.Size)
+	}
+	if len(hdr.Xattrs) > 0 {
+		attrs.Xattrs = make(map[string][]byte, len(hdr.Xattrs))
+		for k, v := range hdr.Xattrs {
+			attrs.Xattrs[k] = []byte(v)
+		}
+	}
+	return attrs
+}
+
+// segsLess returns true if the path a comes before b in tree order
+func segsLess(a, b []string) bool {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return len(a) < len(b)
+}
+
+// ExportTar writes the tree with the root id to the writer as a tar stream.  The
+// output is deterministic i.e. the same tree always produces the same bytes.
+// Entries are written depth first sorted by name with each directory before its
+// contents.  Times, ownership and xattrs are taken from the recorded attributes,
+// with the unix epoch and root ownership used when not recorded.  Hard links are
+// written as links if the file they link to has been written.
+func (blox *Blox) ExportTar(root []byte, wr io.Writer) error {
+	d, err := openDirectory(blox.dev, root)
+	if err != nil {
+		return err
+	}
+
+	te := &tarExporter{
+		blox:  blox,
+		tw:    tar.NewWriter(wr),
+		files: make(map[string]bool),
+	}
+	if err = te.writeDir(d, ""); err != nil {
+		return err
+	}
+	return te.tw.Close()
+}
+
+type tarExporter struct {
+	blox *Blox
+	tw   *tar.Writer
+	// Regular files written by path
+	files map[string]bool
+}
+
+func (te *tarExporter) writeDir(d *directory, dir string) error {
+	return d.Iter(func(node *block.TreeNode) error {
+		if err := block.ValidateNodeName(node.Name); err != nil {
+			return err
+		}
+		p := path.Join(dir, node.Name)
+
+		hdr, err := tar.FileInfoHeader(&nodeFileInfo{node: node}, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = p
+		if attrs := node.Attrs; attrs != nil {
+			hdr.Uid = int(attrs.UID)
+			hdr.Gid = int(attrs.GID)
+			if len(attrs.Xattrs) > 0 {
+				hdr.Xattrs = make(map[string]string, len(attrs.Xattrs))
+				for k, v := range attrs.Xattrs {
+					hdr.Xattrs[k] = string(v)
+				}
+			}
+		}
+
+		switch {
+		case node.IsDir():
+			sub, err := openDirectory(te.blox.dev, node.Address)
+			if err != nil {
+				return err
+			}
+			hdr.Name += "/"
+			if err = te.tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			return te.writeDir(sub, p)
+
+		case node.Type == block.BlockTypeIndex:
+			if node.Link != "" && te.files[path.Clean(node.Link)] {
+				hdr.Typeflag = tar.TypeLink
+				hdr.Linkname = path.Clean(node.Link)
+				hdr.Size = 0
+				return te.tw.WriteHeader(hdr)
+			}
+
+			idx, err := getIndexBlock(te.blox.dev, node.Address)
+			if err != nil {
+				return err
+			}
+			hdr.Size = int64(idx.FileSize())
+			if err = te.tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if err = te.blox.ReadIndex(node.Address, te.tw, runtime.NumCPU()); err != nil {
+				return err
+			}
+			te.files[p] = true
+			return nil
+
+		case node.Type == block.BlockTypeData && node.IsSymlink():
+			target, err := te.blox.readData(node.Address)
+			if err != nil {
+				return err
+			}
+			hdr.Linkname = string(target)
+			return te.tw.WriteHeader(hdr)
+		}
+
+		return block.ErrInvalidBlockType
+	})
+}
+
+// nodeFileInfo implements os.FileInfo for a TreeNode
+type nodeFileInfo struct {
+	node *block.TreeNode
+}
+
+func (fi *nodeFileInfo) Name() string      { return fi.node.Name }
+func (fi *nodeFileInfo) Mode() os.FileMode { return fi.node.Mode }
+func (fi *nodeFileInfo) IsDir() bool       { return fi.node.IsDir() }
+func (fi *nodeFileInfo) Sys() interface{}  { return nil }
+func (fi *nodeFileInfo) Size() int64       { return 0 }
+func (fi *nodeFileInfo) ModTime() time.Time {
+	if fi.node.Attrs != nil && !fi.node.Attrs.ModTime.IsZero() {
+		return fi.node.Attrs.ModTime
+	}
+	return time.Unix(0, 0)
+}
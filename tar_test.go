@@ -0,0 +1,165 @@
+package blox
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func writeTestTar(t *testing.T, mtime time.Time) []byte {
+	type entry struct {
+		hdr  tar.Header
+		data string
+	}
+	entries := []entry{
+		{hdr: tar.Header{Name: "./", Typeflag: tar.TypeDir, Mode: 0755}},
+		{hdr: tar.Header{Name: "dir/", Typeflag: tar.TypeDir, Mode: 0750}},
+		{hdr: tar.Header{Name: "dir/a.txt", Typeflag: tar.TypeReg, Mode: 0600}, data: "file a"},
+		{hdr: tar.Header{Name: "dir/ln", Typeflag: tar.TypeSymlink, Linkname: "a.txt", Mode: 0777}},
+		{hdr: tar.Header{Name: "dir/z", Typeflag: tar.TypeLink, Linkname: "dir/a.txt", Mode: 0600}},
+		// Parent directories are implied
+		{hdr: tar.Header{Name: "b/c/d.txt", Typeflag: tar.TypeReg, Mode: 0644}, data: "file d"},
+		{hdr: tar.Header{Name: "empty", Typeflag: tar.TypeReg, Mode: 0644}},
+		// Replaced by a later entry
+		{hdr: tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644}, data: "old"},
+		{hdr: tar.Header{Name: "x", Typeflag: tar.TypeReg, Mode: 0644}, data: "new"},
+	}
+
+	buf := bytes.NewBuffer(nil)
+	tw := tar.NewWriter(buf)
+	for _, ent := range entries {
+		hdr := ent.hdr
+		hdr.Size = int64(len(ent.data))
+		hdr.ModTime = mtime
+		if err := tw.WriteHeader(&hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(ent.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func Test_Blox_ImportExportTar(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	archive := writeTestTar(t, mtime)
+
+	id, err := bx.ImportTar(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, _, err := bx.Resolve(id, "dir/z")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if node.Link != "dir/a.txt" {
+		t.Fatal("hard link not recorded", node.Link)
+	}
+	info, err := bx.Stat(id, "b/c")
+	if err != nil || info.Mode != os.ModeDir|0755 {
+		t.Fatal("implied directory", err)
+	}
+	// Times are recorded without attributes enabled
+	if info, err = bx.Stat(id, "dir/a.txt"); err != nil || !info.ModTime.Equal(mtime) {
+		t.Fatal("mtime not recorded", err)
+	}
+
+	// Exports are deterministic and import to the same tree
+	exp1 := bytes.NewBuffer(nil)
+	if err = bx.ExportTar(id, exp1); err != nil {
+		t.Fatal(err)
+	}
+	exp2 := bytes.NewBuffer(nil)
+	if err = bx.ExportTar(id, exp2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(exp1.Bytes(), exp2.Bytes()) {
+		t.Fatal("export not deterministic")
+	}
+	id2, err := bx.ImportTar(exp1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, id2) {
+		t.Fatalf("tree id mismatch %x != %x", id, id2)
+	}
+
+	// Restored with the recorded times
+	dst, _ := ioutil.TempDir(testdir, "dst")
+	defer os.RemoveAll(dst)
+	if err = bx.ReadTree(id, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+	for p, want := range map[string]string{"dir/a.txt": "file a", "dir/z": "file a", "b/c/d.txt": "file d", "x": "new"} {
+		got, err := ioutil.ReadFile(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != want {
+			t.Fatalf("%s content mismatch %q", p, got)
+		}
+	}
+	if fi, err := os.Stat(filepath.Join(dst, "dir/a.txt")); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fatal("mtime not restored", err)
+	}
+	if runtime.GOOS != "windows" {
+		if target, err := os.Readlink(filepath.Join(dst, "dir/ln")); err != nil || target != "a.txt" {
+			t.Fatal("symlink not restored", target, err)
+		}
+	}
+
+	// Sizes are recorded with attributes enabled
+	bx.SetTreeAttrs(true)
+	aid, err := bx.ImportTar(bytes.NewReader(archive))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err = bx.Stat(aid, "dir/a.txt"); err != nil || !info.ModTime.Equal(mtime) || info.Size != 6 {
+		t.Fatal("attributes not recorded", err)
+	}
+
+	exp := bytes.NewBuffer(nil)
+	if err = bx.ExportTar(aid, exp); err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(exp)
+	var names []string
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, hdr.Name)
+
+		// The implied directories have no time
+		want := mtime
+		if hdr.Name == "b/" || hdr.Name == "b/c/" {
+			want = time.Unix(0, 0)
+		}
+		if !hdr.ModTime.Equal(want) {
+			t.Fatalf("%s mtime not exported %s", hdr.Name, hdr.ModTime)
+		}
+	}
+	want := []string{"b/", "b/c/", "b/c/d.txt", "dir/", "dir/a.txt", "dir/ln", "dir/z", "empty", "x"}
+	if len(names) != len(want) {
+		t.Fatal("wrong entries", names)
+	}
+	for i := range want {
+		if names[i] != want[i] {
+			t.Fatal("wrong entries", names)
+		}
+	}
+}
@@ -0,0 +1,372 @@
+package blox
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+
+	"github.com/hexablock/blox/block"
+)
+
+var (
+	// ErrNotDirectory is used when a directory is expected
+	ErrNotDirectory = errors.New("not a directory")
+
+	errNotTreeBlock = errors.New("not a tree block")
+)
+
+// inode identifies a file on a device
+type inode struct {
+	dev uint64
+	ino uint64
+}
+
+// WriteTree walks the directory at the path and writes it to blox storage.  Files
+// are sharded in parallel, each into an index.  Directories are written bottom-up as
+// TreeBlocks containing a node per child.  It returns the id of the root TreeBlock.
+// Only regular files, directories and symbolic links are written.  Hard linked files
+// are sharded once with subsequent links recorded as links to the first in walk
+// order.  Extended attributes are recorded if enabled with SetTreeAttrs.  Directories
+// with more entries than the shard threshold are written as a HAMT.
+func (blox *Blox) WriteTree(path string, parallel int) ([]byte, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !fi.IsDir() {
+		return nil, ErrNotDirectory
+	}
+
+	tw := &treeWriter{
+		blox:  blox,
+		root:  path,
+		links: make(map[string]string),
+	}
+
+	// Collect all files to shard them in parallel up front
+	var (
+		files  []string
+		inodes = make(map[inode]string)
+	)
+	err = filepath.Walk(path, func(p string, fi os.FileInfo, err error) error {
+		if err != nil || !fi.Mode().IsRegular() {
+			return err
+		}
+		if ino, ok := fileInode(fi); ok {
+			if first, ok := inodes[ino]; ok {
+				tw.links[p] = first
+				return nil
+			}
+			inodes[ino] = p
+		}
+		files = append(files, p)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if tw.ids, err = blox.writeFiles(files, parallel); err != nil {
+		return nil, err
+	}
+
+	id, _, err := tw.writeDir(path)
+	return id, err
+}
+
+// writeFiles shards the files in parallel returning the index id of each file by
+// path.  The parallelism is split between the file workers and the sharder of each
+// file so at most parallel blocks are written at a time.
+func (blox *Blox) writeFiles(files []string, parallel int) (map[string][]byte, error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	workers := parallel
+	if len(files) < workers {
+		workers = len(files)
+	}
+	if workers == 0 {
+		return map[string][]byte{}, nil
+	}
+	shards := parallel / workers
+
+	var (
+		mu   sync.Mutex
+		ids  = make(map[string][]byte, len(files))
+		errs = make(chan error, len(files))
+		ch   = make(chan string)
+		wg   sync.WaitGroup
+	)
+
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			for p := range ch {
+				fh, err := os.Open(p)
+				if err != nil {
+					errs <- err
+					continue
+				}
+
+				idx, err := blox.WriteIndex(fh, shards)
+				if err != nil && err != block.ErrBlockExists {
+					errs <- fmt.Errorf("%s: %v", p, err)
+					continue
+				}
+
+				mu.Lock()
+				ids[p] = idx.ID()
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for _, p := range files {
+		ch <- p
+	}
+	close(ch)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// treeWriter writes the directories of a tree whose files have been sharded
+type treeWriter struct {
+	blox *Blox
+	// Directory being written
+	root string
+	// Index id of each sharded file by path
+	ids map[string][]byte
+	// Path of the first link of each hard linked file by path
+	links map[string]string
+}
+
+// writeDir writes the directory after writing all of its sub directories returning
+// its id and block type.  File index ids are looked up from the previously sharded
+// files.
+func (tw *treeWriter) writeDir(dir string) ([]byte, block.BlockType, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	nodes := make([]*block.TreeNode, 0, len(entries))
+	for _, fi := range entries {
+		p := filepath.Join(dir, fi.Name())
+
+		var node *block.TreeNode
+		switch {
+		case fi.IsDir():
+			id, typ, err := tw.writeDir(p)
+			if err != nil {
+				return nil, 0, err
+			}
+			node = block.NewDirTreeNode(fi.Name(), id)
+			node.Type = typ
+
+		case fi.Mode().IsRegular():
+			if node, err = tw.fileNode(p, fi.Name()); err != nil {
+				return nil, 0, err
+			}
+
+		case fi.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(p)
+			if err != nil {
+				return nil, 0, err
+			}
+			id, err := tw.blox.writeData([]byte(target))
+			if err != nil {
+				return nil, 0, err
+			}
+			node = block.NewSymlinkTreeNode(fi.Name(), id)
+
+		default:
+			continue
+		}
+
+		node.Mode = fi.Mode()
+		if tw.blox.attrs {
+			if node.Attrs, err = fileAttrs(p, fi); err != nil {
+				return nil, 0, err
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	return tw.blox.dirWriter().write(nodes)
+}
+
+// fileNode returns the node of a sharded file.  Hard links point to the index of the
+// first link along with its path relative to the root.
+func (tw *treeWriter) fileNode(p, name string) (*block.TreeNode, error) {
+	first, isLink := tw.links[p]
+	if !isLink {
+		first = p
+	}
+
+	id, ok := tw.ids[first]
+	if !ok {
+		return nil, fmt.Errorf("file not written: %s", first)
+	}
+	node := block.NewFileTreeNode(name, id)
+
+	if isLink {
+		rel, err := filepath.Rel(tw.root, first)
+		if err != nil {
+			return nil, err
+		}
+		node.Link = filepath.ToSlash(rel)
+	}
+	return node, nil
+}
+
+// writeData writes the bytes as a single data block returning its id
+func (blox *Blox) writeData(data []byte) ([]byte, error) {
+	blk := block.NewMemDataBlock(nil, blox.dev.Hasher())
+	wr, err := blk.Writer()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = wr.Write(data); err != nil {
+		wr.Close()
+		return nil, err
+	}
+	if err = wr.Close(); err != nil {
+		return nil, err
+	}
+
+	if _, err = blox.dev.SetBlock(blk); err != nil && err != block.ErrBlockExists {
+		return nil, err
+	}
+	return blk.ID(), nil
+}
+
+// readData reads the content of the data block with the id
+func (blox *Blox) readData(id []byte) ([]byte, error) {
+	blk, err := blox.dev.GetBlock(id)
+	if err != nil {
+		return nil, err
+	}
+	if blk.Type() != block.BlockTypeData {
+		return nil, block.ErrInvalidBlockType
+	}
+
+	rd, err := blk.Reader()
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+
+	return ioutil.ReadAll(rd)
+}
+
+// ReadTree reads the directory with the id and recreates it at dest.
+// File modes and any recorded attributes are restored from the tree nodes.
+// Directory modes and attributes are restored once their contents have been
+// written.  Hard links are recreated if the file they link to has been restored,
+// otherwise the file content is written.
+func (blox *Blox) ReadTree(id []byte, dest string, parallel int) error {
+	d, err := openDirectory(blox.dev, id)
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	tr := &treeReader{
+		blox:     blox,
+		parallel: parallel,
+		files:    make(map[string]string),
+	}
+	return tr.readDir(d, dest, "")
+}
+
+// treeReader restores a tree to a directory
+type treeReader struct {
+	blox     *Blox
+	parallel int
+	// Restored regular files by path relative to the root
+	files map[string]string
+}
+
+func (tr *treeReader) readDir(d *directory, dir, rel string) error {
+	return d.Iter(func(node *block.TreeNode) error {
+		// Guard against names escaping the destination
+		if err := block.ValidateNodeName(node.Name); err != nil {
+			return err
+		}
+		p := filepath.Join(dir, node.Name)
+		r := path.Join(rel, node.Name)
+
+		switch {
+		case node.IsDir():
+			sub, err := openDirectory(tr.blox.dev, node.Address)
+			if err != nil {
+				return err
+			}
+			if err = os.Mkdir(p, 0700); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err = tr.readDir(sub, p, r); err != nil {
+				return err
+			}
+
+		case node.Type == block.BlockTypeIndex:
+			if err := tr.readFile(node, p); err != nil {
+				return err
+			}
+			tr.files[r] = p
+
+		case node.Type == block.BlockTypeData && node.IsSymlink():
+			target, err := tr.blox.readData(node.Address)
+			if err != nil {
+				return err
+			}
+			if err = os.Symlink(string(target), p); err != nil {
+				return err
+			}
+
+		default:
+			return block.ErrInvalidBlockType
+		}
+
+		return restoreAttrs(p, node)
+	})
+}
+
+// readFile restores the file.  Hard links are only recreated to files restored by
+// the reader so links can never point outside of the destination.
+func (tr *treeReader) readFile(node *block.TreeNode, p string) error {
+	if node.Link != "" {
+		if first, ok := tr.files[path.Clean(node.Link)]; ok {
+			if err := os.Link(first, p); err == nil {
+				return nil
+			}
+		}
+	}
+	return tr.blox.readFile(node.Address, p, tr.parallel)
+}
+
+func (blox *Blox) readFile(id []byte, p string, parallel int) error {
+	fh, err := os.OpenFile(p, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	err = blox.ReadIndex(id, fh, parallel)
+	if e := fh.Close(); err == nil {
+		err = e
+	}
+	return err
+}
@@ -0,0 +1,62 @@
+package blox
+
+import (
+	"os"
+
+	"github.com/hexablock/blox/block"
+)
+
+// fileAttrs returns the attributes of the file at the path recorded by WriteTree.
+// Ownership and xattrs are only recorded where the platform supports them.  Xattrs
+// of symbolic links are not recorded.
+func fileAttrs(p string, fi os.FileInfo) (*block.NodeAttrs, error) {
+	attrs := &block.NodeAttrs{ModTime: fi.ModTime().UTC()}
+	if fi.Mode().IsRegular() {
+		attrs.Size = uint64(fi.Size())
+	}
+	attrs.UID, attrs.GID = fileOwner(fi)
+
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return attrs, nil
+	}
+
+	xattrs, err := readXattrs(p)
+	if err != nil {
+		return nil, err
+	}
+	attrs.Xattrs = xattrs
+
+	return attrs, nil
+}
+
+// restoreAttrs restores the mode and any attributes of the node to the file at the
+// path.  Ownership is only restored if permitted.  The modification time is set
+// last as setting the other attributes may change it.  Only the ownership of
+// symbolic links is restored.
+func restoreAttrs(p string, node *block.TreeNode) error {
+	attrs := node.Attrs
+	if node.IsSymlink() {
+		if attrs != nil {
+			return restoreOwner(p, attrs.UID, attrs.GID)
+		}
+		return nil
+	}
+
+	if attrs != nil {
+		if err := writeXattrs(p, attrs.Xattrs); err != nil {
+			return err
+		}
+		if err := restoreOwner(p, attrs.UID, attrs.GID); err != nil {
+			return err
+		}
+	}
+
+	if err := os.Chmod(p, node.Mode.Perm()); err != nil {
+		return err
+	}
+
+	if attrs != nil && !attrs.ModTime.IsZero() {
+		return os.Chtimes(p, attrs.ModTime, attrs.ModTime)
+	}
+	return nil
+}
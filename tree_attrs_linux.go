@@ -0,0 +1,91 @@
+//go:build linux
+// +build linux
+
+package blox
+
+import (
+	"bytes"
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode of a file with more than one hard link
+func fileInode(fi os.FileInfo) (inode, bool) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok && st.Nlink > 1 {
+		return inode{dev: uint64(st.Dev), ino: uint64(st.Ino)}, true
+	}
+	return inode{}, false
+}
+
+func fileOwner(fi os.FileInfo) (uint32, uint32) {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return st.Uid, st.Gid
+	}
+	return 0, 0
+}
+
+// restoreOwner changes the owner of the file.  It is a no-op if the user is not
+// permitted to do so.
+func restoreOwner(p string, uid, gid uint32) error {
+	if err := os.Lchown(p, int(uid), int(gid)); err != nil && !os.IsPermission(err) {
+		return err
+	}
+	return nil
+}
+
+// readXattrs reads all extended attributes of the file.  It returns nil if the
+// filesystem does not support them.
+func readXattrs(p string) (map[string][]byte, error) {
+	size, err := syscall.Listxattr(p, nil)
+	if err != nil || size == 0 {
+		return nil, xattrError(err)
+	}
+	buf := make([]byte, size)
+	if size, err = syscall.Listxattr(p, buf); err != nil {
+		return nil, xattrError(err)
+	}
+
+	xattrs := make(map[string][]byte)
+	for _, name := range bytes.Split(buf[:size], []byte{0}) {
+		if len(name) == 0 {
+			continue
+		}
+		vsize, err := syscall.Getxattr(p, string(name), nil)
+		if err != nil {
+			return nil, xattrError(err)
+		}
+		val := make([]byte, vsize)
+		if vsize, err = syscall.Getxattr(p, string(name), val); err != nil {
+			return nil, xattrError(err)
+		}
+		xattrs[string(name)] = val[:vsize]
+	}
+
+	if len(xattrs) == 0 {
+		return nil, nil
+	}
+	return xattrs, nil
+}
+
+// writeXattrs sets the extended attributes on the file.  Attributes that are not
+// supported or permitted are skipped.
+func writeXattrs(p string, xattrs map[string][]byte) error {
+	for name, val := range xattrs {
+		if err := syscall.Setxattr(p, name, val, 0); err != nil {
+			if err = xattrError(err); err != nil {
+				return &os.PathError{Op: "setxattr", Path: p, Err: err}
+			}
+		}
+	}
+	return nil
+}
+
+// xattrError returns nil for errors caused by the filesystem or user not
+// supporting extended attributes
+func xattrError(err error) error {
+	switch err {
+	case syscall.ENOTSUP, syscall.EPERM, syscall.EACCES:
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,52 @@
+package blox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func Test_Blox_TreeXattrs(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+	bx.SetTreeAttrs(true)
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeTestTree(t, src)
+
+	if err := syscall.Setxattr(filepath.Join(src, "a.txt"), "user.blox", []byte("val"), 0); err != nil {
+		t.Skip("user xattrs not supported:", err)
+	}
+
+	id, err := bx.WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, _, err := bx.Resolve(id, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(node.Attrs.Xattrs["user.blox"], []byte("val")) {
+		t.Fatal("xattr not recorded", node.Attrs.Xattrs)
+	}
+
+	dst, _ := ioutil.TempDir(testdir, "dst")
+	defer os.RemoveAll(dst)
+	if err = bx.ReadTree(id, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	val := make([]byte, 16)
+	n, err := syscall.Getxattr(filepath.Join(dst, "a.txt"), "user.blox", val)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(val[:n]) != "val" {
+		t.Fatalf("xattr not restored %q", val[:n])
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !linux
+// +build !linux
+
+package blox
+
+import "os"
+
+func fileInode(fi os.FileInfo) (inode, bool) {
+	return inode{}, false
+}
+
+func fileOwner(fi os.FileInfo) (uint32, uint32) {
+	return 0, 0
+}
+
+func restoreOwner(p string, uid, gid uint32) error {
+	return nil
+}
+
+func readXattrs(p string) (map[string][]byte, error) {
+	return nil, nil
+}
+
+func writeXattrs(p string, xattrs map[string][]byte) error {
+	return nil
+}
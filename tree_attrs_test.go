@@ -0,0 +1,75 @@
+package blox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_Blox_TreeAttrs(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	files := writeTestTree(t, src)
+
+	plain, err := bx.WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mtime := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, p := range []string{"a.txt", "sub/deep", "emptydir"} {
+		if err = os.Chtimes(filepath.Join(src, p), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bx.SetTreeAttrs(true)
+	id, err := bx.WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(id, plain) {
+		t.Fatal("attributes should change the id")
+	}
+
+	info, err := bx.Stat(id, "sub/b.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != uint64(len(files["sub/b.txt"])) || info.ModTime.IsZero() {
+		t.Fatal("attrs not used", info.Size, info.ModTime)
+	}
+
+	dst, _ := ioutil.TempDir(testdir, "dst")
+	defer os.RemoveAll(dst)
+	if err = bx.ReadTree(id, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, p := range []string{"a.txt", "sub/deep", "emptydir"} {
+		fi, err := os.Stat(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(mtime) {
+			t.Fatalf("%s mtime not restored %s", p, fi.ModTime())
+		}
+	}
+	if fi, _ := os.Stat(filepath.Join(dst, "a.txt")); fi.Mode().Perm() != 0600 {
+		t.Fatalf("file mode not restored %s", fi.Mode())
+	}
+
+	// Re-importing the restored tree yields the same id
+	id2, err := bx.WriteTree(dst, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, id2) {
+		t.Fatalf("tree id mismatch %x != %x", id, id2)
+	}
+}
@@ -0,0 +1,336 @@
+package blox
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"sort"
+
+	"github.com/hexablock/blox/block"
+)
+
+// ChangeType is the type of change of a path between two trees
+type ChangeType uint8
+
+const (
+	// ChangeAdded means the path only exists in the new tree
+	ChangeAdded ChangeType = iota + 1
+	// ChangeRemoved means the path only exists in the old tree
+	ChangeRemoved
+	// ChangeModified means the content, type or hard link of the path changed
+	ChangeModified
+	// ChangeMode means only the mode of the path changed
+	ChangeMode
+	// ChangeAttrs means only the extended attributes of the path changed
+	ChangeAttrs
+)
+
+func (ct ChangeType) String() string {
+	switch ct {
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	case ChangeMode:
+		return "mode"
+	case ChangeAttrs:
+		return "attrs"
+	}
+	return fmt.Sprintf("ChangeType(%d)", uint8(ct))
+}
+
+// TreeChange is a single difference between two trees
+type TreeChange struct {
+	Type ChangeType
+	// Full slash separated path
+	Path string
+	// Node in the old tree.  Nil if added
+	Old *block.TreeNode
+	// Node in the new tree.  Nil if removed
+	New *block.TreeNode
+	// Differing index entries of a modified file.  Only set when requested
+	Blocks []BlockChange
+}
+
+// BlockChange is a differing entry between two indexes
+type BlockChange struct {
+	// Sequential index of the data block
+	Index uint64
+	// Old block id.  Nil if the old index has fewer blocks
+	Old []byte
+	// New block id.  Nil if the new index has fewer blocks
+	New []byte
+}
+
+// DiffTrees compares the trees with the root ids a and b, and returns the changes
+// from a to b sorted by path.  Subtrees with the same id are identical and are
+// not walked, nor are the HAMT blocks with the same id of sharded directories.
+// Added and removed directories are reported as a single change rather than a
+// change per descendant.  A file whose hard link changed is reported as modified
+// even if its content did not.  A directory whose mode changed and whose content
+// changed is reported both as a mode change and with the changes of its contents.
+// Attribute changes are only reported for paths whose content and mode are
+// unchanged.  If withBlocks is true the differing index entries of each modified
+// file are also computed.
+func (blox *Blox) DiffTrees(a, b []byte, withBlocks bool) ([]*TreeChange, error) {
+	if bytes.Equal(a, b) {
+		return []*TreeChange{}, nil
+	}
+
+	changes := make([]*TreeChange, 0)
+	err := blox.diffTrees("", a, b, func(tc *TreeChange) error {
+		if withBlocks && tc.Type == ChangeModified &&
+			tc.Old.Type == block.BlockTypeIndex && tc.New.Type == block.BlockTypeIndex {
+
+			var err error
+			if tc.Blocks, err = blox.DiffIndexes(tc.Old.Address, tc.New.Address); err != nil {
+				return err
+			}
+		}
+		changes = append(changes, tc)
+		return nil
+	})
+
+	return changes, err
+}
+
+func (blox *Blox) diffTrees(dir string, a, b []byte, f func(*TreeChange) error) error {
+	na, nb, err := diffDirNodes(blox.dev, a, b)
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(na)+len(nb))
+	for name := range na {
+		names = append(names, name)
+	}
+	for name := range nb {
+		if _, ok := na[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := path.Join(dir, name)
+		oldNode, inA := na[name]
+		newNode, inB := nb[name]
+
+		var tc *TreeChange
+		switch {
+		case !inB:
+			tc = &TreeChange{Type: ChangeRemoved, Path: p, Old: oldNode}
+
+		case !inA:
+			tc = &TreeChange{Type: ChangeAdded, Path: p, New: newNode}
+
+		case oldNode.Type != newNode.Type && !(oldNode.IsDir() && newNode.IsDir()),
+			oldNode.Link != newNode.Link:
+			tc = &TreeChange{Type: ChangeModified, Path: p, Old: oldNode, New: newNode}
+
+		case bytes.Equal(oldNode.Address, newNode.Address):
+			if oldNode.Mode != newNode.Mode {
+				tc = &TreeChange{Type: ChangeMode, Path: p, Old: oldNode, New: newNode}
+			} else if !oldNode.Attrs.Equal(newNode.Attrs) {
+				tc = &TreeChange{Type: ChangeAttrs, Path: p, Old: oldNode, New: newNode}
+			}
+
+		case oldNode.IsDir():
+			if oldNode.Mode != newNode.Mode {
+				if err = f(&TreeChange{Type: ChangeMode, Path: p, Old: oldNode, New: newNode}); err != nil {
+					return err
+				}
+			}
+			if err = blox.diffTrees(p, oldNode.Address, newNode.Address, f); err != nil {
+				return err
+			}
+
+		default:
+			tc = &TreeChange{Type: ChangeModified, Path: p, Old: oldNode, New: newNode}
+		}
+
+		if tc != nil {
+			if err = f(tc); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// DiffIndexes compares the data blocks of the indexes with the ids a and b
+// position by position, and returns the differing entries
+func (blox *Blox) DiffIndexes(a, b []byte) ([]BlockChange, error) {
+	ia, err := blox.indexBlockIDs(a)
+	if err != nil {
+		return nil, err
+	}
+	ib, err := blox.indexBlockIDs(b)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(ia)
+	if len(ib) > n {
+		n = len(ib)
+	}
+
+	changes := make([]BlockChange, 0)
+	for i := 0; i < n; i++ {
+		var bc BlockChange
+		if i < len(ia) {
+			bc.Old = ia[i]
+		}
+		if i < len(ib) {
+			bc.New = ib[i]
+		}
+		if !bytes.Equal(bc.Old, bc.New) {
+			bc.Index = uint64(i)
+			changes = append(changes, bc)
+		}
+	}
+
+	return changes, nil
+}
+
+// indexBlockIDs returns the ordered data block ids of the index tree with the id
+func (blox *Blox) indexBlockIDs(id []byte) ([][]byte, error) {
+	idx, err := getIndexBlock(blox.dev, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([][]byte, 0, idx.BlockCount())
+	err = iterIndexTree(blox.dev, idx, func(index uint64, id []byte) error {
+		ids = append(ids, id)
+		return nil
+	})
+	return ids, err
+}
+
+// dirNodes returns the nodes of the directory with the id by name
+func dirNodes(dev BlockDevice, id []byte) (map[string]*block.TreeNode, error) {
+	d, err := openDirectory(dev, id)
+	if err != nil {
+		return nil, err
+	}
+	return d.Nodes()
+}
+
+// diffDirNodes returns the nodes by name of the directories with the ids a and b.
+// If both are sharded only the nodes of the HAMT slots that differ are returned.
+func diffDirNodes(dev BlockDevice, a, b []byte) (map[string]*block.TreeNode, map[string]*block.TreeNode, error) {
+	da, err := openDirectory(dev, a)
+	if err != nil {
+		return nil, nil, err
+	}
+	db, err := openDirectory(dev, b)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if da.hamt != nil && db.hamt != nil {
+		na := make(map[string]*block.TreeNode)
+		nb := make(map[string]*block.TreeNode)
+		err = diffHAMT(dev, da.hamt, db.hamt, na, nb)
+		return na, nb, err
+	}
+
+	na, err := da.Nodes()
+	if err != nil {
+		return nil, nil, err
+	}
+	nb, err := db.Nodes()
+	return na, nb, err
+}
+
+// diffHAMT adds the nodes of the slots that differ between the HAMT blocks at the
+// same depth to na and nb.  The layout of a HAMT only depends on its entries so
+// child blocks with the same id are skipped, and child blocks on both sides are
+// compared slot by slot.
+func diffHAMT(dev BlockDevice, a, b *block.HAMTBlock, na, nb map[string]*block.TreeNode) error {
+	slots := make(map[int]struct{})
+	for _, h := range []*block.HAMTBlock{a, b} {
+		h.IterSlots(func(i int, slot *block.HAMTSlot) error {
+			slots[i] = struct{}{}
+			return nil
+		})
+	}
+
+	for i := range slots {
+		sa, sb := a.Slot(i), b.Slot(i)
+		if slotEqual(sa, sb) {
+			continue
+		}
+
+		if sa != nil && sb != nil && sa.Child != nil && sb.Child != nil {
+			ca, err := getHAMTBlock(dev, sa.Child)
+			if err != nil {
+				return err
+			}
+			cb, err := getHAMTBlock(dev, sb.Child)
+			if err != nil {
+				return err
+			}
+			if err = diffHAMT(dev, ca, cb, na, nb); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := slotNodes(dev, sa, na); err != nil {
+			return err
+		}
+		if err := slotNodes(dev, sb, nb); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// slotNodes adds all nodes of the slot, including those of its child blocks, to
+// nodes
+func slotNodes(dev BlockDevice, slot *block.HAMTSlot, nodes map[string]*block.TreeNode) error {
+	if slot == nil {
+		return nil
+	}
+	if slot.Child == nil {
+		for _, node := range slot.Nodes {
+			nodes[node.Name] = node
+		}
+		return nil
+	}
+
+	child, err := getHAMTBlock(dev, slot.Child)
+	if err != nil {
+		return err
+	}
+	return iterHAMT(dev, child, func(node *block.TreeNode) error {
+		nodes[node.Name] = node
+		return nil
+	})
+}
+
+// slotEqual returns true if both slots are nil, point to the same child block or
+// hold the same nodes
+func slotEqual(a, b *block.HAMTSlot) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Child != nil || b.Child != nil {
+		return bytes.Equal(a.Child, b.Child)
+	}
+	if len(a.Nodes) != len(b.Nodes) {
+		return false
+	}
+	for i, node := range a.Nodes {
+		if node.Name != b.Nodes[i].Name || !nodeEqual(node, b.Nodes[i]) {
+			return false
+		}
+	}
+	return true
+}
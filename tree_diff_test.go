@@ -0,0 +1,122 @@
+package blox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func Test_Blox_DiffTrees(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+	bx.SetChunker(NewFixedChunker(4096))
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeTestTree(t, src)
+
+	root, err := bx.WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Modify the 3rd block and append data modifying the partial last block and
+	// adding another
+	data, _ := ioutil.ReadFile(src + "/sub/deep/c.bin")
+	mod := append([]byte{}, data...)
+	mod[2*4096] = 'X'
+	mod = append(mod, bytes.Repeat([]byte("y"), 4096)...)
+	idx, err := bx.WriteIndex(ioutil.NopCloser(bytes.NewReader(mod)), 2)
+	if err != nil && err != block.ErrBlockExists {
+		t.Fatal(err)
+	}
+
+	old, _, err := bx.Resolve(root, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	chmod := *old
+	chmod.Mode = 0644
+
+	nroot, err := bx.UpdateTree(root,
+		PutOp("sub/deep/c.bin", block.NewFileTreeNode("", idx.ID())),
+		PutOp("a.txt", &chmod),
+		DeleteOp("other"),
+		PutOp("sub/deep/new", block.NewFileTreeNode("", idx.ID())),
+		RenameOp("empty", "emptydir/empty"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := bx.DiffTrees(root, nroot, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ  ChangeType
+		path string
+	}{
+		{ChangeMode, "a.txt"},
+		{ChangeRemoved, "empty"},
+		{ChangeAdded, "emptydir/empty"},
+		{ChangeRemoved, "other"},
+		{ChangeModified, "sub/deep/c.bin"},
+		{ChangeAdded, "sub/deep/new"},
+	}
+	if len(changes) != len(want) {
+		for _, c := range changes {
+			t.Log(c.Type, c.Path)
+		}
+		t.Fatalf("change count mismatch want=%d have=%d", len(want), len(changes))
+	}
+	for i, w := range want {
+		if changes[i].Type != w.typ || changes[i].Path != w.path {
+			t.Fatalf("change %d mismatch want=%s %s have=%s %s", i, w.typ, w.path, changes[i].Type, changes[i].Path)
+		}
+	}
+
+	blocks := changes[4].Blocks
+	if len(blocks) != 3 {
+		t.Fatalf("should have 3 block changes have %d", len(blocks))
+	}
+	if blocks[0].Index != 2 || blocks[0].Old == nil || blocks[0].New == nil {
+		t.Fatalf("wrong block change %+v", blocks[0])
+	}
+	if blocks[1].Index != uint64(len(data)/4096) || blocks[1].Old == nil {
+		t.Fatalf("wrong last block change %+v", blocks[1])
+	}
+	if blocks[2].Old != nil || blocks[2].New == nil {
+		t.Fatalf("wrong appended block change %+v", blocks[2])
+	}
+
+	// Reversed and identical trees
+	changes, err = bx.DiffTrees(nroot, root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes[1].Type != ChangeAdded || changes[1].Path != "empty" || changes[4].Blocks != nil {
+		t.Fatal("wrong reversed changes")
+	}
+	if changes, _ = bx.DiffTrees(root, root, true); len(changes) != 0 {
+		t.Fatal("identical trees should have no changes")
+	}
+
+	// Only the hard link changed
+	link := *old
+	link.Link = "sub/b.txt"
+	lroot, err := bx.UpdateTree(root, PutOp("a.txt", &link))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes, err = bx.DiffTrees(root, lroot, false); err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Type != ChangeModified || changes[0].Path != "a.txt" {
+		t.Fatalf("link change not reported %+v", changes)
+	}
+}
@@ -0,0 +1,321 @@
+package blox
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/hexablock/blox/block"
+)
+
+// ConflictType is the type of a merge conflict
+type ConflictType uint8
+
+const (
+	// ConflictBothModified means both sides changed or added the path differently
+	ConflictBothModified ConflictType = iota + 1
+	// ConflictModifyDelete means one side modified the path and the other deleted it
+	ConflictModifyDelete
+	// ConflictTypeChange means the sides disagree on whether the path is a file or
+	// a directory
+	ConflictTypeChange
+)
+
+func (ct ConflictType) String() string {
+	switch ct {
+	case ConflictBothModified:
+		return "both-modified"
+	case ConflictModifyDelete:
+		return "modify-delete"
+	case ConflictTypeChange:
+		return "type-change"
+	}
+	return fmt.Sprintf("ConflictType(%d)", uint8(ct))
+}
+
+// TreeConflict is a path that could not be merged
+type TreeConflict struct {
+	Type ConflictType
+	// Full slash separated path
+	Path string
+	// Node of each side.  Nil where the path does not exist
+	Base   *block.TreeNode
+	Ours   *block.TreeNode
+	Theirs *block.TreeNode
+}
+
+// MergeTrees performs a three-way merge of the trees ours and theirs with the
+// common ancestor base, and returns the merged root id.  Changes made by only one
+// side are applied and directories changed by both sides are merged recursively.
+// Paths changed by both sides in different ways are returned as conflicts in path
+// order, in which case the merged tree keeps our side of each conflicting path.
+// Base may be nil if there is no common ancestor.  Sharded directories on both
+// sides are compared slot by slot so their unchanged HAMT blocks are not walked.
+func (blox *Blox) MergeTrees(base, ours, theirs []byte) ([]byte, []*TreeConflict, error) {
+	tm := &treeMerger{dev: blox.dev, dw: blox.dirWriter(), conflicts: make([]*TreeConflict, 0)}
+	id, _, err := tm.merge("", base, ours, theirs)
+	if err != nil {
+		return nil, nil, err
+	}
+	return id, tm.conflicts, nil
+}
+
+type treeMerger struct {
+	dev       BlockDevice
+	dw        *dirWriter
+	conflicts []*TreeConflict
+}
+
+// merge merges the directories returning the id and block type of the merged
+// directory
+func (tm *treeMerger) merge(dir string, base, ours, theirs []byte) ([]byte, block.BlockType, error) {
+	switch {
+	case bytes.Equal(ours, theirs), base != nil && bytes.Equal(base, theirs):
+		return tm.dirType(ours)
+	case base != nil && bytes.Equal(base, ours):
+		return tm.dirType(theirs)
+	}
+
+	do, err := openDirectory(tm.dev, ours)
+	if err != nil {
+		return nil, 0, err
+	}
+	dt, err := openDirectory(tm.dev, theirs)
+	if err != nil {
+		return nil, 0, err
+	}
+	if do.hamt != nil && dt.hamt != nil {
+		return tm.mergeHAMT(dir, base, do, dt)
+	}
+
+	nb := map[string]*block.TreeNode{}
+	if base != nil {
+		if nb, err = dirNodes(tm.dev, base); err != nil {
+			return nil, 0, err
+		}
+	}
+	no, err := do.Nodes()
+	if err != nil {
+		return nil, 0, err
+	}
+	nt, err := dt.Nodes()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	names := make(map[string]struct{}, len(no)+len(nt))
+	for _, nodes := range []map[string]*block.TreeNode{nb, no, nt} {
+		for name := range nodes {
+			names[name] = struct{}{}
+		}
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	merged := make([]*block.TreeNode, 0, len(sorted))
+	for _, name := range sorted {
+		node, err := tm.mergeNode(path.Join(dir, name), nb[name], no[name], nt[name])
+		if err != nil {
+			return nil, 0, err
+		}
+		if node != nil {
+			merged = append(merged, node)
+		}
+	}
+
+	return tm.dw.write(merged)
+}
+
+// mergeHAMT merges the sharded directories ours and theirs.  Only the names in the
+// HAMT slots that differ between both sides are merged, looking up each in base,
+// and applied to our directory.  All other names are the same on both sides.
+func (tm *treeMerger) mergeHAMT(dir string, base []byte, do, dt *directory) ([]byte, block.BlockType, error) {
+	no := make(map[string]*block.TreeNode)
+	nt := make(map[string]*block.TreeNode)
+	if err := diffHAMT(tm.dev, do.hamt, dt.hamt, no, nt); err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		db  *directory
+		err error
+	)
+	if base != nil {
+		if db, err = openDirectory(tm.dev, base); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	names := make([]string, 0, len(no)+len(nt))
+	for name := range no {
+		names = append(names, name)
+	}
+	for name := range nt {
+		if _, ok := no[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make(map[string]*block.TreeNode)
+	for _, name := range names {
+		var bn *block.TreeNode
+		if db != nil {
+			if bn, _, err = db.Get(name); err != nil {
+				return nil, 0, err
+			}
+		}
+
+		node, err := tm.mergeNode(path.Join(dir, name), bn, no[name], nt[name])
+		if err != nil {
+			return nil, 0, err
+		}
+		if !nodeEqual(node, no[name]) {
+			changes[name] = node
+		}
+	}
+
+	if len(changes) == 0 {
+		return do.ID(), do.Type(), nil
+	}
+	return tm.dw.update(do, changes)
+}
+
+// dirType returns the id along with the block type of the directory
+func (tm *treeMerger) dirType(id []byte) ([]byte, block.BlockType, error) {
+	d, err := openDirectory(tm.dev, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	return id, d.Type(), nil
+}
+
+// mergeNode merges a single path returning the merged node or nil if it is
+// deleted
+func (tm *treeMerger) mergeNode(p string, bn, on, tn *block.TreeNode) (*block.TreeNode, error) {
+	switch {
+	case nodeEqual(on, tn):
+		return on, nil
+	case nodeEqual(bn, on):
+		return tn, nil
+	case nodeEqual(bn, tn):
+		return on, nil
+	}
+
+	// Both sides changed the path differently
+	switch {
+	case on == nil || tn == nil:
+		tm.conflict(ConflictModifyDelete, p, bn, on, tn)
+		return on, nil
+
+	case on.IsDir() && tn.IsDir():
+		var base []byte
+		if bn != nil && bn.IsDir() {
+			base = bn.Address
+		}
+		// Conflicts of the directory itself precede those of its contents
+		node := *on
+		node.Mode = tm.mergeMode(p, bn, on, tn)
+		node.Attrs = tm.mergeAttrs(p, bn, on, tn)
+
+		id, typ, err := tm.merge(p, base, on.Address, tn.Address)
+		if err != nil {
+			return nil, err
+		}
+		node.Address = id
+		node.Type = typ
+		return &node, nil
+
+	case on.Type != tn.Type:
+		tm.conflict(ConflictTypeChange, p, bn, on, tn)
+		return on, nil
+
+	case bytes.Equal(on.Address, tn.Address):
+		// Same content with a mode, attribute or link change
+		node := *on
+		node.Mode = tm.mergeMode(p, bn, on, tn)
+		node.Attrs = tm.mergeAttrs(p, bn, on, tn)
+		node.Link = tm.mergeLink(p, bn, on, tn)
+		return &node, nil
+	}
+
+	tm.conflict(ConflictBothModified, p, bn, on, tn)
+	return on, nil
+}
+
+// mergeMode merges the modes of a path whose content was merged.  A conflict is
+// recorded if both sides changed the mode differently.
+func (tm *treeMerger) mergeMode(p string, bn, on, tn *block.TreeNode) os.FileMode {
+	switch {
+	case on.Mode == tn.Mode:
+		return on.Mode
+	case bn != nil && bn.Mode == on.Mode:
+		return tn.Mode
+	case bn != nil && bn.Mode == tn.Mode:
+		return on.Mode
+	}
+
+	tm.conflict(ConflictBothModified, p, bn, on, tn)
+	return on.Mode
+}
+
+// mergeLink merges the hard links of a path whose content was merged.  A conflict
+// is recorded if both sides changed the link differently.
+func (tm *treeMerger) mergeLink(p string, bn, on, tn *block.TreeNode) string {
+	switch {
+	case on.Link == tn.Link:
+		return on.Link
+	case bn != nil && bn.Link == on.Link:
+		return tn.Link
+	case bn != nil && bn.Link == tn.Link:
+		return on.Link
+	}
+
+	tm.conflict(ConflictBothModified, p, bn, on, tn)
+	return on.Link
+}
+
+// mergeAttrs merges the attributes of a path whose content was merged.  A conflict
+// is recorded if both sides changed the attributes of a file differently.  The
+// attributes of a directory change along with its contents so our side is kept
+// without a conflict.
+func (tm *treeMerger) mergeAttrs(p string, bn, on, tn *block.TreeNode) *block.NodeAttrs {
+	switch {
+	case on.Attrs.Equal(tn.Attrs):
+		return on.Attrs
+	case bn != nil && bn.Attrs.Equal(on.Attrs):
+		return tn.Attrs
+	case bn != nil && bn.Attrs.Equal(tn.Attrs):
+		return on.Attrs
+	case on.IsDir():
+		return on.Attrs
+	}
+
+	tm.conflict(ConflictBothModified, p, bn, on, tn)
+	return on.Attrs
+}
+
+func (tm *treeMerger) conflict(typ ConflictType, p string, bn, on, tn *block.TreeNode) {
+	tm.conflicts = append(tm.conflicts, &TreeConflict{
+		Type:   typ,
+		Path:   p,
+		Base:   bn,
+		Ours:   on,
+		Theirs: tn,
+	})
+}
+
+// nodeEqual returns true if both nodes are nil or point to the same content with
+// the same type, mode, attributes and link
+func nodeEqual(a, b *block.TreeNode) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Type == b.Type && a.Mode == b.Mode && bytes.Equal(a.Address, b.Address) &&
+		a.Attrs.Equal(b.Attrs) && a.Link == b.Link
+}
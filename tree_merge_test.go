@@ -0,0 +1,197 @@
+package blox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func Test_Blox_MergeTrees(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeTestTree(t, src)
+
+	base, err := bx.WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFile := func(data string) *block.TreeNode {
+		idx, err := bx.WriteIndex(ioutil.NopCloser(bytes.NewReader([]byte(data))), 1)
+		if err != nil && err != block.ErrBlockExists {
+			t.Fatal(err)
+		}
+		return block.NewFileTreeNode("", idx.ID())
+	}
+
+	// Non-overlapping changes including changes in the same directory
+	ours, err := bx.UpdateTree(base,
+		PutOp("sub/deep/ours", newFile("ours")),
+		DeleteOp("other"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err := bx.UpdateTree(base,
+		PutOp("sub/deep/theirs", newFile("theirs")),
+		PutOp("a.txt", newFile("new a")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, conflicts, err := bx.MergeTrees(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Fatalf("should have no conflicts have %d", len(conflicts))
+	}
+
+	expected, err := bx.UpdateTree(base,
+		PutOp("sub/deep/ours", newFile("ours")),
+		DeleteOp("other"),
+		PutOp("sub/deep/theirs", newFile("theirs")),
+		PutOp("a.txt", newFile("new a")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(merged, expected) {
+		t.Fatal("merged tree mismatch")
+	}
+
+	// Merge is symmetric without conflicts
+	if merged2, _, _ := bx.MergeTrees(base, theirs, ours); !bytes.Equal(merged, merged2) {
+		t.Fatal("merge should be symmetric")
+	}
+
+	// Conflicting changes
+	ours, err = bx.UpdateTree(base,
+		PutOp("a.txt", newFile("ours a")),
+		PutOp("sub/b.txt", newFile("ours b")),
+		PutOp("empty", newFile("ours empty")),
+		PutOp("ok", newFile("ok")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	theirs, err = bx.UpdateTree(base,
+		PutOp("a.txt", newFile("theirs a")),
+		DeleteOp("sub/b.txt"),
+		DeleteOp("empty"),
+		PutOp("empty/file", newFile("dir now")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	merged, conflicts, err = bx.MergeTrees(base, ours, theirs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		typ  ConflictType
+		path string
+	}{
+		{ConflictBothModified, "a.txt"},
+		{ConflictTypeChange, "empty"},
+		{ConflictModifyDelete, "sub/b.txt"},
+	}
+	if len(conflicts) != len(want) {
+		t.Fatalf("conflict count mismatch want=%d have=%d", len(want), len(conflicts))
+	}
+	for i, w := range want {
+		if conflicts[i].Type != w.typ || conflicts[i].Path != w.path {
+			t.Fatalf("conflict %d mismatch want=%s %s have=%s %s", i, w.typ, w.path, conflicts[i].Type, conflicts[i].Path)
+		}
+	}
+	if conflicts[2].Theirs != nil || conflicts[2].Ours == nil || conflicts[2].Base == nil {
+		t.Fatal("wrong conflict sides")
+	}
+
+	// Non-conflicting change is merged and conflicts keep our side
+	if _, err = bx.Stat(merged, "ok"); err != nil {
+		t.Fatal(err)
+	}
+	info, _ := bx.Stat(merged, "a.txt")
+	oinfo, _ := bx.Stat(ours, "a.txt")
+	if !bytes.Equal(info.ID, oinfo.ID) {
+		t.Fatal("conflict should keep our side")
+	}
+
+	// Hard link changes
+	node, _, err := bx.Resolve(base, "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	linked := *node
+	linked.Link = "sub/b.txt"
+	chmod := *node
+	chmod.Mode = 0600
+	if ours, err = bx.UpdateTree(base, PutOp("a.txt", &linked)); err != nil {
+		t.Fatal(err)
+	}
+	if theirs, err = bx.UpdateTree(base, PutOp("a.txt", &chmod)); err != nil {
+		t.Fatal(err)
+	}
+	if merged, conflicts, err = bx.MergeTrees(base, ours, theirs); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 0 {
+		t.Fatalf("should have no conflicts have %d", len(conflicts))
+	}
+	mnode, _, _ := bx.Resolve(merged, "a.txt")
+	if mnode.Link != "sub/b.txt" || mnode.Mode != 0600 {
+		t.Fatalf("link not merged %q %v", mnode.Link, mnode.Mode)
+	}
+
+	relinked := *node
+	relinked.Link = "other"
+	if theirs, err = bx.UpdateTree(base, PutOp("a.txt", &relinked)); err != nil {
+		t.Fatal(err)
+	}
+	if merged, conflicts, err = bx.MergeTrees(base, ours, theirs); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 1 || conflicts[0].Type != ConflictBothModified || conflicts[0].Path != "a.txt" {
+		t.Fatal("link conflict not recorded")
+	}
+	if mnode, _, _ = bx.Resolve(merged, "a.txt"); mnode.Link != "sub/b.txt" {
+		t.Fatal("conflict should keep our link", mnode.Link)
+	}
+
+	// Conflicts of a directory precede those of its contents
+	side := func(data string, mode os.FileMode) []byte {
+		root, err := bx.UpdateTree(base, PutOp("sub/b.txt", newFile(data)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		dir, _, err := bx.Resolve(root, "sub")
+		if err != nil {
+			t.Fatal(err)
+		}
+		chmod := *dir
+		chmod.Mode = os.ModeDir | mode
+		if root, err = bx.UpdateTree(root, PutOp("sub", &chmod)); err != nil {
+			t.Fatal(err)
+		}
+		return root
+	}
+	if _, conflicts, err = bx.MergeTrees(base, side("ours b", 0700), side("theirs b", 0750)); err != nil {
+		t.Fatal(err)
+	}
+	if len(conflicts) != 2 || conflicts[0].Path != "sub" || conflicts[1].Path != "sub/b.txt" {
+		for _, c := range conflicts {
+			t.Log(c.Type, c.Path)
+		}
+		t.Fatal("conflicts not in path order")
+	}
+}
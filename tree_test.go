@@ -0,0 +1,184 @@
+package blox
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/hexablock/blox/device"
+)
+
+func newTestBlox(t *testing.T) (*Blox, func()) {
+	d, _ := ioutil.TempDir(testdir, "data")
+	rdev, err := device.NewFileRawDevice(d, sha256.New)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dev := device.NewBlockDevice(device.NewInmemIndex(), rdev)
+	return NewBlox(dev), func() { os.RemoveAll(d) }
+}
+
+// writeTestTree creates a small directory tree returning the file contents by
+// relative path
+func writeTestTree(t *testing.T, dir string) map[string][]byte {
+	files := map[string][]byte{
+		"a.txt":           []byte("file a"),
+		"empty":           {},
+		"sub/b.txt":       bytes.Repeat([]byte("file b "), 1000),
+		"sub/deep/c.bin":  bytes.Repeat([]byte{1, 2, 3}, 100000),
+		"sub/deep/dup":    []byte("file a"),
+		"other/space  ed": []byte("spaces in name"),
+	}
+	for p, data := range files {
+		fp := filepath.Join(dir, p)
+		os.MkdirAll(filepath.Dir(fp), 0755)
+		if err := ioutil.WriteFile(fp, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	os.Chmod(filepath.Join(dir, "a.txt"), 0600)
+	os.Mkdir(filepath.Join(dir, "emptydir"), 0750)
+	return files
+}
+
+func Test_Blox_WriteReadTree(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	files := writeTestTree(t, src)
+
+	id, err := bx.WriteTree(src, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Content addressed
+	id2, err := bx.WriteTree(src, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, id2) {
+		t.Fatalf("tree id mismatch %x != %x", id, id2)
+	}
+
+	dst, _ := ioutil.TempDir(testdir, "dst")
+	defer os.RemoveAll(dst)
+	if err = bx.ReadTree(id, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, data := range files {
+		got, err := ioutil.ReadFile(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, data) {
+			t.Fatalf("%s data mismatch", p)
+		}
+	}
+
+	fi, err := os.Stat(filepath.Join(dst, "a.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0600 {
+		t.Fatalf("file mode not restored %s", fi.Mode())
+	}
+	fi, err = os.Stat(filepath.Join(dst, "emptydir"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fi.IsDir() || fi.Mode().Perm() != 0750 {
+		t.Fatalf("dir mode not restored %s", fi.Mode())
+	}
+
+	if _, err = bx.WriteTree(filepath.Join(src, "a.txt"), 1); err != ErrNotDirectory {
+		t.Fatalf(errCheckStr, ErrNotDirectory, err)
+	}
+}
+
+func Test_Blox_TreeLinks(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeTestTree(t, src)
+
+	if err := os.Symlink("../a.txt", filepath.Join(src, "sub", "rel-link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/does/not/exist", filepath.Join(src, "dangling")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Link(filepath.Join(src, "sub", "b.txt"), filepath.Join(src, "sub", "deep", "hard")); err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := bx.WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, _, err := bx.Resolve(id, "sub/rel-link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !node.IsSymlink() {
+		t.Fatal("should be a symlink")
+	}
+
+	hard, _, err := bx.Resolve(id, "sub/deep/hard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS == "linux" && hard.Link != "sub/b.txt" {
+		t.Fatalf("hard link not detected %q", hard.Link)
+	}
+
+	dst, _ := ioutil.TempDir(testdir, "dst")
+	defer os.RemoveAll(dst)
+	if err = bx.ReadTree(id, dst, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	for p, target := range map[string]string{"sub/rel-link": "../a.txt", "dangling": "/does/not/exist"} {
+		got, err := os.Readlink(filepath.Join(dst, p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != target {
+			t.Fatalf("%s target mismatch %s", p, got)
+		}
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dst, "sub", "deep", "hard"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, bytes.Repeat([]byte("file b "), 1000)) {
+		t.Fatal("hard link data mismatch")
+	}
+	if runtime.GOOS == "linux" {
+		fi1, _ := os.Stat(filepath.Join(dst, "sub", "b.txt"))
+		fi2, _ := os.Stat(filepath.Join(dst, "sub", "deep", "hard"))
+		if !os.SameFile(fi1, fi2) {
+			t.Fatal("hard link not restored")
+		}
+	}
+
+	// Round trip
+	id2, err := bx.WriteTree(dst, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(id, id2) {
+		t.Fatalf("tree id mismatch %x != %x", id, id2)
+	}
+}
@@ -0,0 +1,298 @@
+package blox
+
+import (
+	"errors"
+	"os"
+
+	"github.com/hexablock/blox/block"
+)
+
+// TreeOpType is the type of a tree update operation
+type TreeOpType uint8
+
+const (
+	// TreeOpPut adds or replaces the node at a path
+	TreeOpPut TreeOpType = iota + 1
+	// TreeOpDelete removes the node at a path
+	TreeOpDelete
+	// TreeOpRename moves the node at a path to another path
+	TreeOpRename
+)
+
+var (
+	errInvalidTreeOp  = errors.New("invalid tree operation")
+	errRenameIntoSelf = errors.New("cannot rename a directory into itself")
+)
+
+// TreeOp is a single operation applied by UpdateTree
+type TreeOp struct {
+	Type TreeOpType
+	// Slash separated path the operation applies to
+	Path string
+	// Node to put.  Its name is replaced by the base name of the path
+	Node *block.TreeNode
+	// Destination path of a rename
+	To string
+}
+
+// PutOp returns an operation adding or replacing the node at the path.  Missing
+// parent directories are created.
+func PutOp(path string, node *block.TreeNode) TreeOp {
+	return TreeOp{Type: TreeOpPut, Path: path, Node: node}
+}
+
+// DeleteOp returns an operation removing the node at the path
+func DeleteOp(path string) TreeOp {
+	return TreeOp{Type: TreeOpDelete, Path: path}
+}
+
+// RenameOp returns an operation moving the node at the path to another path
+// replacing any existing node.  Missing parent directories of the destination are
+// created.
+func RenameOp(from, to string) TreeOp {
+	return TreeOp{Type: TreeOpRename, Path: from, To: to}
+}
+
+// UpdateTree applies the operations in order to the tree with the root id and
+// returns the id of the new root.  Trees are immutable so only the directories
+// along the modified paths are rewritten and stored on the device.  All untouched
+// subtrees keep their ids.  Sharded directories only rewrite the HAMT blocks
+// containing the modified entries.
+func (blox *Blox) UpdateTree(root []byte, ops ...TreeOp) ([]byte, error) {
+	tu := &treeUpdater{dev: blox.dev, dw: blox.dirWriter()}
+
+	var err error
+	if tu.root, err = tu.load(root); err != nil {
+		return nil, err
+	}
+
+	for _, op := range ops {
+		switch op.Type {
+		case TreeOpPut:
+			if op.Node == nil {
+				return nil, errInvalidTreeOp
+			}
+			err = tu.put(splitPath(op.Path), op.Node, nil)
+		case TreeOpDelete:
+			_, _, err = tu.remove(splitPath(op.Path))
+		case TreeOpRename:
+			err = tu.rename(splitPath(op.Path), splitPath(op.To))
+		default:
+			err = errInvalidTreeOp
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	id, _, _, err := tu.commit(tu.root)
+	return id, err
+}
+
+// treeEdit is a pending edit of a directory.  Only the modified entries are kept
+// with all others read from the original directory as needed.
+type treeEdit struct {
+	// Original directory.  Nil for new directories
+	base *directory
+	// Modified child nodes by name.  A nil node is a removed entry
+	changes map[string]*block.TreeNode
+	// Loaded sub directories by name
+	subs map[string]*treeEdit
+}
+
+func newTreeEdit() *treeEdit {
+	return &treeEdit{
+		changes: make(map[string]*block.TreeNode),
+		subs:    make(map[string]*treeEdit),
+	}
+}
+
+// get returns the current node with the name
+func (te *treeEdit) get(name string) (*block.TreeNode, bool, error) {
+	if node, ok := te.changes[name]; ok {
+		return node, node != nil, nil
+	}
+	if te.base == nil {
+		return nil, false, nil
+	}
+	return te.base.Get(name)
+}
+
+type treeUpdater struct {
+	dev  BlockDevice
+	dw   *dirWriter
+	root *treeEdit
+}
+
+func (tu *treeUpdater) load(id []byte) (*treeEdit, error) {
+	d, err := openDirectory(tu.dev, id)
+	if err != nil {
+		return nil, err
+	}
+
+	te := newTreeEdit()
+	te.base = d
+	return te, nil
+}
+
+// dir returns the edit of the directory at the path segments optionally creating
+// missing directories
+func (tu *treeUpdater) dir(segs []string, create bool) (*treeEdit, error) {
+	te := tu.root
+	for _, seg := range segs {
+		if sub, ok := te.subs[seg]; ok {
+			te = sub
+			continue
+		}
+
+		node, ok, err := te.get(seg)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			if !create {
+				return nil, ErrPathNotFound
+			}
+			node = block.NewDirTreeNode(seg, nil)
+			node.Mode = os.ModeDir | 0755
+			te.changes[seg] = node
+			te.subs[seg] = newTreeEdit()
+			te = te.subs[seg]
+			continue
+		}
+
+		if !node.IsDir() {
+			return nil, ErrNotDirectory
+		}
+
+		sub, err := tu.load(node.Address)
+		if err != nil {
+			return nil, err
+		}
+		te.subs[seg] = sub
+		te = sub
+	}
+
+	return te, nil
+}
+
+// put sets the node at the path.  A pending edit of a directory being moved is
+// carried along with it.
+func (tu *treeUpdater) put(segs []string, node *block.TreeNode, sub *treeEdit) error {
+	if len(segs) == 0 {
+		return block.ErrInvalidNodeName
+	}
+
+	parent, err := tu.dir(segs[:len(segs)-1], true)
+	if err != nil {
+		return err
+	}
+
+	name := segs[len(segs)-1]
+	nn := *node
+	nn.Name = name
+
+	parent.changes[name] = &nn
+	delete(parent.subs, name)
+	if sub != nil {
+		parent.subs[name] = sub
+	}
+
+	return nil
+}
+
+// remove deletes the node at the path returning it along with any pending edit
+// of it
+func (tu *treeUpdater) remove(segs []string) (*block.TreeNode, *treeEdit, error) {
+	if len(segs) == 0 {
+		return nil, nil, block.ErrInvalidNodeName
+	}
+
+	parent, err := tu.dir(segs[:len(segs)-1], false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	name := segs[len(segs)-1]
+	node, ok, err := parent.get(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ok {
+		return nil, nil, ErrPathNotFound
+	}
+	sub := parent.subs[name]
+
+	parent.changes[name] = nil
+	delete(parent.subs, name)
+
+	return node, sub, nil
+}
+
+func (tu *treeUpdater) rename(from, to []string) error {
+	if len(to) > len(from) && isPathPrefix(from, to) {
+		return errRenameIntoSelf
+	}
+
+	node, sub, err := tu.remove(from)
+	if err != nil {
+		return err
+	}
+	return tu.put(to, node, sub)
+}
+
+// commit writes the modified directories bottom-up returning the id and block type
+// of the directory and whether it changed
+func (tu *treeUpdater) commit(te *treeEdit) ([]byte, block.BlockType, bool, error) {
+	for name, sub := range te.subs {
+		id, typ, ok, err := tu.commit(sub)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if !ok {
+			continue
+		}
+
+		node, _, err := te.get(name)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		nn := *node
+		nn.Address = id
+		nn.Type = typ
+		te.changes[name] = &nn
+	}
+
+	if len(te.changes) == 0 && te.base != nil {
+		return te.base.ID(), te.base.Type(), false, nil
+	}
+
+	var (
+		id  []byte
+		typ block.BlockType
+		err error
+	)
+	if te.base == nil {
+		nodes := make([]*block.TreeNode, 0, len(te.changes))
+		for _, node := range te.changes {
+			if node != nil {
+				nodes = append(nodes, node)
+			}
+		}
+		id, typ, err = tu.dw.write(nodes)
+	} else {
+		id, typ, err = tu.dw.update(te.base, te.changes)
+	}
+
+	return id, typ, true, err
+}
+
+func isPathPrefix(prefix, segs []string) bool {
+	for i := range prefix {
+		if prefix[i] != segs[i] {
+			return false
+		}
+	}
+	return true
+}
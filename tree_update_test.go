@@ -0,0 +1,132 @@
+package blox
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/hexablock/blox/block"
+)
+
+func Test_Blox_UpdateTree(t *testing.T) {
+	bx, cleanup := newTestBlox(t)
+	defer cleanup()
+
+	src, _ := ioutil.TempDir(testdir, "src")
+	defer os.RemoveAll(src)
+	writeTestTree(t, src)
+
+	root, err := bx.WriteTree(src, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idx, err := bx.WriteIndex(ioutil.NopCloser(bytes.NewReader([]byte("new file"))), 1)
+	if err != nil && err != block.ErrBlockExists {
+		t.Fatal(err)
+	}
+
+	before := map[string]*NodeInfo{}
+	for _, p := range []string{"other", "sub", "sub/deep", "emptydir"} {
+		if before[p], err = bx.Stat(root, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	nroot, err := bx.UpdateTree(root,
+		PutOp("sub/deep/new.txt", block.NewFileTreeNode("", idx.ID())),
+		PutOp("created/dir/file", block.NewFileTreeNode("", idx.ID())),
+		DeleteOp("a.txt"),
+		RenameOp("sub/b.txt", "sub/deep/b.txt"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(root, nroot) {
+		t.Fatal("root should change")
+	}
+
+	// Original tree is untouched
+	if _, err = bx.Stat(root, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Untouched subtrees keep their ids
+	for _, p := range []string{"other", "emptydir"} {
+		info, err := bx.Stat(nroot, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(info.ID, before[p].ID) {
+			t.Fatalf("%s id should not change", p)
+		}
+	}
+	for _, p := range []string{"sub", "sub/deep"} {
+		info, err := bx.Stat(nroot, p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bytes.Equal(info.ID, before[p].ID) {
+			t.Fatalf("%s id should change", p)
+		}
+		if info.Mode != before[p].Mode {
+			t.Fatalf("%s mode should not change", p)
+		}
+	}
+
+	for _, p := range []string{"sub/deep/new.txt", "sub/deep/b.txt", "created/dir/file"} {
+		info, err := bx.Stat(nroot, p)
+		if err != nil {
+			t.Fatal(p, err)
+		}
+		if info.IsDir() {
+			t.Fatal(p, "should be a file")
+		}
+	}
+	for _, p := range []string{"a.txt", "sub/b.txt"} {
+		if _, err = bx.Stat(nroot, p); err != ErrPathNotFound {
+			t.Fatalf(errCheckStr, ErrPathNotFound, err)
+		}
+	}
+
+	// Moving a directory carries its pending edits
+	nroot2, err := bx.UpdateTree(nroot,
+		PutOp("sub/deep/x", block.NewFileTreeNode("", idx.ID())),
+		RenameOp("sub/deep", "moved"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bx.Stat(nroot2, "moved/x"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = bx.Stat(nroot2, "moved/c.bin"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reverting produces the original ids
+	nroot3, err := bx.UpdateTree(nroot2, DeleteOp("moved/x"), RenameOp("moved", "sub/deep"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(nroot3, nroot) {
+		t.Fatal("reverted tree should have the same id")
+	}
+
+	// No-op keeps the root
+	if id, _ := bx.UpdateTree(root); !bytes.Equal(id, root) {
+		t.Fatal("root should not change")
+	}
+
+	// Errors
+	if _, err = bx.UpdateTree(root, DeleteOp("missing")); err != ErrPathNotFound {
+		t.Fatalf(errCheckStr, ErrPathNotFound, err)
+	}
+	if _, err = bx.UpdateTree(root, PutOp("a.txt/x", block.NewFileTreeNode("", idx.ID()))); err != ErrNotDirectory {
+		t.Fatalf(errCheckStr, ErrNotDirectory, err)
+	}
+	if _, err = bx.UpdateTree(root, RenameOp("sub", "sub/deep/sub")); err != errRenameIntoSelf {
+		t.Fatalf(errCheckStr, errRenameIntoSelf, err)
+	}
+}
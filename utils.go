@@ -14,8 +14,14 @@ var (
 	errIncompleteRead  = errors.New("incomplete read")
 )
 
+// writeHeaderAndID writes the header followed by the length prefixed id.  Ids are
+// variable length to allow for different hash functions.
 func writeHeaderAndID(wr io.Writer, header Header, id []byte) error {
-	d := append(header[:], id...)
+	if len(id) > maxIDSize {
+		return block.ErrInvalidBlock
+	}
+	d := append(header[:], byte(len(id)))
+	d = append(d, id...)
 	// Write header
 	n, err := wr.Write(d)
 	if err == nil {